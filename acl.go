@@ -0,0 +1,160 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Client access control lists
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+)
+
+// ACLRule represents a single access control rule. It matches
+// either a network (CIDR or a single address), or an address
+// family
+type ACLRule struct {
+	Text   string     // Rule as written in configuration
+	Net    *net.IPNet // Network to match, nil for family rule
+	Family string     // "all", "ipv4", "ipv6" or "loopback"
+}
+
+// ACLRules represents a list of ACL rules
+type ACLRules []ACLRule
+
+// ACL represents access control list
+//
+// Address matched by Deny rules is denied. Otherwise, address
+// matched by Allow rules is allowed
+type ACL struct {
+	Allow ACLRules // Allow rules
+	Deny  ACLRules // Deny rules
+}
+
+// ParseACLRules parses comma-separated list of ACL rules
+//
+// Each rule is either a network in CIDR notation
+// (i.e., 192.168.1.0/24 or fe80::/10), a single IP address,
+// or a keyword: all, ipv4, ipv6 or loopback
+func ParseACLRules(s string) (ACLRules, error) {
+	var rules ACLRules
+
+	for _, text := range strings.Split(s, ",") {
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+
+		rule := ACLRule{Text: text}
+
+		switch strings.ToLower(text) {
+		case "all", "ipv4", "ipv6", "loopback":
+			rule.Family = strings.ToLower(text)
+
+		default:
+			var err error
+
+			if strings.IndexByte(text, '/') < 0 {
+				ip := net.ParseIP(text)
+				if ip == nil {
+					return nil, fmt.Errorf("%q: invalid address", text)
+				}
+
+				bits := 8 * net.IPv6len
+				if ip4 := ip.To4(); ip4 != nil {
+					ip, bits = ip4, 8*net.IPv4len
+				}
+
+				rule.Net = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+			} else {
+				_, rule.Net, err = net.ParseCIDR(text)
+				if err != nil {
+					return nil, fmt.Errorf("%q: invalid network", text)
+				}
+			}
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// Match reports whether IP address matches any of rules
+func (rules ACLRules) Match(ip net.IP) bool {
+	for _, rule := range rules {
+		if rule.Match(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Match reports whether IP address matches the rule
+func (rule ACLRule) Match(ip net.IP) bool {
+	switch rule.Family {
+	case "all":
+		return true
+	case "ipv4":
+		return ip.To4() != nil
+	case "ipv6":
+		return ip.To4() == nil
+	case "loopback":
+		return ip.IsLoopback()
+	}
+
+	return rule.Net.Contains(ip)
+}
+
+// String returns string representation of rules, suitable
+// for ParseACLRules
+func (rules ACLRules) String() string {
+	var texts []string
+	for _, rule := range rules {
+		texts = append(texts, rule.Text)
+	}
+
+	return strings.Join(texts, ", ")
+}
+
+// Empty reports whether ACL contains no rules
+func (acl ACL) Empty() bool {
+	return len(acl.Allow) == 0 && len(acl.Deny) == 0
+}
+
+// Equal checks that two ACLs are equal
+func (acl ACL) Equal(acl2 ACL) bool {
+	return reflect.DeepEqual(acl, acl2)
+}
+
+// ACLCheck checks whether client with the specified IP address
+// is allowed by the list of ACLs, evaluated in priority order
+// (i.e., per-device ACL first, then the global one)
+//
+// The first ACL that explicitly denies or allows the address
+// makes the decision. If no ACL matches the address, it is
+// allowed only if there are no Allow rules at all
+func ACLCheck(ip net.IP, acls ...ACL) bool {
+	allowAll := true
+
+	for _, acl := range acls {
+		switch {
+		case acl.Deny.Match(ip):
+			return false
+		case acl.Allow.Match(ip):
+			return true
+		}
+
+		if len(acl.Allow) != 0 {
+			allowAll = false
+		}
+	}
+
+	return allowAll
+}
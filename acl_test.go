@@ -0,0 +1,103 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Client access control lists test
+ */
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+// Test matching of client addresses against access rules
+func TestACLCheck(t *testing.T) {
+	parse := func(s string) ACLRules {
+		rules, err := ParseACLRules(s)
+		if err != nil {
+			t.Fatalf("ParseACLRules(%q): %s", s, err)
+		}
+		return rules
+	}
+
+	device := ACL{
+		Allow: parse("192.168.1.10"),
+	}
+
+	global := ACL{
+		Allow: parse("loopback, 192.168.1.0/24, fd00::/8"),
+		Deny:  parse("192.168.1.0/28, ipv6"),
+	}
+
+	tests := []struct {
+		addr    string
+		allowed bool
+	}{
+		{"127.0.0.1", true},
+		{"::1", false},
+		{"192.168.1.10", true},
+		{"::ffff:192.168.1.10", true},
+		{"192.168.1.11", false},
+		{"192.168.1.100", true},
+		{"192.168.2.1", false},
+		{"fd00::1", false},
+	}
+
+	for _, test := range tests {
+		allowed := ACLCheck(net.ParseIP(test.addr), device, global)
+		if allowed != test.allowed {
+			t.Errorf("ACLCheck(%s): %v, expected %v",
+				test.addr, allowed, test.allowed)
+		}
+	}
+
+	// Without Allow rules, everything not denied is allowed
+	acl := ACL{Deny: parse("10.0.0.0/8")}
+	if !ACLCheck(net.ParseIP("192.168.1.1"), acl) ||
+		ACLCheck(net.ParseIP("10.1.2.3"), acl) {
+		t.Errorf("ACLCheck: deny-only ACL doesn't work")
+	}
+
+	if !ACLCheck(net.ParseIP("10.1.2.3")) {
+		t.Errorf("ACLCheck: empty ACL must allow everything")
+	}
+
+	// Syntax errors
+	for _, s := range []string{"192.168.1.256", "10.0.0.0/33", "local"} {
+		if _, err := ParseACLRules(s); err == nil {
+			t.Errorf("ParseACLRules(%q): error expected", s)
+		}
+	}
+
+	if s := parse(" all ,ipv4").String(); s != "all, ipv4" {
+		t.Errorf("ACLRules.String: %q", s)
+	}
+}
+
+// Test access control in HTTP proxy
+func TestACLProxy(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %s", err)
+	}
+
+	deny, _ := ParseACLRules("127.0.0.0/8")
+	proxy := NewHTTPProxy(NewLogger(), listener, nil, nil, nil,
+		ACL{Deny: deny})
+	defer proxy.Close()
+
+	url := "http://" + listener.Addr().String() + "/"
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("GET %s: %s", url, err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("GET %s: %s, expected 403", url, resp.Status)
+	}
+}
@@ -0,0 +1,486 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * HTTP Basic and Digest authentication
+ */
+
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// #cgo LDFLAGS: -lcrypt
+//
+// #include <crypt.h>
+// #include <stdlib.h>
+import "C"
+
+// AuthPolicy defines, how requests of some class are authenticated
+type AuthPolicy int
+
+// AuthPolicy values
+const (
+	AuthNone   AuthPolicy = iota // No authentication
+	AuthBasic                    // HTTP Basic authentication
+	AuthDigest                   // HTTP Digest authentication
+)
+
+// String returns AuthPolicy name, as used in configuration file
+func (policy AuthPolicy) String() string {
+	switch policy {
+	case AuthNone:
+		return "none"
+	case AuthBasic:
+		return "basic"
+	case AuthDigest:
+		return "digest"
+	}
+
+	return fmt.Sprintf("unknown (%d)", int(policy))
+}
+
+// AuthClass defines class of request for authentication purposes
+type AuthClass int
+
+// AuthClass values
+const (
+	AuthClassPrint AuthClass = iota // IPP requests
+	AuthClassScan                   // eSCL requests
+	AuthClassWeb                    // Everything else (web console)
+)
+
+// AuthConfig represents authentication configuration
+type AuthConfig struct {
+	PasswordFile string              // Path to the password file
+	Realm        string              // Authentication realm
+	Print        AuthPolicy          // Policy for printing
+	Scan         AuthPolicy          // Policy for scanning
+	Web          AuthPolicy          // Policy for web console
+	users        map[string]authUser // Loaded credentials
+}
+
+// authUser represents credentials of a single user
+type authUser struct {
+	hash string // htpasswd hash, "" if none
+	ha1  string // htdigest MD5(user:realm:password), "" if none
+}
+
+// authVerified caches successful verifications of hashed
+// passwords, because bcrypt is slow by design, and clients
+// send credentials with every request
+var authVerified struct {
+	sync.Mutex
+	keys map[string]struct{}
+}
+
+// authNonceKey is the secret key for Digest nonces
+var authNonceKey = authRandomKey()
+
+// Enabled reports whether authentication is enabled for any
+// class of requests
+func (auth *AuthConfig) Enabled() bool {
+	return auth.Print != AuthNone || auth.Scan != AuthNone ||
+		auth.Web != AuthNone
+}
+
+// Equal checks that two AuthConfigs are equal
+func (auth *AuthConfig) Equal(auth2 *AuthConfig) bool {
+	return reflect.DeepEqual(auth, auth2)
+}
+
+// Load loads the password file, if authentication is enabled
+//
+// The file is compatible with Apache htpasswd and htdigest
+// files. Lines of the htpasswd format (user:hash) are used
+// for Basic authentication; bcrypt, SHA-256/512 crypt ($5$, $6$)
+// and {SHA} hashes are supported. Lines of the htdigest format
+// (user:realm:hash) are used for both Basic and Digest
+// authentication, if realm matches
+func (auth *AuthConfig) Load() error {
+	if !auth.Enabled() {
+		return nil
+	}
+
+	if auth.PasswordFile == "" {
+		return errors.New("auth: password-file is required")
+	}
+
+	file, err := os.Open(auth.PasswordFile)
+	if err != nil {
+		return fmt.Errorf("auth: %s", err)
+	}
+
+	defer file.Close()
+
+	auth.users = make(map[string]authUser)
+	scanner := bufio.NewScanner(file)
+
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, ":")
+		user := auth.users[fields[0]]
+
+		switch {
+		case len(fields) == 2 && strings.HasPrefix(fields[1], "$apr1$"):
+			return fmt.Errorf("auth: %s:%d: $apr1$ hashes are not supported",
+				auth.PasswordFile, lineno)
+
+		case len(fields) == 2:
+			user.hash = fields[1]
+
+		case len(fields) == 3 && len(fields[2]) == 2*md5.Size:
+			if fields[1] != auth.Realm {
+				continue
+			}
+			user.ha1 = strings.ToLower(fields[2])
+
+		default:
+			return fmt.Errorf("auth: %s:%d: invalid line",
+				auth.PasswordFile, lineno)
+		}
+
+		auth.users[fields[0]] = user
+	}
+
+	if err = scanner.Err(); err != nil {
+		return fmt.Errorf("auth: %s", err)
+	}
+
+	return nil
+}
+
+// Class returns class of the request
+//
+// Path is normalized before matching, so "//eSCL/..." or "/./eSCL/..."
+// is still a scan request. Outside of eSCL, only safe methods (GET
+// and HEAD) are considered web console requests, and anything else
+// is considered printing: devices may accept print jobs regardless
+// of the Content-Type, so it cannot be relied upon
+func (auth *AuthConfig) Class(r *http.Request) AuthClass {
+	p := path.Clean("/" + strings.ToLower(r.URL.Path))
+
+	switch {
+	case p == "/escl" || strings.HasPrefix(p, "/escl/"):
+		return AuthClassScan
+	case r.Method != "GET" && r.Method != "HEAD":
+		return AuthClassPrint
+	}
+
+	return AuthClassWeb
+}
+
+// Policy returns authentication policy for the class of requests
+func (auth *AuthConfig) Policy(class AuthClass) AuthPolicy {
+	switch class {
+	case AuthClassPrint:
+		return auth.Print
+	case AuthClassScan:
+		return auth.Scan
+	}
+
+	return auth.Web
+}
+
+// Check checks request credentials against the policy
+//
+// On failure, it returns an error and a challenge, which must be sent
+// to client in the WWW-Authenticate header with 401 response status
+func (auth *AuthConfig) Check(r *http.Request, policy AuthPolicy) (
+	challenge string, err error) {
+
+	hdr := r.Header.Get("Authorization")
+
+	switch policy {
+	case AuthNone:
+		return "", nil
+
+	case AuthBasic:
+		challenge = fmt.Sprintf("Basic realm=%q", auth.Realm)
+		username, password, ok := r.BasicAuth()
+		switch {
+		case !ok:
+			err = errors.New("Basic authentication required")
+		case !auth.checkPassword(username, password):
+			err = fmt.Errorf("Authentication failed for user %q", username)
+		}
+
+	case AuthDigest:
+		var stale bool
+		challenge = fmt.Sprintf("Digest realm=%q, qop=\"auth\", "+
+			"algorithm=MD5, nonce=%q", auth.Realm, authNonce(time.Now()))
+
+		stale, err = auth.checkDigest(r.Method, r.RequestURI, hdr)
+		if stale {
+			challenge += ", stale=true"
+		}
+	}
+
+	return challenge, err
+}
+
+// checkPassword checks user's password
+func (auth *AuthConfig) checkPassword(username, password string) bool {
+	user, found := auth.users[username]
+
+	switch {
+	case !found:
+		return false
+
+	case user.hash != "":
+		return authCheckHash(user.hash, password)
+
+	case user.ha1 != "":
+		ha1 := authMD5(username, auth.Realm, password)
+		return subtle.ConstantTimeCompare([]byte(ha1), []byte(user.ha1)) == 1
+	}
+
+	return false
+}
+
+// checkDigest checks Digest credentials. If nonce is valid, but
+// expired, stale is returned as true, so client may retry without
+// asking user for a password
+func (auth *AuthConfig) checkDigest(method, uri, hdr string) (
+	stale bool, err error) {
+
+	if !strings.HasPrefix(hdr, "Digest ") {
+		return false, errors.New("Digest authentication required")
+	}
+
+	params := authParseParams(hdr[7:])
+	username := params["username"]
+	user, found := auth.users[username]
+
+	switch {
+	case !found || user.ha1 == "":
+		return false, fmt.Errorf("Authentication failed for user %q",
+			username)
+
+	case params["realm"] != auth.Realm || params["uri"] != uri:
+		return false, errors.New("Digest realm or uri mismatch")
+
+	case params["algorithm"] != "" &&
+		!strings.EqualFold(params["algorithm"], "MD5"):
+		return false, fmt.Errorf("Digest algorithm %q not supported",
+			params["algorithm"])
+	}
+
+	nonce := params["nonce"]
+	issued, ok := authNonceCheck(nonce)
+	if !ok {
+		return false, errors.New("Digest nonce invalid")
+	}
+
+	ha2 := authMD5(method, uri)
+	var expected string
+
+	switch params["qop"] {
+	case "":
+		expected = authMD5(user.ha1, nonce, ha2)
+	case "auth":
+		expected = authMD5(user.ha1, nonce, params["nc"],
+			params["cnonce"], "auth", ha2)
+	default:
+		return false, fmt.Errorf("Digest qop %q not supported",
+			params["qop"])
+	}
+
+	response := strings.ToLower(params["response"])
+	if subtle.ConstantTimeCompare([]byte(response), []byte(expected)) != 1 {
+		return false, fmt.Errorf("Authentication failed for user %q",
+			username)
+	}
+
+	if time.Since(issued) > AuthNonceLifetime {
+		return true, errors.New("Digest nonce expired")
+	}
+
+	return false, nil
+}
+
+// authCheckHash checks password against htpasswd hash
+func authCheckHash(hash, password string) bool {
+	sum := sha256.Sum256([]byte(hash + "\x00" + password))
+	key := string(sum[:])
+
+	authVerified.Lock()
+	_, ok := authVerified.keys[key]
+	authVerified.Unlock()
+
+	if ok {
+		return true
+	}
+
+	var computed string
+	if strings.HasPrefix(hash, "{SHA}") {
+		sum := sha1.Sum([]byte(password))
+		computed = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	} else {
+		computed = authCrypt(password, hash)
+	}
+
+	ok = computed != "" &&
+		subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1
+
+	if ok {
+		authVerified.Lock()
+		if authVerified.keys == nil {
+			authVerified.keys = make(map[string]struct{})
+		}
+		authVerified.keys[key] = struct{}{}
+		authVerified.Unlock()
+	}
+
+	return ok
+}
+
+// authCrypt hashes password, using crypt(3). Hashing method and
+// salt are taken from setting, which is usually the hash being
+// verified. On error, "" is returned
+func authCrypt(password, setting string) string {
+	data := (*C.struct_crypt_data)(C.calloc(1,
+		C.size_t(unsafe.Sizeof(C.struct_crypt_data{}))))
+	defer C.free(unsafe.Pointer(data))
+
+	cpassword := C.CString(password)
+	defer C.free(unsafe.Pointer(cpassword))
+
+	csetting := C.CString(setting)
+	defer C.free(unsafe.Pointer(csetting))
+
+	res := C.crypt_r(cpassword, csetting, data)
+	if res == nil {
+		return ""
+	}
+
+	hash := C.GoString(res)
+	if strings.HasPrefix(hash, "*") {
+		return ""
+	}
+
+	return hash
+}
+
+// authMD5 returns hex MD5 of colon-separated strings
+func authMD5(s ...string) string {
+	sum := md5.Sum([]byte(strings.Join(s, ":")))
+	return hex.EncodeToString(sum[:])
+}
+
+// authNonce generates Digest nonce. Nonce contains time of
+// its creation, signed with authNonceKey, so it can be verified
+// without keeping state
+func authNonce(t time.Time) string {
+	var stamp [8]byte
+	binary.BigEndian.PutUint64(stamp[:], uint64(t.Unix()))
+
+	mac := hmac.New(sha256.New, authNonceKey)
+	mac.Write(stamp[:])
+
+	return hex.EncodeToString(stamp[:]) + hex.EncodeToString(mac.Sum(nil))
+}
+
+// authNonceCheck verifies Digest nonce and returns time of
+// its creation
+func authNonceCheck(nonce string) (time.Time, bool) {
+	data, err := hex.DecodeString(nonce)
+	if err != nil || len(data) != 8+sha256.Size {
+		return time.Time{}, false
+	}
+
+	mac := hmac.New(sha256.New, authNonceKey)
+	mac.Write(data[:8])
+
+	if !hmac.Equal(mac.Sum(nil), data[8:]) {
+		return time.Time{}, false
+	}
+
+	return time.Unix(int64(binary.BigEndian.Uint64(data[:8])), 0), true
+}
+
+// authRandomKey generates random key for nonce signing
+func authRandomKey() []byte {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		panic(err)
+	}
+
+	return key
+}
+
+// authParseParams parses comma-separated list of name=value
+// pairs, as used by Digest Authorization header. Values may
+// be quoted
+func authParseParams(s string) map[string]string {
+	params := make(map[string]string)
+
+	for s != "" {
+		s = strings.TrimLeft(s, " \t,")
+
+		// Obtain name
+		i := strings.IndexByte(s, '=')
+		if i < 0 {
+			break
+		}
+
+		name := strings.ToLower(strings.TrimSpace(s[:i]))
+		s = strings.TrimLeft(s[i+1:], " \t")
+
+		// Obtain value
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			var buf strings.Builder
+			i = 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				buf.WriteByte(s[i])
+			}
+
+			value = buf.String()
+			if i < len(s) {
+				i++
+			}
+		} else {
+			i = strings.IndexByte(s, ',')
+			if i < 0 {
+				i = len(s)
+			}
+
+			value = strings.TrimSpace(s[:i])
+		}
+
+		params[name] = value
+		s = s[i:]
+	}
+
+	return params
+}
@@ -0,0 +1,386 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * HTTP Basic and Digest authentication test
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// authTestSetup creates AuthConfig with test users "bcrypt",
+// "sha512", "sha" (htpasswd entries with hashes of that kind) and
+// "digest" (htdigest entry). Password of all users is "secret"
+func authTestSetup(t *testing.T) (*AuthConfig, func()) {
+	dir, err := ioutil.TempDir("", "ipp-usb-test")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	bcrypt := authCrypt("secret", "$2b$05$abcdefghijklmnopqrstuu")
+	if bcrypt == "" {
+		t.Fatalf("authCrypt: bcrypt not supported")
+	}
+
+	path := filepath.Join(dir, "htpasswd")
+	data := "# Test users\n" +
+		"bcrypt:" + bcrypt + "\n" +
+		"sha512:" + authCrypt("secret", "$6$saltsalt$") + "\n" +
+		"sha:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n" +
+		"digest:ipp-usb:" + authMD5("digest", "ipp-usb", "secret") + "\n" +
+		"digest:other:" + authMD5("digest", "other", "other") + "\n"
+
+	err = ioutil.WriteFile(path, []byte(data), 0600)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	auth := &AuthConfig{
+		PasswordFile: path,
+		Realm:        "ipp-usb",
+		Print:        AuthBasic,
+		Scan:         AuthDigest,
+	}
+
+	err = auth.Load()
+	if err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+
+	return auth, func() { os.RemoveAll(dir) }
+}
+
+// Test SHA-crypt password hashes
+func TestAuthCrypt(t *testing.T) {
+	// Test vector from the SHA-crypt specification
+	hash := "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnI" +
+		"FNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"
+
+	if !authCheckHash(hash, "Hello world!") {
+		t.Errorf("authCheckHash: SHA-512 test vector failed")
+	}
+
+	if authCheckHash(hash, "Hello world") {
+		t.Errorf("authCheckHash: SHA-512 wrong password accepted")
+	}
+
+	if authCrypt("secret", "$invalid$") != "" {
+		t.Errorf("authCrypt: invalid setting accepted")
+	}
+}
+
+// Test HTTP Basic authentication
+func TestAuthBasic(t *testing.T) {
+	auth, cleanup := authTestSetup(t)
+	defer cleanup()
+
+	tests := []struct {
+		user, password string
+		ok             bool
+	}{
+		{"bcrypt", "secret", true},
+		{"bcrypt", "wrong", false},
+		{"sha512", "secret", true},
+		{"sha512", "wrong", false},
+		{"sha", "secret", true},
+		{"sha", "wrong", false},
+		{"digest", "secret", true},
+		{"digest", "other", false},
+		{"unknown", "secret", false},
+	}
+
+	for _, test := range tests {
+		// Repeat, to check cached verification
+		for i := 0; i < 2; i++ {
+			r, _ := http.NewRequest("POST", "/ipp/print", nil)
+			r.SetBasicAuth(test.user, test.password)
+
+			challenge, err := auth.Check(r, AuthBasic)
+			if (err == nil) != test.ok {
+				t.Errorf("Basic %s:%s: %v", test.user, test.password, err)
+			}
+
+			if err != nil && challenge != `Basic realm="ipp-usb"` {
+				t.Errorf("Basic: bad challenge %q", challenge)
+			}
+		}
+	}
+
+	r, _ := http.NewRequest("POST", "/ipp/print", nil)
+	if _, err := auth.Check(r, AuthBasic); err == nil {
+		t.Errorf("Basic: missed credentials accepted")
+	}
+}
+
+// Test HTTP Digest authentication
+func TestAuthDigest(t *testing.T) {
+	auth, cleanup := authTestSetup(t)
+	defer cleanup()
+
+	// digest builds Digest Authorization header
+	digest := func(user, password, nonce string) string {
+		uri := "/eSCL/ScannerStatus"
+		ha1 := authMD5(user, "ipp-usb", password)
+		ha2 := authMD5("GET", uri)
+		response := authMD5(ha1, nonce, "00000001", "0a4f113b", "auth", ha2)
+
+		return fmt.Sprintf(`Digest username="%s", realm="ipp-usb", `+
+			`nonce="%s", uri="%s", qop=auth, nc=00000001, `+
+			`cnonce="0a4f113b", response="%s"`,
+			user, nonce, uri, response)
+	}
+
+	check := func(hdr string) (string, error) {
+		r, _ := http.NewRequest("GET", "/eSCL/ScannerStatus", nil)
+		r.RequestURI = "/eSCL/ScannerStatus"
+		r.Header.Set("Authorization", hdr)
+		return auth.Check(r, AuthDigest)
+	}
+
+	nonce := authNonce(time.Now())
+
+	if _, err := check(digest("digest", "secret", nonce)); err != nil {
+		t.Errorf("Digest: %s", err)
+	}
+
+	if _, err := check(digest("digest", "wrong", nonce)); err == nil {
+		t.Errorf("Digest: wrong password accepted")
+	}
+
+	// htpasswd-only users cannot use Digest
+	if _, err := check(digest("sha", "secret", nonce)); err == nil {
+		t.Errorf("Digest: user without htdigest entry accepted")
+	}
+
+	// Forged nonce
+	forged := authNonce(time.Now())
+	forged = forged[:len(forged)-1] + "0"
+	if forged == nonce {
+		forged = forged[:len(forged)-1] + "1"
+	}
+
+	if _, err := check(digest("digest", "secret", forged)); err == nil {
+		t.Errorf("Digest: forged nonce accepted")
+	}
+
+	// Expired nonce
+	old := authNonce(time.Now().Add(-2 * AuthNonceLifetime))
+	challenge, err := check(digest("digest", "secret", old))
+	if err == nil || !strings.HasSuffix(challenge, "stale=true") {
+		t.Errorf("Digest: expired nonce: %v %q", err, challenge)
+	}
+
+	if !strings.HasPrefix(challenge, `Digest realm="ipp-usb", qop="auth"`) {
+		t.Errorf("Digest: bad challenge %q", challenge)
+	}
+}
+
+// Test loading of password file
+func TestAuthLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipp-usb-test")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "htpasswd")
+	auth := &AuthConfig{PasswordFile: path, Web: AuthBasic}
+
+	for _, data := range []string{
+		"user:$apr1$salt$hash\n",
+		"user\n",
+		"user:realm:nothex\n",
+	} {
+		ioutil.WriteFile(path, []byte(data), 0600)
+		if err = auth.Load(); err == nil {
+			t.Errorf("Load(%q): error expected", data)
+		}
+	}
+
+	// Password file is required, if authentication enabled
+	auth = &AuthConfig{Web: AuthBasic}
+	if err = auth.Load(); err == nil {
+		t.Errorf("Load: missed password file: error expected")
+	}
+
+	// But not otherwise
+	auth = &AuthConfig{}
+	if err = auth.Load(); err != nil {
+		t.Errorf("Load: disabled: %s", err)
+	}
+}
+
+// Test classification of requests
+func TestAuthClass(t *testing.T) {
+	auth := &AuthConfig{}
+
+	tests := []struct {
+		method, path, ct string
+		class            AuthClass
+	}{
+		{"POST", "/ipp/print", "application/ipp", AuthClassPrint},
+		{"POST", "/ipp/faxout", "application/ipp", AuthClassPrint},
+		{"GET", "/eSCL/ScannerCapabilities", "", AuthClassScan},
+		{"POST", "/escl/ScanJobs", "text/xml", AuthClassScan},
+		{"GET", "/", "", AuthClassWeb},
+		{"HEAD", "/", "", AuthClassWeb},
+		{"GET", "/eSCLx", "", AuthClassWeb},
+		{"GET", "/ipp/print", "", AuthClassWeb},
+
+		// Content-Type is not relied upon
+		{"POST", "/ipp/print", "", AuthClassPrint},
+		{"POST", "/ipp/print", "application/octet-stream", AuthClassPrint},
+		{"PUT", "/", "", AuthClassPrint},
+
+		// Path is normalized
+		{"GET", "//eSCL/ScanJobs", "", AuthClassScan},
+		{"GET", "/./eSCL/ScannerStatus", "", AuthClassScan},
+		{"POST", "/ipp/../escl/ScanJobs", "text/xml", AuthClassScan},
+	}
+
+	for _, test := range tests {
+		r, _ := http.NewRequest(test.method,
+			"http://localhost"+test.path, nil)
+		if test.ct != "" {
+			r.Header.Set("Content-Type", test.ct)
+		}
+
+		if class := auth.Class(r); class != test.class {
+			t.Errorf("Class(%s %s): %d, expected %d",
+				test.method, test.path, class, test.class)
+		}
+	}
+}
+
+// authTestTransport is the HTTPProxyTransport, that records
+// request headers
+type authTestTransport struct {
+	hdr chan http.Header
+}
+
+// RoundTripWithSession records request header and returns empty response
+func (tr authTestTransport) RoundTripWithSession(session int,
+	rq *http.Request) (*http.Response, error) {
+
+	tr.hdr <- rq.Header
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+	}
+
+	return resp, nil
+}
+
+// Panicked does nothing
+func (tr authTestTransport) Panicked(v interface{}) {}
+
+// Test authentication in HTTP proxy
+func TestAuthProxy(t *testing.T) {
+	auth, cleanup := authTestSetup(t)
+	defer cleanup()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %s", err)
+	}
+
+	tr := authTestTransport{make(chan http.Header, 1)}
+	proxy := NewHTTPProxy(NewLogger(), listener, tr, nil, auth)
+	defer proxy.Close()
+	proxy.Enable()
+
+	url := "http://localhost:" +
+		fmt.Sprint(listener.Addr().(*net.TCPAddr).Port) + "/ipp/print"
+
+	post := func(user string) *http.Response {
+		rq, _ := http.NewRequest("POST", url, strings.NewReader(""))
+		rq.Header.Set("Content-Type", "application/ipp")
+		if user != "" {
+			rq.SetBasicAuth(user, "secret")
+		}
+
+		resp, err := http.DefaultClient.Do(rq)
+		if err != nil {
+			t.Fatalf("POST %s: %s", url, err)
+		}
+		resp.Body.Close()
+
+		return resp
+	}
+
+	resp := post("")
+	if resp.StatusCode != http.StatusUnauthorized ||
+		resp.Header.Get("WWW-Authenticate") == "" {
+		t.Fatalf("POST without credentials: %s", resp.Status)
+	}
+
+	resp = post("sha")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST with credentials: %s", resp.Status)
+	}
+
+	if hdr := <-tr.hdr; hdr.Get("Authorization") != "" {
+		t.Fatalf("Authorization forwarded to device")
+	}
+
+	// Credentials are not forwarded, even if not required
+	rq, _ := http.NewRequest("GET", strings.TrimSuffix(url, "ipp/print"), nil)
+	rq.SetBasicAuth("sha", "secret")
+	resp, err = http.DefaultClient.Do(rq)
+	if err != nil {
+		t.Fatalf("GET %s: %s", rq.URL, err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET with credentials: %s", resp.Status)
+	}
+
+	if hdr := <-tr.hdr; hdr.Get("Authorization") != "" {
+		t.Fatalf("Authorization forwarded to device, policy none")
+	}
+
+	// Policies cannot be bypassed by Content-Type or path tricks
+	rq, _ = http.NewRequest("POST", url, strings.NewReader(""))
+	resp, err = http.DefaultClient.Do(rq)
+	if err != nil {
+		t.Fatalf("POST %s: %s", url, err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("POST without Content-Type: %s", resp.Status)
+	}
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "GET //eSCL/ScannerStatus HTTP/1.1\r\n"+
+		"Host: localhost\r\n\r\n")
+	resp, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("GET //eSCL/ScannerStatus: %s", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("GET //eSCL/ScannerStatus: %s", resp.Status)
+	}
+}
@@ -13,10 +13,13 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"net"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -26,22 +29,42 @@ const (
 
 // Configuration represents a program configuration
 type Configuration struct {
-	HTTPMinPort       int       // Starting port number for HTTP to bind to
-	HTTPMaxPort       int       // Ending port number for HTTP to bind to
-	DNSSdEnable       bool      // Enable DNS-SD advertising
-	LoopbackOnly      bool      // Use only loopback interface
-	IPV6Enable        bool      // Enable IPv6 advertising
-	LogDevice         LogLevel  // Per-device LogLevel mask
-	LogMain           LogLevel  // Main log LogLevel mask
-	LogConsole        LogLevel  // Console  LogLevel mask
-	LogMaxFileSize    int64     // Maximum log file size
-	LogMaxBackupFiles uint      // Count of files preserved during rotation
-	ColorConsole      bool      // Enable ANSI colors on console
-	Quirks            QuirksSet // Device quirks
+	HTTPMinPort       int           // Starting port number for HTTP to bind to
+	HTTPMaxPort       int           // Ending port number for HTTP to bind to
+	DNSSdEnable       bool          // Enable DNS-SD advertising
+	LoopbackOnly      bool          // Use only loopback interface
+	Interfaces        []string      // Use only these interfaces, nil for all
+	ListenAddrs       []string      // Listen only these addresses
+	IPV6Enable        bool          // Enable IPv6 advertising
+	TLSEnable         bool          // Enable TLS (IPPS/HTTPS)
+	TLSCertFile       string        // TLS certificate file, "" for generated
+	TLSKeyFile        string        // TLS private key file
+	ACL               ACL           // Global client access control list
+	Auth              AuthConfig    // HTTP authentication
+	LogDevice         LogLevel      // Per-device LogLevel mask
+	LogMain           LogLevel      // Main log LogLevel mask
+	LogConsole        LogLevel      // Console  LogLevel mask
+	LogMaxFileSize    int64         // Maximum log file size
+	LogMaxBackupFiles uint          // Count of files preserved during rotation
+	ColorConsole      bool          // Enable ANSI colors on console
+	UsbDetachIppOnly  bool          // Detach kernel driver from IPP interfaces only
+	UsbHotplugGrace   time.Duration // Grace period for removed devices
+	MetricsPort       int           // Metrics HTTP port, 0 if disabled
+	MetricsLoopback   bool          // Metrics on loopback interface only
+	StatusPort        int           // Status page HTTP port, 0 if disabled
+	StatusLoopback    bool          // Status page on loopback interface only
+	User              string        // Drop privileges to this user
+	Group             string        // And this group
+	CtrlGroup         string        // Control socket group, "" to keep
+	CtrlMode          os.FileMode   // Control socket permissions
+	StateDir          string        // Program state directory
+	LogDir            string        // Log directory
+	QuirksDir         string        // Quirks directory
+	Quirks            QuirksSet     // Device quirks
 }
 
-// Conf contains a global instance of program configuration
-var Conf = Configuration{
+// confDefault contains the default program configuration
+var confDefault = Configuration{
 	HTTPMinPort:       60000,
 	HTTPMaxPort:       65535,
 	DNSSdEnable:       true,
@@ -53,10 +76,63 @@ var Conf = Configuration{
 	LogMaxFileSize:    256 * 1024,
 	LogMaxBackupFiles: 5,
 	ColorConsole:      true,
+	MetricsLoopback:   true,
+	StatusLoopback:    true,
+	CtrlMode:          0600,
+	Auth:              AuthConfig{Realm: "ipp-usb"},
 }
 
-// ConfLoad loads the program configuration
+// confCurrent holds the current program configuration, as
+// *Configuration
+//
+// Configuration is loaded into a local variable and published
+// only when completely loaded and validated. Published configuration
+// is never modified in place, so it may be safely used by many
+// goroutines simultaneously
+var confCurrent atomic.Value
+
+func init() {
+	confSet(confDefault)
+}
+
+// Conf returns the current program configuration
+//
+// Returned configuration is shared and must not be modified
+func Conf() *Configuration {
+	return confCurrent.Load().(*Configuration)
+}
+
+// confSet publishes new program configuration
+func confSet(conf Configuration) {
+	confCurrent.Store(&conf)
+}
+
+// ConfLoad loads the program configuration from scratch
+//
+// On error, the current configuration remains unchanged
 func ConfLoad() error {
+	conf := confDefault
+
+	err := confLoad(&conf)
+	if err != nil {
+		return err
+	}
+
+	confSet(conf)
+	return nil
+}
+
+// ConfReload reloads the program configuration from scratch
+//
+// The previous configuration is returned, so caller can find out
+// what was changed. On error, configuration remains unchanged
+func ConfReload() (*Configuration, error) {
+	old := Conf()
+	return old, ConfLoad()
+}
+
+// confLoad loads the program configuration into conf
+func confLoad(conf *Configuration) error {
 	// Obtain path to executable directory
 	exepath, err := os.Executable()
 	if err != nil {
@@ -65,29 +141,48 @@ func ConfLoad() error {
 
 	exepath = filepath.Dir(exepath)
 
-	// Build list of configuration files
+	// Build list of configuration files. If configuration
+	// file is given explicitly, only this file is loaded
 	files := []string{
 		filepath.Join(PathConfDir, ConfFileName),
 		filepath.Join(exepath, ConfFileName),
 	}
 
+	if PathOverrides.ConfFile != "" {
+		_, err = os.Stat(PathOverrides.ConfFile)
+		if err != nil {
+			return fmt.Errorf("conf: %s", err)
+		}
+
+		files = []string{PathOverrides.ConfFile}
+	}
+
 	// Load file by file
 	for _, file := range files {
-		err = confLoadInternal(file)
+		err = confLoadInternal(conf, file)
 		if err != nil {
 			return fmt.Errorf("conf: %s", err)
 		}
 	}
 
+	// Load password file
+	err = conf.Auth.Load()
+	if err != nil {
+		return fmt.Errorf("conf: %s", err)
+	}
+
 	// Load quirks
+	quirksDir := PathQuirksDir
+	if conf.QuirksDir != "" && PathOverrides.QuirksDir == "" {
+		quirksDir = conf.QuirksDir
+	}
+
 	quirksDirs := []string{
-		PathQuirksDir,
+		quirksDir,
 		filepath.Join(exepath, "ipp-usb-quirks"),
 	}
 
-	if err == nil {
-		Conf.Quirks, err = LoadQuirksSet(quirksDirs...)
-	}
+	conf.Quirks, err = LoadQuirksSet(quirksDirs...)
 
 	return err
 }
@@ -98,7 +193,7 @@ func confBadValue(rec *IniRecord, format string, args ...interface{}) error {
 }
 
 // Load the program configuration -- internal version
-func confLoadInternal(path string) error {
+func confLoadInternal(conf *Configuration, path string) error {
 	// Open configuration file
 	ini, err := OpenIniFile(path)
 	if err != nil {
@@ -122,30 +217,104 @@ func confLoadInternal(path string) error {
 		case "network":
 			switch rec.Key {
 			case "http-min-port":
-				err = confLoadIPPortKey(&Conf.HTTPMinPort, rec)
+				err = confLoadIPPortKey(&conf.HTTPMinPort, rec)
 			case "http-max-port":
-				err = confLoadIPPortKey(&Conf.HTTPMaxPort, rec)
+				err = confLoadIPPortKey(&conf.HTTPMaxPort, rec)
 			case "dns-sd":
-				err = confLoadBinaryKey(&Conf.DNSSdEnable, rec, "disable", "enable")
+				err = confLoadBinaryKey(&conf.DNSSdEnable, rec, "disable", "enable")
 			case "interface":
-				err = confLoadBinaryKey(&Conf.LoopbackOnly, rec, "all", "loopback")
+				err = confLoadInterfaceKey(conf, rec)
+			case "listen":
+				err = confLoadListenKey(&conf.ListenAddrs, rec)
 			case "ipv6":
-				err = confLoadBinaryKey(&Conf.IPV6Enable, rec, "disable", "enable")
+				err = confLoadBinaryKey(&conf.IPV6Enable, rec, "disable", "enable")
+			case "tls":
+				err = confLoadBinaryKey(&conf.TLSEnable, rec, "disable", "enable")
+			case "tls-cert-file":
+				err = confLoadPathKey(&conf.TLSCertFile, rec)
+			case "tls-key-file":
+				err = confLoadPathKey(&conf.TLSKeyFile, rec)
+			}
+		case "access":
+			switch rec.Key {
+			case "allow":
+				err = confLoadACLKey(&conf.ACL.Allow, rec)
+			case "deny":
+				err = confLoadACLKey(&conf.ACL.Deny, rec)
+			}
+		case "auth":
+			switch rec.Key {
+			case "password-file":
+				err = confLoadPathKey(&conf.Auth.PasswordFile, rec)
+			case "realm":
+				conf.Auth.Realm = rec.Value
+			case "print":
+				err = confLoadAuthPolicyKey(&conf.Auth.Print, rec)
+			case "scan":
+				err = confLoadAuthPolicyKey(&conf.Auth.Scan, rec)
+			case "web":
+				err = confLoadAuthPolicyKey(&conf.Auth.Web, rec)
 			}
 		case "logging":
 			switch rec.Key {
 			case "device-log":
-				err = confLoadLogLevelKey(&Conf.LogDevice, rec)
+				err = confLoadLogLevelKey(&conf.LogDevice, rec)
 			case "main-log":
-				err = confLoadLogLevelKey(&Conf.LogMain, rec)
+				err = confLoadLogLevelKey(&conf.LogMain, rec)
 			case "console-log":
-				err = confLoadLogLevelKey(&Conf.LogConsole, rec)
+				err = confLoadLogLevelKey(&conf.LogConsole, rec)
 			case "console-color":
-				err = confLoadBinaryKey(&Conf.ColorConsole, rec, "disable", "enable")
+				err = confLoadBinaryKey(&conf.ColorConsole, rec, "disable", "enable")
 			case "max-file-size":
-				err = confLoadSizeKey(&Conf.LogMaxFileSize, rec)
+				err = confLoadSizeKey(&conf.LogMaxFileSize, rec)
 			case "max-backup-files":
-				err = confLoadUintKey(&Conf.LogMaxBackupFiles, rec)
+				err = confLoadUintKey(&conf.LogMaxBackupFiles, rec)
+			}
+		case "usb":
+			switch rec.Key {
+			case "detach-kernel-driver":
+				err = confLoadBinaryKey(&conf.UsbDetachIppOnly, rec, "all", "ipp-only")
+			case "hotplug-grace-period":
+				err = confLoadDurationKey(&conf.UsbHotplugGrace, rec)
+			}
+		case "metrics":
+			switch rec.Key {
+			case "port":
+				err = confLoadIPPortKey(&conf.MetricsPort, rec)
+			case "interface":
+				err = confLoadBinaryKey(&conf.MetricsLoopback,
+					rec, "all", "loopback")
+			}
+		case "paths":
+			switch rec.Key {
+			case "state-dir":
+				err = confLoadPathKey(&conf.StateDir, rec)
+			case "log-dir":
+				err = confLoadPathKey(&conf.LogDir, rec)
+			case "quirks-dir":
+				err = confLoadPathKey(&conf.QuirksDir, rec)
+			}
+		case "security":
+			switch rec.Key {
+			case "user":
+				conf.User = rec.Value
+			case "group":
+				conf.Group = rec.Value
+			}
+		case "control":
+			switch rec.Key {
+			case "group":
+				conf.CtrlGroup = rec.Value
+			case "mode":
+				err = confLoadModeKey(&conf.CtrlMode, rec)
+			}
+		case "status-page":
+			switch rec.Key {
+			case "port":
+				err = confLoadIPPortKey(&conf.StatusPort, rec)
+			case "interface":
+				err = confLoadBinaryKey(&conf.StatusLoopback,
+					rec, "all", "loopback")
 			}
 		}
 	}
@@ -155,10 +324,22 @@ func confLoadInternal(path string) error {
 	}
 
 	// Validate configuration
-	if Conf.HTTPMinPort >= Conf.HTTPMaxPort {
+	if conf.HTTPMinPort >= conf.HTTPMaxPort {
 		return errors.New("http-min-port must be less that http-max-port")
 	}
 
+	if !conf.IPV6Enable {
+		for _, addr := range conf.ListenAddrs {
+			if net.ParseIP(addr).To4() == nil {
+				return fmt.Errorf("listen: %q: IPv6 is disabled", addr)
+			}
+		}
+	}
+
+	if (conf.TLSCertFile == "") != (conf.TLSKeyFile == "") {
+		return errors.New("tls-cert-file and tls-key-file must be used together")
+	}
+
 	return nil
 }
 
@@ -248,6 +429,109 @@ func confLoadSizeKey(out *int64, rec *IniRecord) error {
 	return nil
 }
 
+// Load duration key
+func confLoadDurationKey(out *time.Duration, rec *IniRecord) error {
+	d, err := time.ParseDuration(rec.Value)
+	if err != nil || d < 0 {
+		return confBadValue(rec, "%q: invalid duration", rec.Value)
+	}
+
+	*out = d
+	return nil
+}
+
+// Load path key. Path must be absolute
+func confLoadPathKey(out *string, rec *IniRecord) error {
+	if !filepath.IsAbs(rec.Value) {
+		return confBadValue(rec, "%q: path must be absolute", rec.Value)
+	}
+
+	*out = filepath.Clean(rec.Value)
+	return nil
+}
+
+// Load network interface key. Its value is either "all",
+// "loopback" or comma-separated list of interface names
+func confLoadInterfaceKey(conf *Configuration, rec *IniRecord) error {
+	switch rec.Value {
+	case "all", "loopback":
+		conf.Interfaces = nil
+		return confLoadBinaryKey(&conf.LoopbackOnly, rec, "all", "loopback")
+	}
+
+	var names []string
+	for _, name := range strings.Split(rec.Value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || strings.ContainsAny(name, " \t/") {
+			return confBadValue(rec, "%q: invalid interface name", name)
+		}
+		names = append(names, name)
+	}
+
+	conf.LoopbackOnly = false
+	conf.Interfaces = names
+
+	return nil
+}
+
+// Load listen addresses key. Its value is comma-separated list
+// of IP addresses
+func confLoadListenKey(out *[]string, rec *IniRecord) error {
+	var addrs []string
+
+	for _, addr := range strings.Split(rec.Value, ",") {
+		addr = strings.TrimSpace(addr)
+		ip := addr
+		if i := strings.IndexByte(ip, '%'); i >= 0 {
+			ip = ip[:i]
+		}
+
+		if net.ParseIP(ip) == nil {
+			return confBadValue(rec, "%q: invalid IP address", addr)
+		}
+
+		addrs = append(addrs, addr)
+	}
+
+	*out = addrs
+	return nil
+}
+
+// Load ACL key. Rules are appended, so key may be repeated
+func confLoadACLKey(out *ACLRules, rec *IniRecord) error {
+	rules, err := ParseACLRules(rec.Value)
+	if err != nil {
+		return confBadValue(rec, "%s", err)
+	}
+
+	*out = append(*out, rules...)
+	return nil
+}
+
+// Load authentication policy key
+func confLoadAuthPolicyKey(out *AuthPolicy, rec *IniRecord) error {
+	for _, policy := range []AuthPolicy{AuthNone, AuthBasic, AuthDigest} {
+		if rec.Value == policy.String() {
+			*out = policy
+			return nil
+		}
+	}
+
+	return confBadValue(rec, "must be none, basic or digest")
+}
+
+// Load file mode key. Mode is octal number, only permission
+// bits are allowed
+func confLoadModeKey(out *os.FileMode, rec *IniRecord) error {
+	mode, err := strconv.ParseUint(rec.Value, 8, 32)
+	if err != nil || mode&^0777 != 0 {
+		return confBadValue(rec, "%q: invalid mode", rec.Value)
+	}
+
+	*out = os.FileMode(mode)
+	return nil
+}
+
 // Load unsigned integer key
 func confLoadUintKey(out *uint, rec *IniRecord) error {
 	num, err := strconv.ParseUint(rec.Value, 10, 0)
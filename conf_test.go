@@ -0,0 +1,100 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Program configuration test
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// confTestSet publishes a modified copy of the current configuration
+// and returns function that restores the previous configuration
+func confTestSet(update func(conf *Configuration)) func() {
+	saved := Conf()
+	conf := *saved
+	update(&conf)
+	confSet(conf)
+
+	return func() { confSet(*saved) }
+}
+
+// Test configuration reload
+func TestConfReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipp-usb-test")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer confTestSet(func(*Configuration) {})()
+	defer PathOverride(PathParams{}, PathParams{})
+
+	path := filepath.Join(dir, "test.conf")
+	PathOverride(PathParams{ConfFile: path}, PathParams{})
+
+	err = ioutil.WriteFile(path, []byte("[network]\n"+
+		"http-min-port = 61000\n"+
+		"interface = all\n"), 0644)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	// Readers may use configuration while it is reloaded
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				conf := Conf()
+				if conf.HTTPMinPort >= conf.HTTPMaxPort {
+					t.Errorf("inconsistent configuration seen")
+					return
+				}
+			}
+		}
+	}()
+
+	old, err := ConfReload()
+	if err != nil {
+		t.Fatalf("ConfReload: %s", err)
+	}
+
+	conf := Conf()
+	if conf.HTTPMinPort != 61000 || conf.LoopbackOnly || conf == old {
+		t.Errorf("ConfReload: configuration not applied")
+	}
+
+	// Invalid configuration is not published
+	err = ioutil.WriteFile(path, []byte("[network]\n"+
+		"interface = loopback\n"+
+		"http-min-port = 65535\n"), 0644)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	_, err = ConfReload()
+	if err == nil {
+		t.Errorf("ConfReload: invalid port range: error expected")
+	}
+
+	if Conf() != conf {
+		t.Errorf("ConfReload: invalid configuration published")
+	}
+
+	close(done)
+	wg.Wait()
+}
@@ -28,4 +28,78 @@ const (
 	// DNSSdRetryInterval specifies the retry interval in a case
 	// of failed DNS-SD operation
 	DNSSdRetryInterval = 1 * time.Second
+
+	// DevInitRetryMaxInterval specifies the maximum retry interval
+	// for failed device initialization. Actual retry intervals
+	// depend on the error class and grow exponentially up to this
+	// value
+	DevInitRetryMaxInterval = 10 * time.Minute
+
+	// UsbDefaultTransferSize specifies the default size of
+	// USB bulk transfer, unless overridden by quirks
+	UsbDefaultTransferSize = 16384
+
+	// UsbDefaultQueueDepth specifies the default count of USB
+	// bulk transfers, queued per endpoint, unless overridden
+	// by quirks
+	UsbDefaultQueueDepth = 4
+
+	// UsbDrainIdleTimeout specifies how long to wait for data
+	// from device, when draining desynchronized connection.
+	// If nothing received within this interval, connection
+	// considered drained
+	UsbDrainIdleTimeout = 250 * time.Millisecond
+
+	// UsbDrainTimeout specifies the maximum time, spent for
+	// draining desynchronized connection
+	UsbDrainTimeout = 5 * time.Second
+
+	// UsbResyncMaxAttempts specifies how many times in a row
+	// connection may be resynchronized, before device reset
+	// is requested
+	UsbResyncMaxAttempts = 3
+
+	// UsbStallTimeout specifies how long USB connection may be
+	// blocked in read or write without any progress, before
+	// watchdog considers it stalled, unless overridden by quirks
+	UsbStallTimeout = 120 * time.Second
+
+	// UsbInitDelay specifies the default delay between device
+	// configuration and the first I/O. Printer may require
+	// some time to switch configuration
+	UsbInitDelay = time.Second / 4
+
+	// UsbWatchdogInterval specifies how often watchdog checks
+	// connections for progress. Blocking USB I/O is also performed
+	// in chunks of this duration, so watchdog can interrupt it
+	UsbWatchdogInterval = 1 * time.Second
+
+	// PnPRequestTimeout specifies how long to wait until PnP
+	// manager applies the request, sent via control socket. PnP
+	// manager may be busy for a while, reloading configuration
+	PnPRequestTimeout = 2 * DevInitTimeout
+
+	// TLSSniffTimeout specifies how long to wait for the first
+	// byte from client, when detecting whether connection is
+	// plain HTTP or TLS
+	TLSSniffTimeout = 10 * time.Second
+
+	// TLSAcceptRetryMin and TLSAcceptRetryMax specify bounds of
+	// the exponential backoff, when accepting of the incoming
+	// connection fails with the temporary error
+	TLSAcceptRetryMin = 5 * time.Millisecond
+	TLSAcceptRetryMax = 1 * time.Second
+
+	// TLSCertLifetime specifies validity period of generated
+	// self-signed certificates
+	TLSCertLifetime = 10 * 365 * 24 * time.Hour
+
+	// AuthNonceLifetime specifies how long HTTP Digest
+	// authentication nonce remains valid
+	AuthNonceLifetime = 5 * time.Minute
+
+	// URLRewriteMaxXMLSize specifies the maximum size of eSCL XML
+	// document, URLs in which are rewritten. Larger documents are
+	// passed as is
+	URLRewriteMaxXMLSize = 1024 * 1024
 )
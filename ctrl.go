@@ -0,0 +1,370 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Control socket
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// CtrlProtoVersion is the version of the control protocol
+//
+// Protocol is the sequence of JSON objects, exchanged over the
+// Unix domain stream socket. Client sends CtrlRequest, server
+// replies with CtrlResponse. Multiple requests may be sent
+// over the same connection
+const CtrlProtoVersion = 1
+
+// CtrlRequest represents the control request
+type CtrlRequest struct {
+	Version int    `json:"version"`          // Protocol version
+	Command string `json:"command"`          // Command name
+	Device  string `json:"device,omitempty"` // USB address or Ident
+	Log     string `json:"log,omitempty"`    // main, console or device
+	Levels  string `json:"levels,omitempty"` // Log levels, as in config
+}
+
+// CtrlResponse represents the control response
+type CtrlResponse struct {
+	Version   int             `json:"version"`              // Protocol version
+	Error     string          `json:"error,omitempty"`      // Error, if any
+	Pid       int             `json:"pid,omitempty"`        // Daemon's pid
+	Started   string          `json:"started,omitempty"`    // Start time
+	LogLevels *CtrlLogLevels  `json:"log_levels,omitempty"` // Log levels
+	Devices   []CtrlDevStatus `json:"devices,omitempty"`    // Devices
+}
+
+// CtrlLogLevels represents log levels, currently in effect
+type CtrlLogLevels struct {
+	Main    string `json:"main"`    // The main log
+	Console string `json:"console"` // Console log
+	Device  string `json:"device"`  // Per-device logs
+}
+
+// CtrlDevStatus represents device status
+//
+// The "status" command returns only the PnP manager's view
+// of devices (state, error and retry), the "devices" command
+// returns all the parameters
+type CtrlDevStatus struct {
+	UsbAddr   string   `json:"usb_addr"`              // USB address
+	State     string   `json:"state"`                 // PnPDevState
+	Error     string   `json:"error,omitempty"`       // Last init error
+	ErrClass  string   `json:"error_class,omitempty"` // Its class
+	Attempts  int      `json:"attempts,omitempty"`    // Failed attempts
+	NextRetry string   `json:"next_retry,omitempty"`  // Next retry time
+	Ident     string   `json:"ident,omitempty"`       // Device identity
+	HTTPPort  int      `json:"http_port,omitempty"`   // HTTP port
+	DNSSdName string   `json:"dns_sd_name,omitempty"` // DNS-SD name
+	Quirks    []string `json:"quirks,omitempty"`      // Applied quirks
+	ConnState string   `json:"conn_state,omitempty"`  // USB connections
+}
+
+// CtrlServer serves the control socket
+type CtrlServer struct {
+	listener net.Listener          // Control socket listener
+	started  time.Time             // Server start time
+	lock     sync.Mutex            // Access lock
+	conns    map[net.Conn]struct{} // Active connections
+	closed   bool                  // Server is closed
+	done     sync.WaitGroup        // To wait for goroutines termination
+}
+
+// NewCtrlServer creates the control socket at PathCtrlSocket
+// and starts serving it
+//
+// By default, socket is accessible only to its owner, which limits
+// access to the control API. Socket group and permissions may be
+// configured in the [control] section
+func NewCtrlServer() (*CtrlServer, error) {
+	os.MkdirAll(filepath.Dir(PathCtrlSocket), 0755)
+
+	// Remove stale socket, if any. Caller holds the program
+	// lock, so socket can't belong to the running ipp-usb
+	os.Remove(PathCtrlSocket)
+
+	mask := syscall.Umask(0077)
+	listener, err := net.Listen("unix", PathCtrlSocket)
+	syscall.Umask(mask)
+
+	if err != nil {
+		return nil, fmt.Errorf("control socket: %s", err)
+	}
+
+	err = ctrlSetPerms(Conf())
+	if err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("control socket: %s", err)
+	}
+
+	srv := &CtrlServer{
+		listener: listener,
+		started:  time.Now(),
+		conns:    make(map[net.Conn]struct{}),
+	}
+
+	srv.done.Add(1)
+	go srv.serve()
+
+	return srv, nil
+}
+
+// ctrlSetPerms applies configured group and permissions
+// to the control socket
+func ctrlSetPerms(conf *Configuration) error {
+	if conf.CtrlGroup != "" {
+		gid, err := privsLookupGroup(conf.CtrlGroup)
+		if err != nil {
+			return err
+		}
+
+		err = os.Chown(PathCtrlSocket, -1, gid)
+		if err != nil {
+			return err
+		}
+	}
+
+	return os.Chmod(PathCtrlSocket, conf.CtrlMode)
+}
+
+// Close the server
+func (srv *CtrlServer) Close() {
+	srv.lock.Lock()
+	srv.closed = true
+	srv.listener.Close()
+	for conn := range srv.conns {
+		conn.Close()
+	}
+	srv.lock.Unlock()
+
+	srv.done.Wait()
+}
+
+// serve accepts incoming connections
+func (srv *CtrlServer) serve() {
+	defer srv.done.Done()
+
+	for {
+		conn, err := srv.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		srv.lock.Lock()
+		if srv.closed {
+			srv.lock.Unlock()
+			conn.Close()
+			return
+		}
+
+		srv.conns[conn] = struct{}{}
+		srv.done.Add(1)
+		srv.lock.Unlock()
+
+		go srv.handleConn(conn)
+	}
+}
+
+// handleConn handles a single client connection
+func (srv *CtrlServer) handleConn(conn net.Conn) {
+	// Catch panics to log
+	defer func() {
+		v := recover()
+		if v != nil {
+			Log.Panic(v)
+		}
+	}()
+
+	defer srv.done.Done()
+
+	defer func() {
+		srv.lock.Lock()
+		delete(srv.conns, conn)
+		srv.lock.Unlock()
+		conn.Close()
+	}()
+
+	decoder := json.NewDecoder(conn)
+	encoder := json.NewEncoder(conn)
+
+	for {
+		var rq CtrlRequest
+		var rsp CtrlResponse
+
+		err := decoder.Decode(&rq)
+		if err == io.EOF {
+			return
+		}
+
+		if err == nil {
+			rsp = srv.handleRequest(rq)
+		} else {
+			rsp = CtrlResponse{Error: err.Error()}
+		}
+
+		rsp.Version = CtrlProtoVersion
+		if encoder.Encode(rsp) != nil || err != nil {
+			return
+		}
+	}
+}
+
+// handleRequest handles a single request
+func (srv *CtrlServer) handleRequest(rq CtrlRequest) CtrlResponse {
+	var rsp CtrlResponse
+	var err error
+
+	if rq.Version != CtrlProtoVersion {
+		err = fmt.Errorf("unsupported protocol version %d", rq.Version)
+		return CtrlResponse{Error: err.Error()}
+	}
+
+	Log.Debug(' ', "CTRL: %q request received", rq.Command)
+
+	switch rq.Command {
+	case "status":
+		levels := PnPCurrentLogLevels()
+
+		rsp.Pid = os.Getpid()
+		rsp.Started = srv.started.Format(time.RFC3339)
+		rsp.LogLevels = &CtrlLogLevels{
+			Main:    levels.Main.String(),
+			Console: levels.Console.String(),
+			Device:  levels.Device.String(),
+		}
+
+		for _, st := range PnPStatus() {
+			rsp.Devices = append(rsp.Devices, ctrlDevStatus(st, false))
+		}
+
+	case "devices":
+		for _, st := range PnPStatus() {
+			rsp.Devices = append(rsp.Devices, ctrlDevStatus(st, true))
+		}
+
+	case "reset":
+		var addr UsbAddr
+		addr, err = ctrlFindDevice(rq.Device)
+		if err == nil {
+			transport := pnpStatusTransport(addr)
+			if transport == nil {
+				err = fmt.Errorf("%s: device is not ready", addr)
+			} else {
+				Log.Info('-', "CTRL: %s: reset requested", addr)
+				transport.requestReset("requested via control socket")
+			}
+		}
+
+	case "reprobe":
+		var addr UsbAddr
+		addr, err = ctrlFindDevice(rq.Device)
+		if err == nil {
+			Log.Info('-', "CTRL: %s: re-probe requested", addr)
+			PnPRequestReprobe(addr)
+		}
+
+	case "loglevel":
+		err = ctrlSetLogLevels(rq.Log, rq.Levels)
+
+	default:
+		err = fmt.Errorf("unknown command %q", rq.Command)
+	}
+
+	if err != nil {
+		rsp = CtrlResponse{Error: err.Error()}
+	}
+
+	return rsp
+}
+
+// ctrlDevStatus converts PnPDevStatus into CtrlDevStatus. If
+// full is false, only the PnP manager's view is returned
+func ctrlDevStatus(st PnPDevStatus, full bool) CtrlDevStatus {
+	out := CtrlDevStatus{
+		UsbAddr:  st.UsbAddr.String(),
+		State:    st.State.String(),
+		Error:    st.Err,
+		Attempts: st.Attempts,
+	}
+
+	if st.Err != "" {
+		out.ErrClass = st.ErrClass.String()
+	}
+
+	if !st.NextRetry.IsZero() {
+		out.NextRetry = st.NextRetry.Format(time.RFC3339)
+	}
+
+	if full {
+		out.Ident = st.Ident
+		out.HTTPPort = st.HTTPPort
+		out.DNSSdName = st.DNSSdName
+		out.Quirks = st.Quirks
+		out.ConnState = st.ConnState
+	}
+
+	return out
+}
+
+// ctrlFindDevice finds device, known to PnP manager, by its USB
+// address or Ident
+func ctrlFindDevice(device string) (UsbAddr, error) {
+	if device == "" {
+		return UsbAddr{}, errors.New("device not specified")
+	}
+
+	addr, err := ParseUsbAddr(device)
+	for _, st := range PnPStatus() {
+		if (err == nil && st.UsbAddr == addr) || st.Ident == device {
+			return st.UsbAddr, nil
+		}
+	}
+
+	return UsbAddr{}, fmt.Errorf("%s: device not found", device)
+}
+
+// ctrlSetLogLevels changes log levels at runtime
+func ctrlSetLogLevels(log, levels string) error {
+	var target PnPLogTarget
+
+	switch log {
+	case "main":
+		target = PnPLogMain
+	case "console":
+		target = PnPLogConsole
+	case "device":
+		target = PnPLogDevice
+	default:
+		return fmt.Errorf("invalid log %q", log)
+	}
+
+	var mask LogLevel
+	err := confLoadLogLevelKey(&mask,
+		&IniRecord{Key: "levels", Value: levels})
+	if err != nil {
+		return err
+	}
+
+	err = PnPSetLogLevels(target, mask)
+	if err != nil {
+		return fmt.Errorf("%s log levels not set: %s", log, err)
+	}
+
+	Log.Info(' ', "CTRL: %s log levels set to %s", log, mask)
+
+	return nil
+}
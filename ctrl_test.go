@@ -0,0 +1,337 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Control socket test
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// ctrlTestClient is the control socket client for tests
+type ctrlTestClient struct {
+	t       *testing.T
+	conn    net.Conn
+	encoder *json.Encoder
+	decoder *json.Decoder
+}
+
+// request sends request and returns response
+func (c *ctrlTestClient) request(rq CtrlRequest) CtrlResponse {
+	var rsp CtrlResponse
+
+	err := c.encoder.Encode(rq)
+	if err == nil {
+		err = c.decoder.Decode(&rsp)
+	}
+
+	if err != nil {
+		c.t.Fatalf("control request %q: %s", rq.Command, err)
+	}
+
+	if rsp.Version != CtrlProtoVersion {
+		c.t.Fatalf("control request %q: version %d", rq.Command,
+			rsp.Version)
+	}
+
+	return rsp
+}
+
+// wait sends request until check returns true
+func (c *ctrlTestClient) wait(rq CtrlRequest,
+	check func(rsp CtrlResponse) bool) CtrlResponse {
+
+	var rsp CtrlResponse
+	for tm := time.Now(); time.Since(tm) < DevInitTimeout; {
+		rsp = c.request(rq)
+		if check(rsp) {
+			return rsp
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	c.t.Fatalf("control request %q: unexpected response %+v",
+		rq.Command, rsp)
+	return rsp
+}
+
+// Test control socket requests
+func TestCtrl(t *testing.T) {
+	backend, dev, cleanup := usbSimTestSetup(t)
+	defer cleanup()
+
+	savedConf := Conf()
+	savedLevels := Log.Levels()
+	defer func() {
+		confSet(*savedConf)
+		Log.SetLevels(savedLevels)
+	}()
+
+	srv, err := NewCtrlServer()
+	if err != nil {
+		t.Fatalf("NewCtrlServer: %s", err)
+	}
+	defer srv.Close()
+
+	// Socket must be accessible only to owner
+	fi, err := os.Stat(PathCtrlSocket)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if fi.Mode().Perm()&0077 != 0 {
+		t.Fatalf("%s: insecure permissions %s", PathCtrlSocket,
+			fi.Mode().Perm())
+	}
+
+	// Start PnP manager
+	exited := usbSimTestStartPnP()
+
+	conn, err := net.Dial("unix", PathCtrlSocket)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer conn.Close()
+
+	c := &ctrlTestClient{
+		t:       t,
+		conn:    conn,
+		encoder: json.NewEncoder(conn),
+		decoder: json.NewDecoder(conn),
+	}
+
+	devices := CtrlRequest{Version: CtrlProtoVersion, Command: "devices"}
+	status := CtrlRequest{Version: CtrlProtoVersion, Command: "status"}
+
+	isReady := func(rsp CtrlResponse) bool {
+		return len(rsp.Devices) == 1 && rsp.Devices[0].State == "ready"
+	}
+
+	// Check device list
+	info := dev.Info
+	info.FixUp()
+
+	rsp := c.wait(devices, isReady)
+	d := rsp.Devices[0]
+	if d.UsbAddr != dev.UsbAddr.String() || d.Ident != info.Ident() ||
+		d.HTTPPort == 0 || d.ConnState == "" {
+		t.Fatalf("devices: unexpected %+v", d)
+	}
+
+	// Check status
+	rsp = c.request(status)
+	if rsp.Pid != os.Getpid() || rsp.LogLevels == nil ||
+		len(rsp.Devices) != 1 || rsp.Devices[0].Ident != "" {
+		t.Fatalf("status: unexpected %+v", rsp)
+	}
+
+	// Check errors
+	rsp = c.request(CtrlRequest{Version: 0, Command: "status"})
+	if rsp.Error == "" {
+		t.Fatalf("invalid version: error expected")
+	}
+
+	rsp = c.request(CtrlRequest{Version: CtrlProtoVersion,
+		Command: "reprobe", Device: "Bus 099 Device 099"})
+	if rsp.Error == "" {
+		t.Fatalf("reprobe of unknown device: error expected")
+	}
+
+	rsp = c.request(CtrlRequest{Version: CtrlProtoVersion,
+		Command: "loglevel", Log: "device", Levels: "bad"})
+	if rsp.Error == "" {
+		t.Fatalf("invalid log levels: error expected")
+	}
+
+	// Change log levels
+	rsp = c.request(CtrlRequest{Version: CtrlProtoVersion,
+		Command: "loglevel", Log: "device", Levels: "trace-ipp"})
+	if rsp.Error != "" {
+		t.Fatalf("loglevel: %s", rsp.Error)
+	}
+
+	c.wait(status, func(rsp CtrlResponse) bool {
+		return rsp.LogLevels != nil && rsp.LogLevels.Device == "trace-ipp"
+	})
+
+	// Reset the device, identified by Ident
+	rsp = c.request(CtrlRequest{Version: CtrlProtoVersion,
+		Command: "reset", Device: info.Ident()})
+	if rsp.Error != "" {
+		t.Fatalf("reset: %s", rsp.Error)
+	}
+
+	c.wait(devices, func(rsp CtrlResponse) bool { return !isReady(rsp) })
+	c.wait(devices, isReady)
+
+	// Re-probe the device, identified by address
+	rsp = c.request(CtrlRequest{Version: CtrlProtoVersion,
+		Command: "reprobe", Device: "1:2"})
+	if rsp.Error != "" {
+		t.Fatalf("reprobe: %s", rsp.Error)
+	}
+
+	c.wait(devices, func(rsp CtrlResponse) bool { return !isReady(rsp) })
+	c.wait(devices, isReady)
+
+	backend.Remove(dev.UsbAddr)
+	<-exited
+}
+
+// Test control socket client
+func TestCtrlClient(t *testing.T) {
+	backend, dev, cleanup := usbSimTestSetup(t)
+	defer cleanup()
+
+	savedConf := Conf()
+	savedLevels := Log.Levels()
+	defer func() {
+		confSet(*savedConf)
+		Log.SetLevels(savedLevels)
+	}()
+
+	// Without daemon, client must fail with clear message
+	err := CtrlRun(ioutil.Discard, "status", nil, false)
+	if err == nil || !strings.Contains(err.Error(), "not running") {
+		t.Fatalf("CtrlRun: unexpected error %v", err)
+	}
+
+	srv, err := NewCtrlServer()
+	if err != nil {
+		t.Fatalf("NewCtrlServer: %s", err)
+	}
+	defer srv.Close()
+
+	exited := usbSimTestStartPnP()
+	usbSimTestWaitReady(t)
+
+	var buf bytes.Buffer
+	err = CtrlRun(&buf, "status", nil, false)
+	if err != nil {
+		t.Fatalf("status: %s", err)
+	}
+
+	if !strings.Contains(buf.String(), "ready") ||
+		!strings.Contains(buf.String(), dev.UsbAddr.String()) {
+		t.Fatalf("status: device not listed:\n%s", buf.String())
+	}
+
+	// Check JSON output
+	buf.Reset()
+	err = CtrlRun(&buf, "devices", nil, true)
+	if err != nil {
+		t.Fatalf("devices: %s", err)
+	}
+
+	var rsp CtrlResponse
+	err = json.Unmarshal(buf.Bytes(), &rsp)
+	if err != nil {
+		t.Fatalf("devices: invalid JSON: %s", err)
+	}
+
+	if len(rsp.Devices) != 1 || rsp.Devices[0].HTTPPort == 0 {
+		t.Fatalf("devices: unexpected %+v", rsp)
+	}
+
+	// Check errors, reported by daemon
+	err = CtrlRun(ioutil.Discard, "reset", []string{"bad"}, false)
+	if err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Fatalf("reset: unexpected error %v", err)
+	}
+
+	// Change log levels
+	err = CtrlRun(ioutil.Discard, "loglevel", []string{"debug"}, false)
+	if err != nil {
+		t.Fatalf("loglevel: %s", err)
+	}
+
+	for tm := time.Now(); !strings.Contains(buf.String(), "main=debug"); {
+		if time.Since(tm) > DevInitTimeout {
+			t.Fatalf("loglevel: levels not changed:\n%s", buf.String())
+		}
+
+		time.Sleep(50 * time.Millisecond)
+		buf.Reset()
+		CtrlRun(&buf, "loglevel", nil, false)
+	}
+
+	if !strings.Contains(buf.String(), "device=debug") {
+		t.Fatalf("loglevel: device levels not changed:\n%s", buf.String())
+	}
+
+	backend.Remove(dev.UsbAddr)
+	<-exited
+}
+
+// Test control socket group and permissions
+func TestCtrlPerms(t *testing.T) {
+	_, _, cleanup := usbSimTestSetup(t)
+	defer cleanup()
+
+	gid := os.Getgid()
+	defer confTestSet(func(conf *Configuration) {
+		conf.CtrlGroup = strconv.Itoa(gid)
+		conf.CtrlMode = 0660
+	})()
+
+	srv, err := NewCtrlServer()
+	if err != nil {
+		t.Fatalf("NewCtrlServer: %s", err)
+	}
+	defer srv.Close()
+
+	fi, err := os.Stat(PathCtrlSocket)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if fi.Mode().Perm() != 0660 ||
+		int(fi.Sys().(*syscall.Stat_t).Gid) != gid {
+		t.Fatalf("%s: permissions %s gid %d, expected 0660 %d",
+			PathCtrlSocket, fi.Mode().Perm(),
+			fi.Sys().(*syscall.Stat_t).Gid, gid)
+	}
+
+	// Unknown group is an error
+	confTestSet(func(conf *Configuration) {
+		conf.CtrlGroup = "ipp-usb-no-such-group"
+	})
+
+	srv2, err := NewCtrlServer()
+	if err == nil {
+		srv2.Close()
+		t.Fatalf("NewCtrlServer: unknown group: error expected")
+	}
+}
+
+// Test failure of log levels change, not delivered to PnP manager
+func TestCtrlLogLevelsBusy(t *testing.T) {
+	// PnP manager is not running, so its queue fills up
+	defer func() {
+		for len(pnpLogLevelsChan) > 0 {
+			<-pnpLogLevelsChan
+		}
+	}()
+
+	for len(pnpLogLevelsChan) < cap(pnpLogLevelsChan) {
+		pnpLogLevelsChan <- pnpLogLevels{done: make(chan struct{})}
+	}
+
+	err := ctrlSetLogLevels("main", "all")
+	if err == nil {
+		t.Fatalf("ctrlSetLogLevels: error expected")
+	}
+}
@@ -0,0 +1,282 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Control socket client
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// CtrlCommands lists client commands, accepted by CtrlRun
+var CtrlCommands = map[string]struct {
+	MinArgs, MaxArgs int
+}{
+	"status":   {0, 0},
+	"devices":  {0, 0},
+	"reset":    {1, 1},
+	"reprobe":  {1, 1},
+	"loglevel": {0, 2},
+}
+
+// CtrlClient represents the control socket client
+type CtrlClient struct {
+	conn    net.Conn      // Connection to daemon
+	encoder *json.Encoder // Request encoder
+	decoder *json.Decoder // Response decoder
+}
+
+// NewCtrlClient connects to the running daemon
+func NewCtrlClient() (*CtrlClient, error) {
+	conn, err := net.Dial("unix", PathCtrlSocket)
+	if err != nil {
+		return nil, ctrlDialError(err)
+	}
+
+	client := &CtrlClient{
+		conn:    conn,
+		encoder: json.NewEncoder(conn),
+		decoder: json.NewDecoder(conn),
+	}
+
+	return client, nil
+}
+
+// ctrlDialError makes human-readable error message from
+// the control socket connect error
+func ctrlDialError(err error) error {
+	if operr, ok := err.(*net.OpError); ok {
+		if syserr, ok := operr.Err.(*os.SyscallError); ok {
+			switch syserr.Err {
+			case syscall.ENOENT, syscall.ECONNREFUSED:
+				return errors.New("ipp-usb daemon is not running")
+			case syscall.EACCES, syscall.EPERM:
+				return fmt.Errorf("%s: permission denied "+
+					"(try to run as root)", PathCtrlSocket)
+			}
+		}
+	}
+
+	return fmt.Errorf("%s: %s", PathCtrlSocket, err)
+}
+
+// Close the client
+func (client *CtrlClient) Close() {
+	client.conn.Close()
+}
+
+// Do sends request to the daemon and returns its response. If
+// daemon reports error, it is returned as error
+func (client *CtrlClient) Do(rq CtrlRequest) (CtrlResponse, error) {
+	var rsp CtrlResponse
+
+	rq.Version = CtrlProtoVersion
+	err := client.encoder.Encode(rq)
+	if err == nil {
+		err = client.decoder.Decode(&rsp)
+	}
+
+	switch {
+	case err == io.EOF:
+		err = errors.New("connection closed by daemon")
+	case err == nil && rsp.Error != "":
+		err = errors.New(rsp.Error)
+	}
+
+	return rsp, err
+}
+
+// CtrlRun executes client command and prints result to out, as
+// a human-readable text or, if asJSON is true, as JSON
+func CtrlRun(out io.Writer, cmd string, args []string, asJSON bool) error {
+	client, err := NewCtrlClient()
+	if err != nil {
+		return err
+	}
+
+	defer client.Close()
+
+	// Build request
+	rq := CtrlRequest{Command: cmd}
+	switch cmd {
+	case "reset", "reprobe":
+		rq.Device = args[0]
+
+	case "loglevel":
+		switch len(args) {
+		case 0:
+			// Just print current log levels
+			rq.Command = "status"
+		case 1:
+			// Set main and device logs
+			rq.Log = "main"
+			rq.Levels = args[0]
+		case 2:
+			rq.Log = args[0]
+			rq.Levels = args[1]
+		}
+	}
+
+	rsp, err := client.Do(rq)
+	if err == nil && cmd == "loglevel" && len(args) == 1 {
+		rq.Log = "device"
+		rsp, err = client.Do(rq)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// Print response
+	if asJSON {
+		data, _ := json.MarshalIndent(rsp, "", "  ")
+		fmt.Fprintf(out, "%s\n", data)
+		return nil
+	}
+
+	switch cmd {
+	case "status":
+		ctrlPrintStatus(out, rsp)
+	case "devices":
+		ctrlPrintDevices(out, rsp)
+	case "reset":
+		fmt.Fprintf(out, "%s: reset requested\n", rq.Device)
+	case "reprobe":
+		fmt.Fprintf(out, "%s: re-probe requested\n", rq.Device)
+	case "loglevel":
+		if rsp.LogLevels != nil {
+			ctrlPrintLogLevels(out, rsp.LogLevels)
+		} else if len(args) == 1 {
+			fmt.Fprintf(out, "main and device log levels set to %s\n",
+				args[0])
+		} else {
+			fmt.Fprintf(out, "%s log levels set to %s\n",
+				args[0], args[1])
+		}
+	}
+
+	return nil
+}
+
+// ctrlPrintStatus prints response to the "status" command
+func ctrlPrintStatus(out io.Writer, rsp CtrlResponse) {
+	fmt.Fprintf(out, "ipp-usb daemon is running, pid=%d, started %s\n",
+		rsp.Pid, ctrlFmtTime(rsp.Started))
+
+	if rsp.LogLevels != nil {
+		ctrlPrintLogLevels(out, rsp.LogLevels)
+	}
+
+	if len(rsp.Devices) == 0 {
+		fmt.Fprintf(out, "No IPP-over-USB devices\n")
+		return
+	}
+
+	fmt.Fprintf(out, "\n")
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, " Num\tDevice\tState\tError\n")
+	for i, dev := range rsp.Devices {
+		state := dev.State
+		switch {
+		case dev.State == "retry" && dev.NextRetry != "":
+			state = "retry " + ctrlFmtTime(dev.NextRetry)
+		case dev.State == "failed":
+			state = fmt.Sprintf("failed after %d attempts",
+				dev.Attempts)
+		}
+
+		err := dev.Error
+		if err != "" {
+			err = fmt.Sprintf("%s (%s)", err, dev.ErrClass)
+		}
+
+		fmt.Fprintf(w, "%3d.\t%s\t%s\t%s\n", i+1, dev.UsbAddr, state, err)
+	}
+	w.Flush()
+}
+
+// ctrlPrintDevices prints response to the "devices" command
+func ctrlPrintDevices(out io.Writer, rsp CtrlResponse) {
+	if len(rsp.Devices) == 0 {
+		fmt.Fprintf(out, "No IPP-over-USB devices\n")
+		return
+	}
+
+	for i, dev := range rsp.Devices {
+		if i != 0 {
+			fmt.Fprintf(out, "\n")
+		}
+
+		fmt.Fprintf(out, "%s: %s\n", dev.UsbAddr, dev.State)
+
+		w := tabwriter.NewWriter(out, 0, 0, 1, ' ', 0)
+		if dev.Ident != "" {
+			fmt.Fprintf(w, "  Ident:\t%s\n", dev.Ident)
+		}
+		if dev.HTTPPort != 0 {
+			fmt.Fprintf(w, "  HTTP port:\t%d\n", dev.HTTPPort)
+		}
+		if dev.DNSSdName != "" {
+			fmt.Fprintf(w, "  DNS-SD name:\t%s\n", dev.DNSSdName)
+		}
+		if dev.ConnState != "" {
+			fmt.Fprintf(w, "  USB connections:\t%s\n", dev.ConnState)
+		}
+		for i, q := range dev.Quirks {
+			if i == 0 {
+				fmt.Fprintf(w, "  Quirks:\t%s\n", q)
+			} else {
+				fmt.Fprintf(w, "\t%s\n", q)
+			}
+		}
+		if dev.Error != "" {
+			fmt.Fprintf(w, "  Last error:\t%s (%s)\n",
+				dev.Error, dev.ErrClass)
+		}
+		w.Flush()
+	}
+}
+
+// ctrlPrintLogLevels prints log levels
+func ctrlPrintLogLevels(out io.Writer, levels *CtrlLogLevels) {
+	fmt.Fprintf(out, "Log levels: main=%s console=%s device=%s\n",
+		ctrlFmtLogLevels(levels.Main),
+		ctrlFmtLogLevels(levels.Console),
+		ctrlFmtLogLevels(levels.Device))
+}
+
+// ctrlFmtLogLevels formats log levels for printing
+func ctrlFmtLogLevels(levels string) string {
+	if levels == "" {
+		return "none"
+	}
+	return levels
+}
+
+// ctrlFmtTime formats time, received from daemon, for printing.
+// Future time is printed relative to now
+func ctrlFmtTime(s string) string {
+	tm, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return s
+	}
+
+	if d := time.Until(tm); d > 0 {
+		return "in " + d.Round(time.Second).String()
+	}
+
+	return tm.Local().Format("2006-01-02 15:04:05")
+}
@@ -10,8 +10,10 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"net"
 	"net/http"
+	"sync"
 	"time"
 )
 
@@ -27,36 +29,103 @@ type Device struct {
 	HTTPClient     *http.Client    // HTTP client for internal queries
 	HTTPProxy      *HTTPProxy      // HTTP proxy
 	UsbTransport   *UsbTransport   // Backing USB transport
+	DNSSdServices  DNSSdServices   // Advertised DNS-SD services
 	DNSSdPublisher *DNSSdPublisher // DNS-SD publisher
 	Log            *Logger         // Device's logger
+	transport      *devTransport   // Transport, used by HTTPProxy
 }
 
 // NewDevice creates new Device object
-func NewDevice(desc UsbDeviceDesc) (*Device, error) {
-	dev := &Device{
-		UsbAddr: desc.UsbAddr,
+//
+// If ctx is canceled, initialization is aborted and
+// ctx.Err() is returned
+func NewDevice(ctx context.Context, desc UsbDeviceDesc) (*Device, error) {
+	// Create USB transport
+	transport, err := NewUsbTransport(desc)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = ctx.Err(); err != nil {
+		transport.Close(false)
+		return nil, err
+	}
+
+	return NewDeviceWithTransport(ctx, desc, transport)
+}
+
+// NewDeviceWithTransport creates new Device object on a top
+// of already created UsbTransport. On error, transport is closed
+//
+// If ctx is canceled, initialization is aborted and
+// ctx.Err() is returned
+//
+// Panic during initialization (i.e., while parsing malformed
+// device response) is logged and ErrPanic is returned
+func NewDeviceWithTransport(ctx context.Context, desc UsbDeviceDesc,
+	transport *UsbTransport) (dev *Device, err error) {
+
+	dev = &Device{
+		UsbAddr:      desc.UsbAddr,
+		UsbTransport: transport,
+		transport:    newDevTransport(transport),
 	}
 
-	var err error
 	var info UsbDeviceInfo
 	var listener net.Listener
+	var tlsConfig *tls.Config
+	var auth AuthConfig
 	var ippinfo *IppPrinterInfo
 	var dnssdName string
 	var dnssdServices DNSSdServices
 	var log *LogMessage
 
-	// Create USB transport
-	dev.UsbTransport, err = NewUsbTransport(desc)
-	if err != nil {
-		goto ERROR
+	// cleanup releases resources on failure
+	cleanup := func() {
+		if dev.HTTPProxy != nil {
+			dev.HTTPProxy.Close()
+		}
+
+		if dev.UsbTransport != nil {
+			dev.UsbTransport.Close(true)
+		}
+
+		if listener != nil {
+			listener.Close()
+		}
 	}
 
+	// Catch panics, so they affect only this device
+	defer func() {
+		v := recover()
+		if v != nil {
+			transport.Log().Recovered(v)
+			cleanup()
+			dev, err = nil, ErrPanic
+		}
+	}()
+
+	// Abort initialization, if ctx is canceled
+	stopCancel := devCancelInit(ctx, transport)
+	defer stopCancel()
+
 	// Obtain device's logger
 	info = dev.UsbTransport.UsbDeviceInfo()
 	dev.Log = dev.UsbTransport.Log()
 
-	// Load persistent state
+	// Load persistent state. If device is identified by
+	// USB port, migrate its state from the legacy identifier,
+	// unless it is used or may be inherited by another device
+	if info.IdentByPort && info.LegacyOwner &&
+		!usbIdentInUse(info.SerialIdent()) {
+		DevStateMigrate(info.SerialIdent(), info.Ident())
+	}
+
 	dev.State = LoadDevState(info.Ident(), info.Comment())
+	if dev.State.UsbPort != info.PortPath {
+		dev.State.UsbPort = info.PortPath
+		dev.State.Save()
+	}
 
 	// Create HTTP client for local queries
 	dev.HTTPClient = &http.Client{
@@ -69,9 +138,23 @@ func NewDevice(desc UsbDeviceDesc) (*Device, error) {
 		goto ERROR
 	}
 
+	// Accept TLS connections on the same port, if enabled
+	if Conf().TLSEnable {
+		tlsConfig, err = TLSConfig(dev.State, info.MfgAndProduct)
+		if err != nil {
+			goto ERROR
+		}
+
+		listener = NewTLSSniffListener(listener, tlsConfig)
+	}
+
 	// Create HTTP server
-	dev.UsbTransport.SetDeadline(time.Now().Add(DevInitTimeout))
-	dev.HTTPProxy = NewHTTPProxy(dev.Log, listener, dev.UsbTransport)
+	dev.UsbTransport.SetDeadline(
+		time.Now().Add(dev.UsbTransport.Quirks().InitTimeout()))
+	auth = Conf().Auth
+	dev.HTTPProxy = NewHTTPProxy(dev.Log, listener, dev.transport,
+		dev.UsbTransport.metrics, &auth,
+		dev.UsbTransport.Quirks().ACL(), Conf().ACL)
 
 	// Obtain DNS-SD info for IPP
 	log = dev.Log.Begin()
@@ -120,6 +203,12 @@ func NewDevice(desc UsbDeviceDesc) (*Device, error) {
 		goto ERROR
 	}
 
+	// Device without both IPP and eSCL services is useless
+	if ippinfo == nil && err != nil {
+		err = ErrNoServices
+		goto ERROR
+	}
+
 	// Update IPP service advertising for scanner presence
 	if ippinfo != nil {
 		if ippSvc := &dnssdServices[ippinfo.IppSvcIndex]; err == nil {
@@ -132,11 +221,22 @@ func NewDevice(desc UsbDeviceDesc) (*Device, error) {
 	// Advertise Web service. Assume it always exists
 	dnssdServices.Add(DNSSdSvcInfo{Type: "_http._tcp", Port: dev.State.HTTPPort})
 
+	// Advertise secure variants of services, if TLS enabled
+	if tlsConfig != nil {
+		dnssdServices = TLSServices(dnssdServices)
+	}
+
 	// Enable handling incoming requests
+	stopCancel()
+	if err = ctx.Err(); err != nil {
+		goto ERROR
+	}
+
 	dev.UsbTransport.SetDeadline(time.Time{})
 	dev.HTTPProxy.Enable()
 
 	// Start DNS-SD publisher
+	dev.DNSSdServices = dnssdServices
 	for _, svc := range dnssdServices {
 		dev.Log.Debug('>', "%s: %s TXT record:", dnssdName, svc.Type)
 		for _, txt := range svc.Txt {
@@ -144,9 +244,11 @@ func NewDevice(desc UsbDeviceDesc) (*Device, error) {
 		}
 	}
 
-	if Conf.DNSSdEnable {
+	if Conf().DNSSdEnable {
 		dev.DNSSdPublisher = NewDNSSdPublisher(dev.Log, dev.State,
 			dnssdServices)
+		dev.DNSSdPublisher.OnPanic = dev.transport.Panicked
+		dev.DNSSdPublisher.Metrics = dev.UsbTransport.metrics
 		err = dev.DNSSdPublisher.Publish()
 		if err != nil {
 			goto ERROR
@@ -156,21 +258,43 @@ func NewDevice(desc UsbDeviceDesc) (*Device, error) {
 	return dev, nil
 
 ERROR:
-	if dev.HTTPProxy != nil {
-		dev.HTTPProxy.Close()
+	if ctx.Err() != nil {
+		err = ctx.Err()
 	}
 
-	if dev.UsbTransport != nil {
-		dev.UsbTransport.Close(true)
-	}
-
-	if listener != nil {
-		listener.Close()
-	}
+	cleanup()
 
 	return nil, err
 }
 
+// devCancelInit aborts device initialization in progress when
+// ctx is canceled, by expiring the transport deadline
+//
+// Returned function stops watching the context. It must be
+// called before the deadline is reset, and may be called
+// multiple times
+func devCancelInit(ctx context.Context, transport *UsbTransport) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			transport.SetDeadline(time.Now())
+		case <-done:
+		}
+		close(stopped)
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-stopped
+		})
+	}
+}
+
 // Shutdown gracefully shuts down the device. If provided context
 // expires before the shutdown is complete, Shutdown returns the
 // context's error
@@ -192,6 +316,59 @@ func (dev *Device) Shutdown(ctx context.Context) error {
 	return nil
 }
 
+// Detach detaches Device from the USB device, that was removed
+// from the bus
+//
+// HTTP proxy and DNS-SD publisher remain active, and incoming
+// requests wait until the USB device is reattached with Attach,
+// or Device is closed
+func (dev *Device) Detach() {
+	dev.transport.Detach()
+
+	if dev.UsbTransport != nil {
+		dev.UsbTransport.Close(false)
+		dev.UsbTransport = nil
+	}
+}
+
+// Attach attaches detached Device to the USB device, represented
+// by the UsbTransport. Caller is responsible to check that device
+// identity matches
+func (dev *Device) Attach(desc UsbDeviceDesc, transport *UsbTransport) {
+	info := transport.UsbDeviceInfo()
+
+	dev.UsbAddr = desc.UsbAddr
+	dev.UsbTransport = transport
+	dev.HTTPClient = &http.Client{
+		Transport: transport,
+	}
+
+	if dev.State.UsbPort != info.PortPath {
+		dev.State.UsbPort = info.PortPath
+		dev.State.Save()
+	}
+
+	dev.transport.Attach(transport)
+}
+
+// SetLogLevels changes log levels of the device's logger
+func (dev *Device) SetLogLevels(levels LogLevel) {
+	dev.Log.SetLevels(levels).CcUpdate()
+	if dev.UsbTransport != nil && dev.UsbTransport.Log() != dev.Log {
+		dev.UsbTransport.Log().SetLevels(levels).CcUpdate()
+	}
+}
+
+// ReopenLogs redirects device's logs to the current log directory,
+// after it was changed
+func (dev *Device) ReopenLogs() {
+	path := logDevFilePath(dev.State.Ident)
+	dev.Log.ToFile(path)
+	if dev.UsbTransport != nil && dev.UsbTransport.Log() != dev.Log {
+		dev.UsbTransport.Log().ToFile(path)
+	}
+}
+
 // Close the Device
 func (dev *Device) Close() {
 	if dev.DNSSdPublisher != nil {
@@ -199,6 +376,8 @@ func (dev *Device) Close() {
 		dev.DNSSdPublisher = nil
 	}
 
+	dev.transport.Close()
+
 	if dev.HTTPProxy != nil {
 		dev.HTTPProxy.Close()
 		dev.HTTPProxy = nil
@@ -209,3 +388,107 @@ func (dev *Device) Close() {
 		dev.UsbTransport = nil
 	}
 }
+
+// devTransport is the swappable transport for HTTPProxy. While
+// Device is detached, requests wait until it is reattached
+// or closed
+type devTransport struct {
+	lock      sync.Mutex    // Access lock
+	transport *UsbTransport // Current transport, nil if detached
+	attached  chan struct{} // Closed when attached or closed
+	closed    bool          // Transport is closed
+	log       *Logger       // Device's logger
+}
+
+// newDevTransport creates a new devTransport, attached
+// to the UsbTransport
+func newDevTransport(transport *UsbTransport) *devTransport {
+	return &devTransport{
+		transport: transport,
+		attached:  make(chan struct{}),
+		log:       transport.Log(),
+	}
+}
+
+// Detach detaches devTransport from the current UsbTransport
+func (dt *devTransport) Detach() {
+	dt.lock.Lock()
+	if !dt.closed && dt.transport != nil {
+		dt.transport = nil
+		dt.attached = make(chan struct{})
+	}
+	dt.lock.Unlock()
+}
+
+// Attach attaches devTransport to the new UsbTransport and
+// wakes up waiting requests
+func (dt *devTransport) Attach(transport *UsbTransport) {
+	dt.lock.Lock()
+	if !dt.closed && dt.transport == nil {
+		dt.transport = transport
+		close(dt.attached)
+	}
+	dt.lock.Unlock()
+}
+
+// Close closes devTransport. Waiting requests fail
+// with ErrDevRemoved
+func (dt *devTransport) Close() {
+	dt.lock.Lock()
+	if !dt.closed {
+		dt.closed = true
+		if dt.transport == nil {
+			close(dt.attached)
+		}
+		dt.transport = nil
+	}
+	dt.lock.Unlock()
+}
+
+// RoundTripWithSession executes a single HTTP transaction, using
+// the current UsbTransport. If devTransport is detached, it waits
+// until attached, closed, or request is canceled
+func (dt *devTransport) RoundTripWithSession(session int,
+	rq *http.Request) (*http.Response, error) {
+
+	dt.lock.Lock()
+	transport, attached, closed := dt.transport, dt.attached, dt.closed
+	dt.lock.Unlock()
+
+	if closed {
+		return nil, ErrDevRemoved
+	}
+
+	if transport == nil {
+		select {
+		case <-attached:
+		case <-rq.Context().Done():
+			return nil, rq.Context().Err()
+		}
+
+		dt.lock.Lock()
+		transport = dt.transport
+		dt.lock.Unlock()
+
+		if transport == nil {
+			return nil, ErrDevRemoved
+		}
+	}
+
+	return transport.RoundTripWithSession(session, rq)
+}
+
+// Panicked handles panic, recovered while serving a request. If
+// devTransport is attached, device is reset and reinitialized,
+// otherwise panic is only logged
+func (dt *devTransport) Panicked(v interface{}) {
+	dt.lock.Lock()
+	transport := dt.transport
+	dt.lock.Unlock()
+
+	if transport != nil {
+		transport.Panicked(v)
+	} else {
+		dt.log.Recovered(v)
+	}
+}
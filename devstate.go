@@ -23,6 +23,7 @@ import (
 // port allocation etc)
 type DevState struct {
 	Ident         string // Device identification
+	UsbPort       string // USB port path, as seen last time
 	HTTPPort      int    // Allocated HTTP port
 	DNSSdName     string // DNS-SD name, as reported by device
 	DNSSdOverride string // DNS-SD name after collision resolution
@@ -56,6 +57,8 @@ func LoadDevState(ident, comment string) *DevState {
 		switch rec.Section {
 		case "device":
 			switch rec.Key {
+			case "usb-port":
+				state.UsbPort = rec.Value
 			case "http-port":
 				err = state.loadTCPPort(&state.HTTPPort, rec)
 			case "dns-sd-name":
@@ -107,6 +110,7 @@ func (state *DevState) Save() {
 	}
 
 	fmt.Fprintf(&buf, "[device]\n")
+	fmt.Fprintf(&buf, "usb-port        = %q\n", state.UsbPort)
 	fmt.Fprintf(&buf, "http-port       = %d\n", state.HTTPPort)
 	fmt.Fprintf(&buf, "dns-sd-name     = %q\n", state.DNSSdName)
 	fmt.Fprintf(&buf, "dns-sd-override = %q\n", state.DNSSdOverride)
@@ -118,12 +122,64 @@ func (state *DevState) Save() {
 	}
 }
 
+// DevStateMigrate migrates persistent state of the device from
+// the legacy identifier to the new one
+//
+// Migration is performed only if the legacy state file exists
+// and was created before ipp-usb started to record USB port of
+// the device, and the new state file doesn't exist yet. The legacy
+// state file is renamed, so only one device may inherit it
+func DevStateMigrate(from, to string) {
+	oldpath := (&DevState{Ident: from}).devStatePath()
+	newpath := (&DevState{Ident: to}).devStatePath()
+
+	if _, err := os.Stat(newpath); err == nil {
+		return
+	}
+
+	// Check that legacy state file doesn't contain USB port
+	ini, err := OpenIniFile(oldpath)
+	if err != nil {
+		return
+	}
+
+	for err == nil {
+		var rec *IniRecord
+		rec, err = ini.Next()
+		if err == nil && rec.Section == "device" && rec.Key == "usb-port" {
+			ini.Close()
+			return
+		}
+	}
+
+	ini.Close()
+
+	// Rename the file
+	err = os.Rename(oldpath, newpath)
+	if err != nil {
+		Log.Error('!', "STATE MIGRATE: %s", err)
+		return
+	}
+
+	Log.Info(' ', "STATE MIGRATE: %s -> %s", from, to)
+}
+
 // HTTPListen allocates HTTP port and updates persistent configuration
 func (state *DevState) HTTPListen() (net.Listener, error) {
 	port := state.HTTPPort
 
+	// Use socket, passed by systemd, if any
+	if listener, sdport := sdListen(state.Ident, port); listener != nil {
+		if sdport != port {
+			state.HTTPPort = sdport
+			state.Save()
+		}
+		return listener, nil
+	}
+
 	// Check that preallocated port is within the configured range
-	if !(Conf.HTTPMinPort <= port && port <= Conf.HTTPMaxPort) {
+	conf := Conf()
+	if !(conf.HTTPMinPort <= port && port <= conf.HTTPMaxPort) {
 		port = 0
 	}
 
@@ -136,7 +192,7 @@ func (state *DevState) HTTPListen() (net.Listener, error) {
 	}
 
 	// Allocate a port
-	for port = Conf.HTTPMinPort; port <= Conf.HTTPMaxPort; port++ {
+	for port = conf.HTTPMinPort; port <= conf.HTTPMaxPort; port++ {
 		listener, err := NewListener(port)
 		if err == nil {
 			state.HTTPPort = port
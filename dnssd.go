@@ -87,12 +87,14 @@ func (services *DNSSdServices) Add(srv DNSSdSvcInfo) {
 // One publisher may publish multiple services unser the
 // same Service Instance Name
 type DNSSdPublisher struct {
-	Log      *Logger        // Device's logger
-	DevState *DevState      // Device persistent state
-	Services DNSSdServices  // Registered services
-	fin      chan struct{}  // Closed to terminate publisher goroutine
-	finDone  sync.WaitGroup // To wait for goroutine termination
-	sysdep   *dnssdSysdep   // System-dependent stuff
+	Log      *Logger             // Device's logger
+	DevState *DevState           // Device persistent state
+	Services DNSSdServices       // Registered services
+	OnPanic  func(v interface{}) // Called on panic, if not nil
+	Metrics  *DevMetrics         // Device metrics, may be nil
+	fin      chan struct{}       // Closed to terminate publisher goroutine
+	finDone  sync.WaitGroup      // To wait for goroutine termination
+	sysdep   *dnssdSysdep        // System-dependent stuff
 }
 
 // DNSSdStatus represents DNS-SD publisher status
@@ -163,6 +165,7 @@ func (publisher *DNSSdPublisher) Unpublish() {
 	publisher.finDone.Wait()
 
 	publisher.sysdep.Close()
+	publisher.Metrics.dnssdStatus(false)
 
 	publisher.Log.Info('-', "DNS-SD: %s: removed", publisher.instance(0))
 }
@@ -197,11 +200,15 @@ func (publisher *DNSSdPublisher) instance(suffix int) string {
 
 // Event handling goroutine
 func (publisher *DNSSdPublisher) goroutine() {
-	// Catch panics to log
+	// Catch panics to log. If OnPanic is set, panic
+	// affects only this device
 	defer func() {
 		v := recover()
 		if v != nil {
-			Log.Panic(v)
+			if publisher.OnPanic == nil {
+				publisher.Log.Panic(v)
+			}
+			publisher.OnPanic(v)
 		}
 	}()
 
@@ -226,6 +233,7 @@ func (publisher *DNSSdPublisher) goroutine() {
 			switch status {
 			case DNSSdSuccess:
 				publisher.Log.Info(' ', "DNS-SD: %s: published", instance)
+				publisher.Metrics.dnssdStatus(true)
 				if instance != publisher.DevState.DNSSdOverride {
 					publisher.DevState.DNSSdOverride = instance
 					publisher.DevState.Save()
@@ -243,6 +251,7 @@ func (publisher *DNSSdPublisher) goroutine() {
 
 				fail = true
 				publisher.sysdep.Close()
+				publisher.Metrics.dnssdFailed()
 
 			default:
 				publisher.Log.Error(' ', "DNS-SD: %s: unknown event %s",
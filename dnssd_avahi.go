@@ -57,7 +57,9 @@ func newDnssdSysdep(log *Logger, instance string, services DNSSdServices) (
 	var err error
 	var poll *C.AvahiPoll
 	var rc C.int
-	var proto, iface int
+	var proto int
+	var ifaces []int
+	var loopback bool
 
 	sysdep := &dnssdSysdep{
 		log:        log,
@@ -110,79 +112,39 @@ func newDnssdSysdep(log *Logger, instance string, services DNSSdServices) (
 
 	avahiEgroupMap[sysdep.egroup] = sysdep
 
-	// Compute iface and proto, adjust fqdn
-	iface = C.AVAHI_IF_UNSPEC
-	if Conf.LoopbackOnly {
-		iface, err = Loopback()
-		if err != nil {
-			goto ERROR
-		}
+	// Compute ifaces and proto, adjust fqdn
+	ifaces, loopback, err = ListenInterfaces()
+	if err != nil {
+		goto ERROR
+	}
+
+	if ifaces == nil {
+		ifaces = []int{C.AVAHI_IF_UNSPEC}
+	}
 
+	if loopback {
 		old := sysdep.fqdn
 		sysdep.fqdn = "localhost"
 		sysdep.log.Debug(' ', "DNS-SD: FQDN: %q->%q", old, sysdep.fqdn)
 	}
 
 	proto = C.AVAHI_PROTO_UNSPEC
-	if !Conf.IPV6Enable {
+	if !Conf().IPV6Enable {
 		proto = C.AVAHI_PROTO_INET
 	}
 
 	// Populate entry group
-	for _, svc := range services {
-		// Prepare TXT record
-		var c_txt *C.AvahiStringList
-		c_txt, err = sysdep.avahiTxtRecord(svc.Port, svc.Txt)
-		if err != nil {
-			goto ERROR
-		}
-
-		// Register service type
-		c_svc_type := C.CString(svc.Type)
-
-		rc = C.avahi_entry_group_add_service_strlst(
-			sysdep.egroup,
-			C.AvahiIfIndex(iface),
-			C.AvahiProtocol(proto),
-			0,
-			c_instance,
-			c_svc_type,
-			nil, // Domain
-			nil, // Host
-			C.uint16_t(svc.Port),
-			c_txt,
-		)
+	for _, iface := range ifaces {
+		for _, svc := range services {
+			rc, err = sysdep.avahiAddService(iface, proto,
+				c_instance, svc)
+			if err != nil {
+				goto ERROR
+			}
 
-		// Register subtypes, if any
-		for _, subtype := range svc.SubTypes {
 			if rc != C.AVAHI_OK {
-				break
+				goto AVAHI_ERROR
 			}
-
-			sysdep.log.Debug(' ', "DNS-SD: +subtype: %q", subtype)
-
-			c_subtype := C.CString(subtype)
-			rc = C.avahi_entry_group_add_service_subtype(
-				sysdep.egroup,
-				C.AvahiIfIndex(iface),
-				C.AvahiProtocol(proto),
-				0,
-				c_instance,
-				c_svc_type,
-				nil,
-				c_subtype,
-			)
-			C.free(unsafe.Pointer(c_subtype))
-
-		}
-
-		// Release C memory
-		C.free(unsafe.Pointer(c_svc_type))
-		C.avahi_string_list_free(c_txt)
-
-		// Check for Avahi error
-		if rc != C.AVAHI_OK {
-			goto AVAHI_ERROR
 		}
 	}
 
@@ -253,6 +215,61 @@ func (sysdep *dnssdSysdep) notify(status DNSSdStatus) {
 	sysdep.statusChan <- status
 }
 
+// avahiAddService adds service with subtypes, if any, to the
+// entry group, on the specified interface
+func (sysdep *dnssdSysdep) avahiAddService(iface, proto int,
+	c_instance *C.char, svc DNSSdSvcInfo) (C.int, error) {
+
+	// Prepare TXT record
+	c_txt, err := sysdep.avahiTxtRecord(svc.Port, svc.Txt)
+	if err != nil {
+		return C.AVAHI_OK, err
+	}
+
+	defer C.avahi_string_list_free(c_txt)
+
+	// Register service type
+	c_svc_type := C.CString(svc.Type)
+	defer C.free(unsafe.Pointer(c_svc_type))
+
+	rc := C.avahi_entry_group_add_service_strlst(
+		sysdep.egroup,
+		C.AvahiIfIndex(iface),
+		C.AvahiProtocol(proto),
+		0,
+		c_instance,
+		c_svc_type,
+		nil, // Domain
+		nil, // Host
+		C.uint16_t(svc.Port),
+		c_txt,
+	)
+
+	// Register subtypes, if any
+	for _, subtype := range svc.SubTypes {
+		if rc != C.AVAHI_OK {
+			break
+		}
+
+		sysdep.log.Debug(' ', "DNS-SD: +subtype: %q", subtype)
+
+		c_subtype := C.CString(subtype)
+		rc = C.avahi_entry_group_add_service_subtype(
+			sysdep.egroup,
+			C.AvahiIfIndex(iface),
+			C.AvahiProtocol(proto),
+			0,
+			c_instance,
+			c_svc_type,
+			nil,
+			c_subtype,
+		)
+		C.free(unsafe.Pointer(c_subtype))
+	}
+
+	return rc, nil
+}
+
 // avahiTxtRecord converts DNSSdTxtRecord to AvahiStringList
 func (sysdep *dnssdSysdep) avahiTxtRecord(port int, txt DNSSdTxtRecord) (
 	*C.AvahiStringList, error) {
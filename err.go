@@ -18,4 +18,9 @@ var (
 	ErrShutdown     = errors.New("Shutdown requested")
 	ErrBlackListed  = errors.New("Device is blacklisted")
 	ErrInitTimedOut = errors.New("Device initialization timed out")
+	ErrUsbStalled   = errors.New("USB I/O stalled")
+	ErrDevRemoved   = errors.New("Device removed")
+	ErrDevReenum    = errors.New("Device re-enumerated after reset")
+	ErrNoServices   = errors.New("Neither IPP nor eSCL service available")
+	ErrPanic        = errors.New("Device handler panicked")
 )
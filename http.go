@@ -25,24 +25,45 @@ var (
 	httpSessionID int32
 )
 
+// HTTPProxyTransport is the transport for outgoing requests of
+// the HTTPProxy. It is implemented by the UsbTransport
+type HTTPProxyTransport interface {
+	// RoundTripWithSession executes a single HTTP transaction
+	RoundTripWithSession(session int, rq *http.Request) (
+		*http.Response, error)
+
+	// Panicked handles panic, recovered while serving a request
+	Panicked(v interface{})
+}
+
 // HTTPProxy represents HTTP protocol proxy backed by the
 // specified http.RoundTripper. It implements http.Handler
 // interface
 type HTTPProxy struct {
-	log       *Logger       // Logger instance
-	server    *http.Server  // HTTP server
-	enable    bool          // Proxy can handle incoming requests
-	transport *UsbTransport // Transport for outgoing requests
-	closeWait chan struct{} // Closed at server close
+	log       *Logger            // Logger instance
+	server    *http.Server       // HTTP server
+	enable    bool               // Proxy can handle incoming requests
+	transport HTTPProxyTransport // Transport for outgoing requests
+	metrics   *DevMetrics        // Device metrics, may be nil
+	auth      *AuthConfig        // Authentication, may be nil
+	acls      []ACL              // Client ACLs, in priority order
+	closeWait chan struct{}      // Closed at server close
 }
 
 // NewHTTPProxy creates new HTTP proxy
-func NewHTTPProxy(logger *Logger,
-	listener net.Listener, transport *UsbTransport) *HTTPProxy {
+//
+// Clients are checked against acls, in priority order (see ACLCheck),
+// and authenticated, if auth is not nil
+func NewHTTPProxy(logger *Logger, listener net.Listener,
+	transport HTTPProxyTransport, metrics *DevMetrics,
+	auth *AuthConfig, acls ...ACL) *HTTPProxy {
 
 	proxy := &HTTPProxy{
 		log:       logger,
 		transport: transport,
+		metrics:   metrics,
+		auth:      auth,
+		acls:      acls,
 		closeWait: make(chan struct{}),
 	}
 
@@ -73,16 +94,24 @@ func (proxy *HTTPProxy) Enable() {
 
 // Handle HTTP request
 func (proxy *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// Catch panics to log
+	// Catch panics, so they affect only this device
 	defer func() {
 		v := recover()
-		if v != nil {
-			Log.Panic(v)
+		if v != nil && v != http.ErrAbortHandler {
+			proxy.transport.Panicked(v)
+			panic(http.ErrAbortHandler)
 		}
 	}()
 
 	session := int(atomic.AddInt32(&httpSessionID, 1)-1) % 1000
 
+	// Check client access
+	if !proxy.httpAccessAllowed(r) {
+		proxy.httpError(session, w, r, http.StatusForbidden,
+			fmt.Errorf("Access denied for %s", r.RemoteAddr))
+		return
+	}
+
 	// Perform sanity checking
 	if !proxy.enable {
 		proxy.httpError(session, w, r, http.StatusServiceUnavailable,
@@ -90,6 +119,21 @@ func (proxy *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Authenticate client
+	if proxy.auth != nil {
+		policy := proxy.auth.Policy(proxy.auth.Class(r))
+		challenge, err := proxy.auth.Check(r, policy)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", challenge)
+			proxy.httpError(session, w, r, http.StatusUnauthorized,
+				fmt.Errorf("%s (client %s)", err, r.RemoteAddr))
+			return
+		}
+	}
+
+	// Client credentials are never forwarded to device
+	r.Header.Del("Authorization")
+
 	if r.Method == "CONNECT" {
 		proxy.httpError(session, w, r, http.StatusMethodNotAllowed,
 			errors.New("CONNECT not allowed"))
@@ -157,6 +201,9 @@ func (proxy *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 			url := *r.URL
 			url.Host = fmt.Sprintf("localhost:%d", localAddr.Port)
+			if r.TLS != nil {
+				url.Scheme = "https"
+			}
 
 			proxy.httpRedirect(session, w, r, http.StatusFound, &url)
 			return
@@ -166,13 +213,24 @@ func (proxy *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Send request and obtain response status and header
 	resp, err := proxy.transport.RoundTripWithSession(session, r)
 	if err != nil {
-		proxy.httpError(session, w, r, http.StatusServiceUnavailable, err)
+		status := http.StatusServiceUnavailable
+		if err == ErrUsbStalled {
+			status = http.StatusGatewayTimeout
+		}
+
+		proxy.httpError(session, w, r, status, err)
 		return
 	}
 
+	// Rewrite device-local URLs to the address, used by client
+	if rw := NewURLRewriter(r, localAddr.Port); rw != nil {
+		rw.Response(r, resp)
+	}
+
 	httpRemoveHopByHopHeaders(resp.Header)
 	httpCopyHeaders(w.Header(), resp.Header)
 	w.WriteHeader(resp.StatusCode)
+	proxy.metrics.httpRequest(r.Method, resp.StatusCode)
 
 	// Obtain response body, if any
 	_, err = io.Copy(w, resp.Body)
@@ -197,6 +255,7 @@ func (proxy *HTTPProxy) httpError(session int, w http.ResponseWriter, r *http.Re
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	httpNoCache(w)
 	w.WriteHeader(status)
+	proxy.metrics.httpRequest(r.Method, status)
 
 	w.Write([]byte(err.Error()))
 	w.Write([]byte("\n"))
@@ -208,6 +267,26 @@ func (proxy *HTTPProxy) httpError(session int, w http.ResponseWriter, r *http.Re
 	}
 }
 
+// httpAccessAllowed checks client address against proxy ACLs
+func (proxy *HTTPProxy) httpAccessAllowed(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	// Strip IPv6 zone, if any
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	return ACLCheck(ip, proxy.acls...)
+}
+
 // Respond to request with the HTTP redirect
 func (proxy *HTTPProxy) httpRedirect(session int, w http.ResponseWriter, r *http.Request,
 	status int, location *url.URL) {
@@ -219,6 +298,7 @@ func (proxy *HTTPProxy) httpRedirect(session int, w http.ResponseWriter, r *http
 
 	w.Header().Set("Location", location.String())
 	w.WriteHeader(status)
+	proxy.metrics.httpRequest(r.Method, status)
 
 	proxy.log.HTTPDebug(' ', session, "redirected to %s", location)
 }
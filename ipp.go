@@ -177,7 +177,8 @@ func newIppDecoder(msg *goipp.Message) ippAttrs {
 //                from the UsbDeviceInfo
 //
 //   TXT fields:
-//     air:              hardcoded as "none"
+//     air:              "username,password" if printing requires
+//                       authentication, "none" otherwise
 //     mopria-certified: "mopria-certified"
 //     rp:               hardcoded as "ipp/print"
 //     kind:             "printer-kind"
@@ -241,7 +242,11 @@ func (attrs ippAttrs) decode(usbinfo UsbDeviceInfo) (
 		}
 	}
 
-	svc.Txt.Add("air", "none")
+	if Conf().Auth.Print != AuthNone {
+		svc.Txt.Add("air", "username,password")
+	} else {
+		svc.Txt.Add("air", "none")
+	}
 	svc.Txt.IfNotEmpty("mopria-certified", attrs.strSingle("mopria-certified"))
 	svc.Txt.Add("rp", "ipp/print")
 	svc.Txt.Add("priority", "50")
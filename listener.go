@@ -11,6 +11,7 @@ package main
 import (
 	"net"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -25,15 +26,41 @@ import (
 // and to filter incoming connection in Accept() wrapper rather
 // that create separate IPv4 and IPv6 listeners and dial with
 // them both
+//
+// The only exception is explicitly configured listen addresses:
+// device listener then consists of multiple listeners, one per
+// address (see multiListener)
 type Listener struct {
-	net.Listener // Underlying net.Listener
+	net.Listener          // Underlying net.Listener
+	loopbackOnly bool     // Accept only loopback connections
+	interfaces   []string // Accept only connections to these interfaces
 }
 
-// NewListener creates new listener
+// NewListener creates new listener for device, according to
+// the network configuration
 func NewListener(port int) (net.Listener, error) {
+	conf := Conf()
+	if len(conf.ListenAddrs) != 0 {
+		return newAddrsListener(port, conf.ListenAddrs)
+	}
+
+	nl, err := newListener(port, conf.LoopbackOnly)
+	if err != nil {
+		return nil, err
+	}
+
+	l := nl.(Listener)
+	l.interfaces = conf.Interfaces
+
+	return l, nil
+}
+
+// newListener creates new listener. If loopbackOnly is true,
+// only loopback connections are accepted
+func newListener(port int, loopbackOnly bool) (net.Listener, error) {
 	// Setup network and address
 	network := "tcp4"
-	if Conf.IPV6Enable {
+	if Conf().IPV6Enable {
 		network = "tcp"
 	}
 
@@ -46,7 +73,52 @@ func NewListener(port int) (net.Listener, error) {
 	}
 
 	// Wrap into Listener
-	return Listener{nl}, nil
+	return Listener{Listener: nl, loopbackOnly: loopbackOnly}, nil
+}
+
+// newAddrsListener creates listener, bound to the specified
+// addresses. Port must be available on all addresses
+func newAddrsListener(port int, addrs []string) (net.Listener, error) {
+	var listeners []net.Listener
+
+	network := "tcp4"
+	if Conf().IPV6Enable {
+		network = "tcp"
+	}
+
+	for _, addr := range addrs {
+		nl, err := net.Listen(network,
+			net.JoinHostPort(addr, strconv.Itoa(port)))
+
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+
+		listeners = append(listeners, Listener{Listener: nl})
+	}
+
+	if len(listeners) == 1 {
+		return listeners[0], nil
+	}
+
+	return newMultiListener(listeners), nil
+}
+
+// wrapListener wraps net.Listener, created elsewhere (i.e., passed
+// by systemd), into Listener, that filters incoming connections
+// according to the network configuration
+func wrapListener(nl net.Listener) net.Listener {
+	l := Listener{Listener: nl}
+
+	if conf := Conf(); len(conf.ListenAddrs) == 0 {
+		l.loopbackOnly = conf.LoopbackOnly
+		l.interfaces = conf.Interfaces
+	}
+
+	return l
 }
 
 // Accept new connection
@@ -66,9 +138,11 @@ func (l Listener) Accept() (net.Conn, error) {
 			continue
 		}
 
-		// Reject non-loopback connections, if required
-		if Conf.LoopbackOnly &&
-			!tcpconn.LocalAddr().(*net.TCPAddr).IP.IsLoopback() {
+		// Reject connections to the wrong interfaces, if required
+		local := tcpconn.LocalAddr().(*net.TCPAddr).IP
+		if (l.loopbackOnly && !local.IsLoopback()) ||
+			(l.interfaces != nil && !listenerOnInterfaces(local,
+				l.interfaces)) {
 			tcpconn.SetLinger(0)
 			tcpconn.Close()
 			continue
@@ -81,3 +155,123 @@ func (l Listener) Accept() (net.Conn, error) {
 		return tcpconn, nil
 	}
 }
+
+// listenerOnInterfaces reports whether local address belongs to
+// one of the named network interfaces
+//
+// Interface addresses are obtained for every connection, so
+// address changes (i.e., by DHCP) are handled properly
+func listenerOnInterfaces(local net.IP, names []string) bool {
+	for _, name := range names {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			continue
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(local) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// multiListener combines multiple listeners into one
+//
+// Temporary Accept errors of underlying listeners (i.e., EMFILE)
+// are returned to the caller, which is expected to retry, as
+// http.Server does. Permanent error of any underlying listener
+// (including its closing) terminates the whole multiListener
+type multiListener struct {
+	listeners []net.Listener // Underlying listeners
+	conns     chan net.Conn  // Accepted connections
+	errs      chan error     // Temporary Accept errors
+	done      chan struct{}  // Closed when any listener failed
+	err       error          // Listener error
+	doneOnce  sync.Once      // To close done once
+}
+
+// newMultiListener creates new multiListener
+func newMultiListener(listeners []net.Listener) net.Listener {
+	l := &multiListener{
+		listeners: listeners,
+		conns:     make(chan net.Conn),
+		errs:      make(chan error),
+		done:      make(chan struct{}),
+	}
+
+	for _, nl := range listeners {
+		go l.acceptLoop(nl)
+	}
+
+	return l
+}
+
+// Accept new connection
+func (l *multiListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+// Close the listener
+func (l *multiListener) Close() error {
+	var err error
+
+	for _, nl := range l.listeners {
+		if err2 := nl.Close(); err == nil {
+			err = err2
+		}
+	}
+
+	return err
+}
+
+// Addr returns address of the first underlying listener
+func (l *multiListener) Addr() net.Addr {
+	return l.listeners[0].Addr()
+}
+
+// acceptLoop accepts connections from one of underlying listeners
+func (l *multiListener) acceptLoop(nl net.Listener) {
+	for {
+		conn, err := nl.Accept()
+		if ne, ok := err.(net.Error); ok && ne.Temporary() {
+			// Wait until error is taken by Accept, so caller's
+			// backoff applies to this loop as well
+			select {
+			case l.errs <- err:
+				continue
+			case <-l.done:
+				return
+			}
+		}
+
+		if err != nil {
+			l.doneOnce.Do(func() {
+				l.err = err
+				close(l.done)
+			})
+			return
+		}
+
+		select {
+		case l.conns <- conn:
+		case <-l.done:
+			conn.Close()
+			return
+		}
+	}
+}
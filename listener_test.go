@@ -0,0 +1,256 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * HTTP listener test
+ */
+
+package main
+
+import (
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// listenerTestLoopback returns name of the loopback interface
+func listenerTestLoopback(t *testing.T) string {
+	idx, err := Loopback()
+	if err != nil {
+		t.Skipf("%s", err)
+	}
+
+	iface, err := net.InterfaceByIndex(idx)
+	if err != nil {
+		t.Skipf("%s", err)
+	}
+
+	return iface.Name
+}
+
+// listenerTestPort returns free TCP port
+func listenerTestPort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %s", err)
+	}
+
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	return port
+}
+
+// listenerTestAccepted reports whether connection to addr is
+// accepted by the listener
+func listenerTestAccepted(l net.Listener, addr string) bool {
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+
+	select {
+	case conn := <-accepted:
+		conn.Close()
+		return true
+	case <-time.After(250 * time.Millisecond):
+		return false
+	}
+}
+
+// Test listening on selected network interfaces
+func TestListenerInterfaces(t *testing.T) {
+	lo := listenerTestLoopback(t)
+
+	// Interface names
+	defer confTestSet(func(conf *Configuration) {
+		conf.LoopbackOnly = false
+		conf.Interfaces = []string{lo}
+	})()
+
+	port := listenerTestPort(t)
+	l, err := NewListener(port)
+	if err != nil {
+		t.Fatalf("NewListener: %s", err)
+	}
+
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	if !listenerTestAccepted(l, addr) {
+		t.Errorf("interface %s: connection rejected", lo)
+	}
+	l.Close()
+
+	idx, loopback, err := ListenInterfaces()
+	if err != nil || len(idx) != 1 || !loopback {
+		t.Errorf("ListenInterfaces: %v %v %v", idx, loopback, err)
+	}
+
+	// Connections to other interfaces are rejected
+	confTestSet(func(conf *Configuration) {
+		conf.Interfaces = []string{"ipp-usb-none"}
+	})
+	l, err = NewListener(port)
+	if err != nil {
+		t.Fatalf("NewListener: %s", err)
+	}
+
+	if listenerTestAccepted(l, addr) {
+		t.Errorf("interface ipp-usb-none: connection accepted")
+	}
+	l.Close()
+
+	if _, _, err = ListenInterfaces(); err == nil {
+		t.Errorf("ListenInterfaces: missed interface: error expected")
+	}
+}
+
+// Test listening on selected addresses
+func TestListenerAddrs(t *testing.T) {
+	listenerTestLoopback(t)
+
+	addrs := []string{"127.0.0.1", "127.0.0.2"}
+	if probe, err := net.Listen("tcp", "127.0.0.2:0"); err == nil {
+		probe.Close()
+	} else {
+		addrs = addrs[:1]
+	}
+
+	defer confTestSet(func(conf *Configuration) { conf.ListenAddrs = addrs })()
+	port := listenerTestPort(t)
+
+	l, err := NewListener(port)
+	if err != nil {
+		t.Fatalf("NewListener: %s", err)
+	}
+	defer l.Close()
+
+	for _, addr := range addrs {
+		addr = net.JoinHostPort(addr, strconv.Itoa(port))
+		if !listenerTestAccepted(l, addr) {
+			t.Errorf("%s: connection rejected", addr)
+		}
+	}
+
+	// Unlisted addresses are not bound
+	if len(addrs) > 1 {
+		addr := net.JoinHostPort("127.0.0.3", strconv.Itoa(port))
+		if listenerTestAccepted(l, addr) {
+			t.Errorf("%s: connection accepted", addr)
+		}
+	}
+
+	_, loopback, err := ListenInterfaces()
+	if err != nil || !loopback {
+		t.Errorf("ListenInterfaces: %v %v", loopback, err)
+	}
+
+	confTestSet(func(conf *Configuration) {
+		conf.ListenAddrs = []string{"0.0.0.0"}
+	})
+	idx, _, err := ListenInterfaces()
+	if err != nil || idx != nil {
+		t.Errorf("ListenInterfaces: unspecified address: %v %v", idx, err)
+	}
+}
+
+// Test loading of interface and listen parameters
+func TestListenerConf(t *testing.T) {
+	conf := confDefault
+
+	rec := &IniRecord{Key: "interface", Value: "lo, eth1"}
+	err := confLoadInterfaceKey(&conf, rec)
+	if err != nil || conf.LoopbackOnly || len(conf.Interfaces) != 2 ||
+		conf.Interfaces[1] != "eth1" {
+		t.Errorf("interface = %s: %v %v %s", rec.Value,
+			conf.LoopbackOnly, conf.Interfaces, err)
+	}
+
+	rec.Value = "loopback"
+	err = confLoadInterfaceKey(&conf, rec)
+	if err != nil || !conf.LoopbackOnly || conf.Interfaces != nil {
+		t.Errorf("interface = %s: %v %v %s", rec.Value,
+			conf.LoopbackOnly, conf.Interfaces, err)
+	}
+
+	rec = &IniRecord{Key: "listen", Value: "127.0.0.1, fe80::1%eth0"}
+	var addrs []string
+	err = confLoadListenKey(&addrs, rec)
+	if err != nil || len(addrs) != 2 || addrs[1] != "fe80::1%eth0" {
+		t.Errorf("listen = %s: %v %s", rec.Value, addrs, err)
+	}
+
+	rec.Value = "127.0.0.1, localhost"
+	if err = confLoadListenKey(&addrs, rec); err == nil {
+		t.Errorf("listen = %s: error expected", rec.Value)
+	}
+}
+
+// listenerTestTempError is the temporary net.Error
+type listenerTestTempError struct{}
+
+func (listenerTestTempError) Error() string   { return "temporary error" }
+func (listenerTestTempError) Timeout() bool   { return false }
+func (listenerTestTempError) Temporary() bool { return true }
+
+// listenerTestFailing is the net.Listener, which Accept fails
+// with the temporary error once, then works as usual
+type listenerTestFailing struct {
+	net.Listener
+	failed int32
+}
+
+// Accept fails once with the temporary error
+func (l *listenerTestFailing) Accept() (net.Conn, error) {
+	if atomic.CompareAndSwapInt32(&l.failed, 0, 1) {
+		return nil, listenerTestTempError{}
+	}
+	return l.Listener.Accept()
+}
+
+// Test combining of multiple listeners
+func TestListenerMulti(t *testing.T) {
+	var listeners []net.Listener
+	for i := 0; i < 2; i++ {
+		nl, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("net.Listen: %s", err)
+		}
+		listeners = append(listeners, nl)
+	}
+
+	failing := &listenerTestFailing{Listener: listeners[0]}
+	listeners[0] = failing
+
+	l := newMultiListener(listeners)
+	defer l.Close()
+
+	// Temporary error is returned, but listener keeps working
+	_, err := l.Accept()
+	if ne, ok := err.(net.Error); !ok || !ne.Temporary() {
+		t.Fatalf("Accept: %v, expected temporary error", err)
+	}
+
+	for _, nl := range listeners {
+		if !listenerTestAccepted(l, nl.Addr().String()) {
+			t.Errorf("%s: connection rejected", nl.Addr())
+		}
+	}
+
+	// Permanent error terminates the listener
+	listeners[1].Close()
+	if _, err = l.Accept(); err == nil {
+		t.Errorf("Accept: error expected after close")
+	}
+}
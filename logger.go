@@ -49,7 +49,7 @@ var (
 )
 
 // LogLevel enumerates possible log levels
-type LogLevel int
+type LogLevel int32
 
 const (
 	LogError LogLevel = 1 << iota
@@ -76,6 +76,35 @@ func (levels *LogLevel) Adjust() {
 	}
 }
 
+// String returns LogLevel mask as a comma-separated list of
+// keywords, in the same form, as used in the configuration file
+func (levels LogLevel) String() string {
+	var words []string
+
+	switch {
+	case levels&LogTraceAll == LogTraceAll:
+		return "all"
+	case levels&LogTraceAll != 0:
+		if levels&LogTraceIPP != 0 {
+			words = append(words, "trace-ipp")
+		}
+		if levels&LogTraceESCL != 0 {
+			words = append(words, "trace-escl")
+		}
+		if levels&LogTraceHTTP != 0 {
+			words = append(words, "trace-http")
+		}
+	case levels&LogDebug != 0:
+		words = append(words, "debug")
+	case levels&LogInfo != 0:
+		words = append(words, "info")
+	case levels&LogError != 0:
+		words = append(words, "error")
+	}
+
+	return strings.Join(words, ",")
+}
+
 // loggerMode enumerates possible Logger modes
 type loggerMode int
 
@@ -113,9 +142,7 @@ func NewLogger() *Logger {
 		mode:     loggerNoMode,
 		levels:   LogAll,
 		ccLevels: 0,
-		outhook: func(w io.Writer, _ LogLevel, line []byte) {
-			w.Write(line)
-		},
+		outhook:  logPlainWrite,
 	}
 
 	l.LogMessage.logger = l
@@ -125,22 +152,57 @@ func NewLogger() *Logger {
 
 // ToNowhere redirects log to nowhere
 func (l *Logger) ToNowhere() *Logger {
+	l.lock.Lock()
 	l.mode = loggerDiscard
 	l.out = ioutil.Discard
+	l.lock.Unlock()
 	return l
 }
 
+// logPlainWrite is the default Logger output hook
+func logPlainWrite(w io.Writer, _ LogLevel, line []byte) {
+	w.Write(line)
+}
+
+// LogConfigure applies logging configuration from Conf to the
+// standard loggers. It is called at startup and again, when
+// configuration is reloaded
+//
+// Console colors are applied only if Console actually writes
+// to console. Output hook is replaced under the Console lock, as
+// devices may write to the log concurrently
+func LogConfigure() {
+	conf := Conf()
+
+	Console.lock.Lock()
+	if Console.mode == loggerConsole {
+		Console.outhook = logPlainWrite
+		if conf.ColorConsole && logIsAtty(os.Stdout) {
+			Console.outhook = logColorConsoleWrite
+		}
+	}
+	Console.lock.Unlock()
+
+	Log.SetLevels(conf.LogMain)
+	Console.SetLevels(conf.LogConsole)
+	Log.CcUpdate()
+}
+
 // ToConsole redirects log to console
 func (l *Logger) ToConsole() *Logger {
+	l.lock.Lock()
 	l.mode = loggerConsole
 	l.out = os.Stdout
+	l.lock.Unlock()
 	return l
 }
 
 // ToColorConsole redirects log to console with ANSI colors
 func (l *Logger) ToColorConsole() *Logger {
 	if logIsAtty(os.Stdout) {
+		l.lock.Lock()
 		l.outhook = logColorConsoleWrite
+		l.lock.Unlock()
 	}
 
 	return l.ToConsole()
@@ -149,21 +211,34 @@ func (l *Logger) ToColorConsole() *Logger {
 // ToStdOutErr redirects log to Stdout or Stderr, depending
 // on LogLevel
 func (l *Logger) ToStdOutErr() *Logger {
+	l.lock.Lock()
 	l.outhook = func(out io.Writer, level LogLevel, line []byte) {
 		if level == LogError {
 			out = os.Stderr
 		}
 		out.Write(line)
 	}
+	l.lock.Unlock()
 
 	return l.ToConsole()
 }
 
 // ToFile redirects log to arbitrary log file
+//
+// If logger already writes to file, this file is closed, so
+// logger may be redirected at runtime
 func (l *Logger) ToFile(path string) *Logger {
+	l.lock.Lock()
+	if l.mode == loggerFile && l.out != nil {
+		if file, ok := l.out.(*os.File); ok {
+			file.Close()
+		}
+	}
+
 	l.path = path
 	l.mode = loggerFile
 	l.out = nil // Will be opened on demand
+	l.lock.Unlock()
 	return l
 }
 
@@ -174,7 +249,12 @@ func (l *Logger) ToMainFile() *Logger {
 
 // ToDevFile redirects log to per-device log file
 func (l *Logger) ToDevFile(info UsbDeviceInfo) *Logger {
-	return l.ToFile(filepath.Join(PathLogDir, info.Ident()+".log"))
+	return l.ToFile(logDevFilePath(info.Ident()))
+}
+
+// logDevFilePath returns path to the per-device log file
+func logDevFilePath(ident string) string {
+	return filepath.Join(PathLogDir, ident+".log")
 }
 
 // Cc adds io.Writer to send "carbon copy" to
@@ -186,8 +266,18 @@ func (l *Logger) ToDevFile(info UsbDeviceInfo) *Logger {
 //   LogInfo implies LogError
 func (l *Logger) Cc(to *Logger) *Logger {
 	l.cc = append(l.cc, to)
-	l.ccLevels |= to.levels
+	return l.CcUpdate()
+}
 
+// CcUpdate updates carbon copy filtering, after levels of
+// carbon copy loggers were changed
+func (l *Logger) CcUpdate() *Logger {
+	var ccLevels LogLevel
+	for _, to := range l.cc {
+		ccLevels |= to.Levels()
+	}
+
+	atomic.StoreInt32((*int32)(&l.ccLevels), int32(ccLevels))
 	return l
 }
 
@@ -201,12 +291,26 @@ func (l *Logger) Close() {
 }
 
 // SetLevels set logger's log levels
+//
+// Log levels may be changed at runtime, while logger is in use
 func (l *Logger) SetLevels(levels LogLevel) *Logger {
 	levels.Adjust()
-	l.levels = levels
+	atomic.StoreInt32((*int32)(&l.levels), int32(levels))
 	return l
 }
 
+// Levels returns logger's log levels
+func (l *Logger) Levels() LogLevel {
+	return LogLevel(atomic.LoadInt32((*int32)(&l.levels)))
+}
+
+// mask returns log levels, generated by logger itself or
+// by its carbon copies
+func (l *Logger) mask() LogLevel {
+	return l.Levels() |
+		LogLevel(atomic.LoadInt32((*int32)(&l.ccLevels)))
+}
+
 // Pause the logger. All output will be buffered,
 // and flushed to destination when logger is resumed
 func (l *Logger) Pause() *Logger {
@@ -226,14 +330,19 @@ func (l *Logger) Resume() *Logger {
 // Panic writes to log a panic message, including
 // call stack, and terminates a program
 func (l *Logger) Panic(v interface{}) {
+	l.Recovered(v)
+	os.Exit(1)
+}
+
+// Recovered writes to log a recovered panic message, including
+// call stack. Unlike Panic, it doesn't terminate a program
+func (l *Logger) Recovered(v interface{}) {
 	l.Error('!', "panic: %v", v)
 	l.Error('!', "")
 
 	w := l.LineWriter(LogError, '!')
 	w.Write(debug.Stack())
 	w.Close()
-
-	os.Exit(1)
 }
 
 // Format a time prefix
@@ -262,18 +371,19 @@ func (l *Logger) rotate() {
 		return
 	}
 
+	conf := Conf()
 	stat, err := file.Stat()
-	if err != nil || stat.Size() <= Conf.LogMaxFileSize {
+	if err != nil || stat.Size() <= conf.LogMaxFileSize {
 		return
 	}
 
 	// Perform rotation
-	if Conf.LogMaxBackupFiles > 0 {
+	if conf.LogMaxBackupFiles > 0 {
 		prevpath := ""
-		for i := Conf.LogMaxBackupFiles; i > 0; i-- {
+		for i := conf.LogMaxBackupFiles; i > 0; i-- {
 			nextpath := fmt.Sprintf("%s.%d.gz", l.path, i-1)
 
-			if i == Conf.LogMaxBackupFiles {
+			if i == conf.LogMaxBackupFiles {
 				os.Remove(nextpath)
 			} else {
 				os.Rename(nextpath, prevpath)
@@ -353,7 +463,7 @@ func (msg *LogMessage) Begin() *LogMessage {
 func (msg *LogMessage) Add(level LogLevel, prefix byte,
 	format string, args ...interface{}) *LogMessage {
 
-	if (msg.logger.levels|msg.logger.ccLevels)&level != 0 {
+	if msg.logger.mask()&level != 0 {
 		buf := logLineBufAlloc(level, prefix)
 		fmt.Fprintf(buf, format, args...)
 
@@ -370,7 +480,7 @@ func (msg *LogMessage) Nl(level LogLevel) *LogMessage {
 
 // addBytes adds a next line of log message, taking slice of bytes as input
 func (msg *LogMessage) addBytes(level LogLevel, prefix byte, line []byte) *LogMessage {
-	if (msg.logger.levels|msg.logger.ccLevels)&level != 0 {
+	if msg.logger.mask()&level != 0 {
 		buf := logLineBufAlloc(level, prefix)
 		buf.Write(line)
 
@@ -434,7 +544,7 @@ func (msg *LogMessage) Check(err error) {
 
 // HexDump appends a HEX dump to the log message
 func (msg *LogMessage) HexDump(level LogLevel, data []byte) *LogMessage {
-	if (msg.logger.levels|msg.logger.ccLevels)&level == 0 {
+	if msg.logger.mask()&level == 0 {
 		return msg
 	}
 
@@ -489,7 +599,7 @@ func (msg *LogMessage) HexDump(level LogLevel, data []byte) *LogMessage {
 func (msg *LogMessage) HTTPRequest(level LogLevel, prefix byte,
 	session int, rq *http.Request) *LogMessage {
 
-	if (msg.logger.levels|msg.logger.ccLevels)&level == 0 {
+	if msg.logger.mask()&level == 0 {
 		return msg
 	}
 
@@ -522,7 +632,7 @@ func (msg *LogMessage) HTTPRequest(level LogLevel, prefix byte,
 func (msg *LogMessage) HTTPResponse(level LogLevel, prefix byte,
 	session int, rsp *http.Response) *LogMessage {
 
-	if (msg.logger.levels|msg.logger.ccLevels)&level == 0 {
+	if msg.logger.mask()&level == 0 {
 		return msg
 	}
 
@@ -600,7 +710,7 @@ func (msg *LogMessage) HTTPDebug(prefix byte,
 func (msg *LogMessage) IppRequest(level LogLevel, prefix byte,
 	m *goipp.Message) *LogMessage {
 
-	if (msg.logger.levels|msg.logger.ccLevels)&level != 0 {
+	if msg.logger.mask()&level != 0 {
 		m.Print(msg.LineWriter(level, prefix), true)
 	}
 	return msg
@@ -610,7 +720,7 @@ func (msg *LogMessage) IppRequest(level LogLevel, prefix byte,
 func (msg *LogMessage) IppResponse(level LogLevel, prefix byte,
 	m *goipp.Message) *LogMessage {
 
-	if (msg.logger.levels|msg.logger.ccLevels)&level != 0 {
+	if msg.logger.mask()&level != 0 {
 		m.Print(msg.LineWriter(level, prefix), false)
 	}
 	return msg
@@ -666,7 +776,7 @@ func (msg *LogMessage) Flush() {
 
 	// Open log file on demand
 	if msg.logger.out == nil && msg.logger.mode == loggerFile {
-		os.MkdirAll(PathLogDir, 0755)
+		os.MkdirAll(filepath.Dir(msg.logger.path), 0755)
 		msg.logger.out, _ = os.OpenFile(msg.logger.path,
 			os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
 	}
@@ -690,7 +800,7 @@ func (msg *LogMessage) Flush() {
 		cclist = append(cclist, struct {
 			levels LogLevel
 			msg    *LogMessage
-		}{cc.levels, cc.Begin()})
+		}{cc.Levels(), cc.Begin()})
 	}
 
 	// Send message content to the logger
@@ -703,7 +813,7 @@ func (msg *LogMessage) Flush() {
 
 		// Generate own output
 		buf.Truncate(timeLen)
-		if l.level&msg.logger.levels != 0 {
+		if l.level&msg.logger.Levels() != 0 {
 			if !l.empty() {
 				if timeLen != 0 {
 					buf.WriteByte(' ')
@@ -3,7 +3,7 @@
  * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
  * See LICENSE for license terms and conditions
  *
- * Loopback interface index discovery
+ * Loopback and listen interfaces index discovery
  */
 
 package main
@@ -12,6 +12,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"strings"
 )
 
 // Loopback returns index of loopback interface
@@ -31,3 +32,90 @@ func Loopback() (int, error) {
 
 	return 0, fmt.Errorf("Loopback discovery: %s", err)
 }
+
+// ListenInterfaces returns indexes of network interfaces, devices
+// are accessible on, according to the network configuration, and
+// reports whether all these interfaces are loopback. If devices
+// are accessible on all interfaces, nil is returned
+func ListenInterfaces() (indexes []int, loopback bool, err error) {
+	var ifaces []net.Interface
+	conf := Conf()
+
+	switch {
+	case len(conf.ListenAddrs) != 0:
+		ifaces, err = listenAddrsInterfaces(conf.ListenAddrs)
+		if ifaces == nil || err != nil {
+			return nil, false, err
+		}
+
+	case conf.Interfaces != nil:
+		for _, name := range conf.Interfaces {
+			iface, err := net.InterfaceByName(name)
+			if err == nil {
+				ifaces = append(ifaces, *iface)
+			}
+		}
+
+	case conf.LoopbackOnly:
+		idx, err := Loopback()
+		return []int{idx}, true, err
+
+	default:
+		return nil, false, nil
+	}
+
+	if len(ifaces) == 0 {
+		return nil, false, errors.New("Interface discovery: not found")
+	}
+
+	loopback = true
+	for _, iface := range ifaces {
+		indexes = append(indexes, iface.Index)
+		loopback = loopback && (iface.Flags&net.FlagLoopback) != 0
+	}
+
+	return indexes, loopback, nil
+}
+
+// listenAddrsInterfaces returns interfaces, that own the listen
+// addresses. If any of addresses is unspecified (0.0.0.0 or ::),
+// nil is returned, which means all interfaces
+func listenAddrsInterfaces(addrs []string) ([]net.Interface, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("Interface discovery: %s", err)
+	}
+
+	var ifaces []net.Interface
+	seen := make(map[int]bool)
+
+	for _, addr := range addrs {
+		zone := ""
+		if i := strings.IndexByte(addr, '%'); i >= 0 {
+			addr, zone = addr[:i], addr[i+1:]
+		}
+
+		ip := net.ParseIP(addr)
+		if ip.IsUnspecified() {
+			return nil, nil
+		}
+
+		for _, iface := range interfaces {
+			if seen[iface.Index] || (zone != "" && zone != iface.Name) {
+				continue
+			}
+
+			ifaddrs, _ := iface.Addrs()
+			for _, ifaddr := range ifaddrs {
+				ipnet, ok := ifaddr.(*net.IPNet)
+				if ok && ipnet.IP.Equal(ip) {
+					ifaces = append(ifaces, iface)
+					seen[iface.Index] = true
+					break
+				}
+			}
+		}
+	}
+
+	return ifaces, nil
+}
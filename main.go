@@ -12,7 +12,9 @@ import (
 	"bytes"
 	"fmt"
 	"os"
+	"path/filepath"
 	"sort"
+	"strings"
 )
 
 const usageText = `Usage:
@@ -27,8 +29,34 @@ Modes are:
                   ignored
     check       - check configuration and exit
 
+Client commands (require running daemon):
+    status      - print daemon and devices status
+    devices     - print detailed information about devices
+    reset dev   - reset device and initialize it again
+    reprobe dev - initialize device again, without reset
+    loglevel [log] [levels]
+                - print or change log levels at runtime. Log is
+                  main, console or device; by default, both main
+                  and device logs are changed
+
+    Device (dev) is specified either by its USB address (i.e., 001:002)
+    or by its identity, as printed by the "devices" command
+
 Options are
     -bg         - run in background (ignored in debug mode)
+    -json       - print output of client commands as JSON
+    -c file     - use the specified configuration file
+    -state-dir dir
+                - use the specified program state directory
+    -log-dir dir
+                - use the specified log directory
+    -quirks-dir dir
+                - use the specified quirks directory
+
+Paths may also be set by environment variables IPP_USB_CONF,
+IPP_USB_STATE_DIR, IPP_USB_LOG_DIR and IPP_USB_QUIRKS_DIR and
+in the configuration file. Command line takes precedence over
+environment, and environment over the configuration file
 `
 
 // RunMode represents the program run mode
@@ -40,6 +68,7 @@ const (
 	RunUdev
 	RunDebug
 	RunCheck
+	RunClient
 )
 
 // String returns RunMode name
@@ -55,6 +84,8 @@ func (m RunMode) String() string {
 		return "debug"
 	case RunCheck:
 		return "check"
+	case RunClient:
+		return "client"
 	}
 
 	return fmt.Sprintf("unknown (%d)", int(m))
@@ -62,8 +93,12 @@ func (m RunMode) String() string {
 
 // RunParameters represents the program run parameters
 type RunParameters struct {
-	Mode       RunMode // Run mode
-	Background bool    // Run in background
+	Mode       RunMode    // Run mode
+	Background bool       // Run in background
+	Command    string     // Client command, RunClient mode only
+	Args       []string   // Client command arguments
+	JSON       bool       // Print client command output as JSON
+	Paths      PathParams // Paths, overridden from the command line
 }
 
 // usage prints detailed usage and exits
@@ -96,8 +131,25 @@ func parseArgv() (params RunParameters) {
 	// For now, default mode is debug mode. It may change in a future
 	params.Mode = RunDebug
 
+	// pathArg consumes path argument of the option
+	args := os.Args[1:]
+	pathArg := func(opt string) string {
+		if len(args) < 2 {
+			usageError("Missing argument for %s", opt)
+		}
+
+		args = args[1:]
+		path, err := filepath.Abs(args[0])
+		if err != nil {
+			usageError("%s: %s", opt, err)
+		}
+
+		return path
+	}
+
 	modes := 0
-	for _, arg := range os.Args[1:] {
+	for ; len(args) > 0; args = args[1:] {
+		arg := args[0]
 		switch arg {
 		case "-h", "-help", "--help":
 			usage()
@@ -115,8 +167,27 @@ func parseArgv() (params RunParameters) {
 			modes++
 		case "-bg":
 			params.Background = true
+		case "-json":
+			params.JSON = true
+		case "-c":
+			params.Paths.ConfFile = pathArg(arg)
+		case "-state-dir":
+			params.Paths.StateDir = pathArg(arg)
+		case "-log-dir":
+			params.Paths.LogDir = pathArg(arg)
+		case "-quirks-dir":
+			params.Paths.QuirksDir = pathArg(arg)
 		default:
-			usageError("Invalid argument %s", arg)
+			if _, ok := CtrlCommands[arg]; ok && modes == 0 {
+				params.Mode = RunClient
+				params.Command = arg
+				modes++
+			} else if params.Mode == RunClient &&
+				!strings.HasPrefix(arg, "-") {
+				params.Args = append(params.Args, arg)
+			} else {
+				usageError("Invalid argument %s", arg)
+			}
 		}
 	}
 
@@ -124,6 +195,16 @@ func parseArgv() (params RunParameters) {
 		usageError("Conflicting run modes")
 	}
 
+	if params.Mode == RunClient {
+		cmd := CtrlCommands[params.Command]
+		switch {
+		case len(params.Args) < cmd.MinArgs:
+			usageError("Missing argument for %s", params.Command)
+		case len(params.Args) > cmd.MaxArgs:
+			usageError("Too many arguments for %s", params.Command)
+		}
+	}
+
 	if params.Mode == RunDebug {
 		params.Background = false
 	}
@@ -138,20 +219,31 @@ func main() {
 	// Parse arguments
 	params := parseArgv()
 
-	// Load configuration file
+	// Load configuration file and setup paths
+	PathOverride(params.Paths, PathEnv())
+
 	err = ConfLoad()
 	InitLog.Check(err)
 
+	PathSetFromConf()
+	Log.ToMainFile()
+
+	// Execute client command. It doesn't require root
+	// privileges, if control socket permissions allow
+	if params.Mode == RunClient {
+		err = CtrlRun(os.Stdout, params.Command, params.Args,
+			params.JSON)
+		InitLog.Check(err)
+		os.Exit(0)
+	}
+
 	// Setup logging
 	if params.Mode != RunDebug && params.Mode != RunCheck {
 		Console.ToNowhere()
-	} else if Conf.ColorConsole {
-		Console.ToColorConsole()
 	}
 
-	Log.SetLevels(Conf.LogMain)
-	Console.SetLevels(Conf.LogConsole)
 	Log.Cc(Console)
+	LogConfigure()
 
 	// In RunCheck mode, list IPP-over-USB devices
 	if params.Mode == RunCheck {
@@ -175,21 +267,27 @@ func main() {
 			for i, dev := range list {
 				buf.Reset()
 				fmt.Fprintf(&buf, "%3d. %s", i+1, dev.UsbAddr)
-				if info, err := dev.GetUsbDeviceInfo(); err == nil {
+				info, err := dev.GetUsbDeviceInfo()
+				if err == nil {
 					fmt.Fprintf(&buf, "  %4.4x:%.4x  %q",
 						info.Vendor, info.Product, info.MfgAndProduct)
 				}
 
 				InitLog.Info(0, " %s", buf.String())
+
+				if err != nil {
+					continue
+				}
+
+				for _, q := range Conf().Quirks.Match(info) {
+					InitLog.Info(0, "      quirks from [%s] (%s)",
+						q.Model, q.Origin)
+					InitLog.Info(0, "        %s", q.Match)
+				}
 			}
 		}
 	}
 
-	// Check user privileges
-	if os.Geteuid() != 0 {
-		InitLog.Exit(0, "This program requires root privileges")
-	}
-
 	// If mode is "check", we are done
 	if params.Mode == RunCheck {
 		os.Exit(0)
@@ -204,9 +302,16 @@ func main() {
 
 	// Prevent multiple copies of ipp-usb from being running
 	// in a same time
+	//
+	// Note, ipp-usb may run without root privileges, if USB
+	// devices and program directories are accessible
 	os.MkdirAll(PathLockDir, 0755)
 	lock, err := os.OpenFile(PathLockFile,
 		os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if os.IsPermission(err) && os.Geteuid() != 0 {
+		InitLog.Exit(0, "This program requires root privileges "+
+			"or write access to %s", PathProgState)
+	}
 	InitLog.Check(err)
 	defer lock.Close()
 
@@ -221,6 +326,10 @@ func main() {
 	}
 	InitLog.Check(err)
 
+	// Take sockets, passed by systemd socket activation, if any
+	err = SdListenFds()
+	InitLog.Check(err)
+
 	// Write to log that we are here
 	if params.Mode != RunCheck {
 		Log.Info(' ', "===============================")
@@ -233,6 +342,35 @@ func main() {
 	err = UsbInit()
 	InitLog.Check(err)
 
+	// Start control socket server
+	ctrl, err := NewCtrlServer()
+	InitLog.Check(err)
+	defer ctrl.Close()
+
+	// Start metrics server, if enabled
+	conf := Conf()
+	if conf.MetricsPort != 0 {
+		metrics, err := NewMetricsServer(conf.MetricsPort,
+			conf.MetricsLoopback)
+		InitLog.Check(err)
+		defer metrics.Close()
+	}
+
+	// Start status page server, if enabled
+	if conf.StatusPort != 0 {
+		status, err := NewStatusServer(conf.StatusPort,
+			conf.StatusLoopback)
+		InitLog.Check(err)
+		defer status.Close()
+	}
+
+	// Everything that requires root privileges is opened,
+	// so drop them, if configured
+	if conf.User != "" && os.Geteuid() == 0 {
+		err = DropPrivileges(conf.User, conf.Group)
+		InitLog.Check(err)
+	}
+
 	// Close stdin/stdout/stderr, unless running in debug mode
 	if params.Mode != RunDebug {
 		err = CloseStdInOutErr()
@@ -0,0 +1,452 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Metrics, in Prometheus text exposition format
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DevMetrics contains per-device metrics
+//
+// Metrics are indexed by device Ident and survive device
+// reinitialization. All methods may be called on nil
+// *DevMetrics, and do nothing in this case
+type DevMetrics struct {
+	lock          sync.Mutex           // Access lock
+	httpRequests  map[[2]string]uint64 // By method and status
+	usbErrors     map[string]uint64    // By UsbErrCode
+	bytesSent     uint64               // Bytes sent to USB
+	bytesRecv     uint64               // Bytes received from USB
+	queueWaitSum  time.Duration        // Total connection wait time
+	queueWaitCnt  uint64               // Count of connection waits
+	initSum       time.Duration        // Total initialization time
+	initCnt       uint64               // Count of initializations
+	resets        uint64               // Count of device resets
+	dnssdUp       bool                 // DNS-SD services published
+	dnssdFailures uint64               // DNS-SD publish failures
+	transport     *UsbTransport        // Current transport, if any
+}
+
+// metricsRegistry contains all metrics
+var metricsRegistry = struct {
+	sync.Mutex
+	devs         map[string]*DevMetrics // Per-device metrics, by Ident
+	initFailures map[PnPErrClass]uint64 // Init failures, by class
+	initRetries  uint64                 // Init retries
+}{
+	devs:         make(map[string]*DevMetrics),
+	initFailures: make(map[PnPErrClass]uint64),
+}
+
+// MetricsDev returns metrics of the device with the specified Ident,
+// creating them, if needed
+func MetricsDev(ident string) *DevMetrics {
+	metricsRegistry.Lock()
+	defer metricsRegistry.Unlock()
+
+	dm := metricsRegistry.devs[ident]
+	if dm == nil {
+		dm = &DevMetrics{
+			httpRequests: make(map[[2]string]uint64),
+			usbErrors:    make(map[string]uint64),
+		}
+		metricsRegistry.devs[ident] = dm
+	}
+
+	return dm
+}
+
+// metricsInitFailed counts failed device initialization
+func metricsInitFailed(class PnPErrClass) {
+	metricsRegistry.Lock()
+	metricsRegistry.initFailures[class]++
+	metricsRegistry.Unlock()
+}
+
+// metricsInitRetry counts retry of device initialization
+func metricsInitRetry() {
+	metricsRegistry.Lock()
+	metricsRegistry.initRetries++
+	metricsRegistry.Unlock()
+}
+
+// attach sets transport, which connection pool is reported
+func (dm *DevMetrics) attach(transport *UsbTransport) {
+	if dm == nil {
+		return
+	}
+
+	dm.lock.Lock()
+	dm.transport = transport
+	dm.lock.Unlock()
+}
+
+// detach clears transport, if it is the current one
+func (dm *DevMetrics) detach(transport *UsbTransport) {
+	if dm == nil {
+		return
+	}
+
+	dm.lock.Lock()
+	if dm.transport == transport {
+		dm.transport = nil
+	}
+	dm.lock.Unlock()
+}
+
+// httpRequest counts HTTP request, handled by proxy
+func (dm *DevMetrics) httpRequest(method string, status int) {
+	if dm == nil {
+		return
+	}
+
+	// Method comes from client, so limit set of possible
+	// values, to keep count of samples bounded
+	switch method {
+	case "GET", "HEAD", "POST", "PUT", "DELETE", "OPTIONS":
+	default:
+		method = "other"
+	}
+
+	dm.lock.Lock()
+	dm.httpRequests[[2]string{method, strconv.Itoa(status)}]++
+	dm.lock.Unlock()
+}
+
+// usbIO counts bytes, sent to and received from USB, and USB errors
+func (dm *DevMetrics) usbIO(sent, recv int, err error) {
+	if dm == nil {
+		return
+	}
+
+	dm.lock.Lock()
+	dm.bytesSent += uint64(sent)
+	dm.bytesRecv += uint64(recv)
+
+	if err != nil && !usbIsTimeout(err) {
+		code := "other"
+		if usberr, ok := err.(UsbError); ok {
+			code = usberr.Code.String()
+		}
+		dm.usbErrors[code]++
+	}
+	dm.lock.Unlock()
+}
+
+// queueWait accounts time, spent waiting for USB connection
+func (dm *DevMetrics) queueWait(d time.Duration) {
+	if dm == nil {
+		return
+	}
+
+	dm.lock.Lock()
+	dm.queueWaitSum += d
+	dm.queueWaitCnt++
+	dm.lock.Unlock()
+}
+
+// initDone accounts successful device initialization
+func (dm *DevMetrics) initDone(d time.Duration) {
+	if dm == nil {
+		return
+	}
+
+	dm.lock.Lock()
+	dm.initSum += d
+	dm.initCnt++
+	dm.lock.Unlock()
+}
+
+// reset counts device reset
+func (dm *DevMetrics) reset() {
+	if dm == nil {
+		return
+	}
+
+	dm.lock.Lock()
+	dm.resets++
+	dm.lock.Unlock()
+}
+
+// dnssdStatus sets DNS-SD publisher status
+func (dm *DevMetrics) dnssdStatus(up bool) {
+	if dm == nil {
+		return
+	}
+
+	dm.lock.Lock()
+	dm.dnssdUp = up
+	dm.lock.Unlock()
+}
+
+// dnssdFailed counts DNS-SD publishing failure
+func (dm *DevMetrics) dnssdFailed() {
+	if dm == nil {
+		return
+	}
+
+	dm.lock.Lock()
+	dm.dnssdUp = false
+	dm.dnssdFailures++
+	dm.lock.Unlock()
+}
+
+// metricsFamily represents a family of metrics with
+// the same name
+type metricsFamily struct {
+	name, help, typ string
+	samples         []metricsSample
+}
+
+// metricsSample represents a single sample of metrics
+type metricsSample struct {
+	suffix string  // Name suffix, i.e., _sum or _count
+	labels string  // Formatted labels
+	value  float64 // Sample value
+}
+
+// add adds sample to the metrics family. Labels are given
+// as name, value pairs
+func (fam *metricsFamily) add(value float64, labels ...string) {
+	fam.addWithSuffix("", value, labels...)
+}
+
+// addSummary adds summary sample (_sum and _count) to the
+// metrics family
+func (fam *metricsFamily) addSummary(sum time.Duration, cnt uint64,
+	labels ...string) {
+
+	fam.addWithSuffix("_sum", sum.Seconds(), labels...)
+	fam.addWithSuffix("_count", float64(cnt), labels...)
+}
+
+// addWithSuffix adds sample with name suffix to the metrics family
+func (fam *metricsFamily) addWithSuffix(suffix string, value float64,
+	labels ...string) {
+
+	var buf bytes.Buffer
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i != 0 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(&buf, "%s=\"%s\"", labels[i],
+			metricsEscape(labels[i+1]))
+	}
+
+	fam.samples = append(fam.samples,
+		metricsSample{suffix, buf.String(), value})
+}
+
+// metricsEscape escapes label value
+func metricsEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// MetricsWrite writes all metrics in Prometheus text
+// exposition format
+func MetricsWrite(w io.Writer) {
+	httpRequests := &metricsFamily{name: "ipp_usb_http_requests_total",
+		help: "HTTP requests, handled by proxy", typ: "counter"}
+	bytesSent := &metricsFamily{name: "ipp_usb_usb_sent_bytes_total",
+		help: "Bytes sent to device over USB", typ: "counter"}
+	bytesRecv := &metricsFamily{name: "ipp_usb_usb_received_bytes_total",
+		help: "Bytes received from device over USB", typ: "counter"}
+	usbErrors := &metricsFamily{name: "ipp_usb_usb_errors_total",
+		help: "USB I/O errors, by error code", typ: "counter"}
+	connTotal := &metricsFamily{name: "ipp_usb_usb_connections",
+		help: "USB connections in the pool", typ: "gauge"}
+	connInUse := &metricsFamily{name: "ipp_usb_usb_connections_in_use",
+		help: "USB connections currently in use", typ: "gauge"}
+	queueWait := &metricsFamily{name: "ipp_usb_queue_wait_seconds",
+		help: "Time, requests wait for free USB connection",
+		typ:  "summary"}
+	initTime := &metricsFamily{name: "ipp_usb_device_init_seconds",
+		help: "Duration of successful device initialization",
+		typ:  "summary"}
+	resets := &metricsFamily{name: "ipp_usb_device_resets_total",
+		help: "Device resets", typ: "counter"}
+	dnssdUp := &metricsFamily{name: "ipp_usb_dnssd_published",
+		help: "1 if DNS-SD services are published, 0 otherwise",
+		typ:  "gauge"}
+	dnssdFailures := &metricsFamily{name: "ipp_usb_dnssd_failures_total",
+		help: "DNS-SD publishing failures", typ: "counter"}
+	initFailures := &metricsFamily{name: "ipp_usb_init_failures_total",
+		help: "Failed device initializations, by error class",
+		typ:  "counter"}
+	initRetries := &metricsFamily{name: "ipp_usb_init_retries_total",
+		help: "Retries of device initialization", typ: "counter"}
+	devices := &metricsFamily{name: "ipp_usb_devices",
+		help: "Devices, known to PnP manager, by state", typ: "gauge"}
+
+	// Collect global metrics
+	metricsRegistry.Lock()
+
+	idents := make([]string, 0, len(metricsRegistry.devs))
+	for ident := range metricsRegistry.devs {
+		idents = append(idents, ident)
+	}
+	sort.Strings(idents)
+
+	devs := make([]*DevMetrics, len(idents))
+	for i, ident := range idents {
+		devs[i] = metricsRegistry.devs[ident]
+	}
+
+	for class := PnPErrOther; class <= PnPErrProtocol; class++ {
+		initFailures.add(float64(metricsRegistry.initFailures[class]),
+			"class", class.String())
+	}
+
+	initRetries.add(float64(metricsRegistry.initRetries))
+	metricsRegistry.Unlock()
+
+	states := make(map[PnPDevState]int)
+	for _, st := range PnPStatus() {
+		states[st.State]++
+	}
+
+	for state := PnPDevInitializing; state <= PnPDevDetached; state++ {
+		devices.add(float64(states[state]), "state", state.String())
+	}
+
+	// Collect per-device metrics
+	for i, dm := range devs {
+		dev := []string{"device", idents[i]}
+
+		dm.lock.Lock()
+
+		keys := make([][2]string, 0, len(dm.httpRequests))
+		for key := range dm.httpRequests {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i][0] < keys[j][0] ||
+				(keys[i][0] == keys[j][0] && keys[i][1] < keys[j][1])
+		})
+
+		for _, key := range keys {
+			httpRequests.add(float64(dm.httpRequests[key]),
+				"device", idents[i], "method", key[0], "status", key[1])
+		}
+
+		codes := make([]string, 0, len(dm.usbErrors))
+		for code := range dm.usbErrors {
+			codes = append(codes, code)
+		}
+		sort.Strings(codes)
+
+		for _, code := range codes {
+			usbErrors.add(float64(dm.usbErrors[code]),
+				"device", idents[i], "code", code)
+		}
+
+		bytesSent.add(float64(dm.bytesSent), dev...)
+		bytesRecv.add(float64(dm.bytesRecv), dev...)
+
+		if dm.transport != nil {
+			connTotal.add(float64(cap(dm.transport.connPool)), dev...)
+			connInUse.add(float64(dm.transport.connInUse()), dev...)
+		} else {
+			connTotal.add(0, dev...)
+			connInUse.add(0, dev...)
+		}
+
+		queueWait.addSummary(dm.queueWaitSum, dm.queueWaitCnt, dev...)
+		initTime.addSummary(dm.initSum, dm.initCnt, dev...)
+		resets.add(float64(dm.resets), dev...)
+
+		up := 0.0
+		if dm.dnssdUp {
+			up = 1
+		}
+		dnssdUp.add(up, dev...)
+		dnssdFailures.add(float64(dm.dnssdFailures), dev...)
+
+		dm.lock.Unlock()
+	}
+
+	// Write out everything
+	for _, fam := range []*metricsFamily{
+		devices, initFailures, initRetries, initTime,
+		httpRequests, queueWait, bytesSent, bytesRecv, usbErrors,
+		connTotal, connInUse, resets, dnssdUp, dnssdFailures,
+	} {
+		fam.write(w)
+	}
+}
+
+// write writes metrics family
+func (fam *metricsFamily) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", fam.name, fam.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", fam.name, fam.typ)
+
+	for _, smp := range fam.samples {
+		name := fam.name + smp.suffix
+		value := strconv.FormatFloat(smp.value, 'g', -1, 64)
+		if smp.labels != "" {
+			fmt.Fprintf(w, "%s{%s} %s\n", name, smp.labels, value)
+		} else {
+			fmt.Fprintf(w, "%s %s\n", name, value)
+		}
+	}
+}
+
+// MetricsServer serves metrics over HTTP
+type MetricsServer struct {
+	server    *http.Server  // HTTP server
+	closeWait chan struct{} // Closed at server close
+}
+
+// NewMetricsServer creates new MetricsServer, listening on
+// the specified port
+func NewMetricsServer(port int, loopbackOnly bool) (*MetricsServer, error) {
+	listener, err := newListener(port, loopbackOnly)
+	if err != nil {
+		return nil, fmt.Errorf("metrics: %s", err)
+	}
+
+	return newMetricsServer(listener), nil
+}
+
+// newMetricsServer creates new MetricsServer on a top of
+// existent listener
+func newMetricsServer(listener net.Listener) *MetricsServer {
+	srv := &MetricsServer{closeWait: make(chan struct{})}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		httpNoCache(w)
+		MetricsWrite(w)
+	})
+
+	srv.server = &http.Server{Handler: mux}
+
+	go func() {
+		srv.server.Serve(listener)
+		close(srv.closeWait)
+	}()
+
+	return srv
+}
+
+// Close the server
+func (srv *MetricsServer) Close() {
+	srv.server.Close()
+	<-srv.closeWait
+}
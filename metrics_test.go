@@ -0,0 +1,90 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Metrics test
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Test Prometheus metrics served over HTTP
+func TestMetrics(t *testing.T) {
+	backend, dev, cleanup := usbSimTestSetup(t)
+	defer cleanup()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %s", err)
+	}
+
+	srv := newMetricsServer(listener)
+	defer srv.Close()
+
+	// Start PnP manager and wait until device is ready
+	exited := usbSimTestStartPnP()
+	st := usbSimTestWaitReady(t)
+
+	// Send request to the device
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%d/", st.HTTPPort))
+	if err != nil {
+		t.Fatalf("GET /: %s", err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	// Fetch metrics
+	resp, err = http.Get("http://" + listener.Addr().String() + "/metrics")
+	if err != nil {
+		t.Fatalf("GET /metrics: %s", err)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("GET /metrics: %s", err)
+	}
+
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct,
+		"text/plain") {
+		t.Fatalf("GET /metrics: unexpected Content-Type %q", ct)
+	}
+
+	device := fmt.Sprintf("device=%q", st.Ident)
+	for _, expected := range []string{
+		`ipp_usb_devices{state="ready"} 1`,
+		"# TYPE ipp_usb_http_requests_total counter",
+		"ipp_usb_http_requests_total{" + device +
+			`,method="GET",status="200"}`,
+		"ipp_usb_usb_sent_bytes_total{" + device + "}",
+		"ipp_usb_usb_connections{" + device + "} 3",
+		"ipp_usb_queue_wait_seconds_count{" + device + "}",
+		"ipp_usb_device_init_seconds_sum{" + device + "}",
+		`ipp_usb_init_failures_total{class="other"}`,
+	} {
+		if !strings.Contains(string(data), expected) {
+			t.Errorf("GET /metrics: %q missed:\n%s", expected, data)
+		}
+	}
+
+	backend.Remove(dev.UsbAddr)
+	<-exited
+}
+
+// Test escaping of metrics label values
+func TestMetricsEscape(t *testing.T) {
+	in := "a\\b\"c\nd"
+	out := metricsEscape(in)
+	if out != `a\\b\"c\nd` {
+		t.Fatalf("metricsEscape(%q): %q", in, out)
+	}
+}
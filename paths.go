@@ -8,7 +8,19 @@
 
 package main
 
-const (
+import (
+	"os"
+	"path/filepath"
+)
+
+// Note, these are variables rather than constants. They start with
+// the built-in defaults, PathOverride applies paths given on the command
+// line or in the environment, and PathSetFromConf applies the [paths]
+// configuration section to the rest. So the command line takes precedence
+// over the environment, which takes precedence over the configuration file.
+//
+// Tests may redirect them into the temporary directory
+var (
 	// PathConfDir defines path to configuration directory
 	PathConfDir = "/etc/ipp-usb"
 
@@ -28,9 +40,114 @@ const (
 	// files are saved to
 	PathProgStateDev = PathProgState + "/dev"
 
+	// PathCtrlSocket defines path to the control socket
+	PathCtrlSocket = PathProgState + "/ctrl.sock"
+
 	// PathLogDir defines path to log directory
-	PathLogDir = "/var/log/ipp-usb"
+	PathLogDir = PathDefaultLogDir
 
 	// PathLogFile defines path to the main log file
 	PathLogFile = PathLogDir + "/main.log"
 )
+
+// PathDefaultLogDir defines the default log directory
+const PathDefaultLogDir = "/var/log/ipp-usb"
+
+// PathParams represents paths, that can be overridden from the
+// command line or environment. Empty string means not overridden
+type PathParams struct {
+	ConfFile  string // Configuration file
+	StateDir  string // Program state directory
+	LogDir    string // Log directory
+	QuirksDir string // Quirks directory
+}
+
+// PathOverrides contains paths, overridden from the command line
+// or environment. They take precedence over the configuration file
+var PathOverrides PathParams
+
+// PathEnv returns paths, overridden by environment variables
+func PathEnv() PathParams {
+	return PathParams{
+		ConfFile:  os.Getenv("IPP_USB_CONF"),
+		StateDir:  os.Getenv("IPP_USB_STATE_DIR"),
+		LogDir:    os.Getenv("IPP_USB_LOG_DIR"),
+		QuirksDir: os.Getenv("IPP_USB_QUIRKS_DIR"),
+	}
+}
+
+// PathOverride overrides paths from the command line and environment.
+// Command line takes precedence over environment
+func PathOverride(cmdline, env PathParams) {
+	choose := func(s1, s2 string) string {
+		if s1 != "" {
+			return s1
+		}
+		return s2
+	}
+
+	PathOverrides = PathParams{
+		ConfFile:  choose(cmdline.ConfFile, env.ConfFile),
+		StateDir:  choose(cmdline.StateDir, env.StateDir),
+		LogDir:    choose(cmdline.LogDir, env.LogDir),
+		QuirksDir: choose(cmdline.QuirksDir, env.QuirksDir),
+	}
+
+	if PathOverrides.StateDir != "" {
+		PathSetStateDir(PathOverrides.StateDir)
+	}
+
+	if PathOverrides.LogDir != "" {
+		PathSetLogDir(PathOverrides.LogDir)
+	}
+
+	if PathOverrides.QuirksDir != "" {
+		PathQuirksDir = PathOverrides.QuirksDir
+	}
+}
+
+// PathSetStateDir sets program state directory and all
+// paths, derived from it
+func PathSetStateDir(dir string) {
+	PathProgState = dir
+	PathLockDir = filepath.Join(dir, "lock")
+	PathLockFile = filepath.Join(PathLockDir, "ipp-usb.lock")
+	PathProgStateDev = filepath.Join(dir, "dev")
+	PathCtrlSocket = filepath.Join(dir, "ctrl.sock")
+}
+
+// PathSetLogDir sets log directory and all paths, derived from it
+func PathSetLogDir(dir string) {
+	PathLogDir = dir
+	PathLogFile = filepath.Join(dir, "main.log")
+}
+
+// PathSetFromConf sets paths from the configuration file,
+// unless overridden from the command line or environment
+func PathSetFromConf() {
+	conf := Conf()
+
+	if conf.StateDir != "" && PathOverrides.StateDir == "" {
+		PathSetStateDir(conf.StateDir)
+	}
+
+	if conf.LogDir != "" && PathOverrides.LogDir == "" {
+		PathSetLogDir(conf.LogDir)
+	}
+}
+
+// PathLogDirFromConf returns log directory, implied by the
+// configuration file, unless overridden from the command line
+// or environment
+//
+// It is used to apply log-dir changes on configuration reload
+func PathLogDirFromConf() string {
+	switch {
+	case PathOverrides.LogDir != "":
+		return PathOverrides.LogDir
+	case Conf().LogDir != "":
+		return Conf().LogDir
+	}
+
+	return PathDefaultLogDir
+}
@@ -0,0 +1,98 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Common paths test
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Test paths override from command line, environment and configuration
+func TestPathOverride(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipp-usb-test")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	savedConf := Conf()
+	savedState, savedLog := PathProgState, PathLogDir
+	savedQuirks := PathQuirksDir
+	defer func() {
+		confSet(*savedConf)
+		PathOverride(PathParams{}, PathParams{})
+		PathSetStateDir(savedState)
+		PathSetLogDir(savedLog)
+		PathQuirksDir = savedQuirks
+	}()
+
+	quirks, _ := filepath.Abs("testdata/quirks")
+	conf := filepath.Join(dir, "test.conf")
+	err = ioutil.WriteFile(conf, []byte("[paths]\n"+
+		"state-dir = /conf/state\n"+
+		"log-dir = /conf/log\n"+
+		"quirks-dir = "+quirks+"\n"), 0644)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	// Command line takes precedence over environment, and
+	// environment over configuration file
+	PathOverride(
+		PathParams{ConfFile: conf, StateDir: "/cmd/state"},
+		PathParams{StateDir: "/env/state", LogDir: "/env/log"})
+
+	_, err = ConfReload()
+	if err != nil {
+		t.Fatalf("ConfReload: %s", err)
+	}
+
+	PathSetFromConf()
+
+	if PathProgState != "/cmd/state" ||
+		PathLockFile != "/cmd/state/lock/ipp-usb.lock" ||
+		PathCtrlSocket != "/cmd/state/ctrl.sock" {
+		t.Errorf("state dir: %s %s %s", PathProgState, PathLockFile,
+			PathCtrlSocket)
+	}
+
+	if PathLogDir != "/env/log" || PathLogFile != "/env/log/main.log" {
+		t.Errorf("log dir: %s %s", PathLogDir, PathLogFile)
+	}
+
+	if len(Conf().Quirks) == 0 {
+		t.Errorf("quirks not loaded from %s", quirks)
+	}
+
+	// Configuration file is used, if not overridden
+	PathOverride(PathParams{ConfFile: conf}, PathParams{})
+	PathSetFromConf()
+
+	if PathProgState != "/conf/state" || PathLogDir != "/conf/log" {
+		t.Errorf("paths from config: %s %s", PathProgState, PathLogDir)
+	}
+
+	// Explicitly specified configuration file must exist
+	PathOverride(PathParams{ConfFile: filepath.Join(dir, "missed")},
+		PathParams{})
+	_, err = ConfReload()
+	if err == nil {
+		t.Errorf("ConfReload: missed file: error expected")
+	}
+
+	// Paths in configuration file must be absolute
+	ioutil.WriteFile(conf, []byte("[paths]\nstate-dir = state\n"), 0644)
+	PathOverride(PathParams{ConfFile: conf}, PathParams{})
+	_, err = ConfReload()
+	if err == nil {
+		t.Errorf("ConfReload: relative path: error expected")
+	}
+}
@@ -10,8 +10,11 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -25,9 +28,178 @@ const (
 	PnPTerm                      // Terminating signal received
 )
 
-// pnpRetryTime returns time of next retry of failed device initialization
-func pnpRetryTime() time.Time {
-	return time.Now().Add(DNSSdRetryInterval)
+// pnpResetChan receives addresses of devices that require reset
+var pnpResetChan = make(chan UsbAddr, 16)
+
+// PnPRequestReset asks PnP manager to close the device, reset
+// it and reinitialize from scratch
+func PnPRequestReset(addr UsbAddr) {
+	select {
+	case pnpResetChan <- addr:
+	default:
+	}
+}
+
+// pnpReprobeChan receives addresses of devices that require
+// re-probing
+var pnpReprobeChan = make(chan UsbAddr, 16)
+
+// PnPRequestReprobe asks PnP manager to close the device, if
+// it is running, and immediately reinitialize it. Unlike
+// PnPRequestReset, device is not reset, and devices that
+// failed to initialize are retried immediately
+func PnPRequestReprobe(addr UsbAddr) {
+	select {
+	case pnpReprobeChan <- addr:
+	default:
+	}
+}
+
+// PnPLogTarget selects a logger, affected by PnPSetLogLevels
+type PnPLogTarget int
+
+const (
+	PnPLogMain    PnPLogTarget = iota // The main log
+	PnPLogConsole                     // Console log
+	PnPLogDevice                      // Per-device logs
+)
+
+// pnpLogLevels is the PnPSetLogLevels request
+type pnpLogLevels struct {
+	target PnPLogTarget  // Affected logger
+	levels LogLevel      // New log levels
+	done   chan struct{} // Closed when request is applied
+}
+
+// pnpLogLevelsChan receives log levels change requests
+var pnpLogLevelsChan = make(chan pnpLogLevels, 16)
+
+// PnPSetLogLevels asks PnP manager to change log levels at
+// runtime and waits until change is applied. Changes remain
+// in effect until configuration is reloaded
+//
+// It fails, if PnP manager doesn't accept or doesn't apply
+// the request in time
+func PnPSetLogLevels(target PnPLogTarget, levels LogLevel) error {
+	req := pnpLogLevels{target, levels, make(chan struct{})}
+
+	select {
+	case pnpLogLevelsChan <- req:
+	default:
+		return errors.New("PnP manager is busy")
+	}
+
+	select {
+	case <-req.done:
+		return nil
+	case <-time.After(PnPRequestTimeout):
+		return errors.New("PnP manager is not responding")
+	}
+}
+
+// PnPErrClass classifies device initialization errors
+type PnPErrClass int
+
+const (
+	PnPErrOther       PnPErrClass = iota // Unclassified error
+	PnPErrBlacklisted                    // Device is blacklisted
+	PnPErrAccess                         // USB access denied or device busy
+	PnPErrTimeout                        // Initialization timed out
+	PnPErrProtocol                       // IPP/eSCL protocol failure
+)
+
+// String returns PnPErrClass name
+func (class PnPErrClass) String() string {
+	switch class {
+	case PnPErrOther:
+		return "other"
+	case PnPErrBlacklisted:
+		return "blacklisted"
+	case PnPErrAccess:
+		return "access"
+	case PnPErrTimeout:
+		return "timeout"
+	case PnPErrProtocol:
+		return "protocol"
+	}
+
+	return fmt.Sprintf("unknown (%d)", int(class))
+}
+
+// PnPClassifyError returns class of device initialization error
+func PnPClassifyError(err error) PnPErrClass {
+	switch err {
+	case ErrBlackListed:
+		return PnPErrBlacklisted
+	case ErrInitTimedOut, ErrUsbStalled:
+		return PnPErrTimeout
+	case ErrNoServices:
+		return PnPErrProtocol
+	}
+
+	if usberr, ok := err.(UsbError); ok {
+		switch usberr.Code {
+		case UsbEAccess, UsbEBusy:
+			return PnPErrAccess
+		case UsbETimeout:
+			return PnPErrTimeout
+		}
+	}
+
+	return PnPErrOther
+}
+
+// pnpRetryPolicy defines how failed initialization is retried
+type pnpRetryPolicy struct {
+	initial   time.Duration // Initial retry interval
+	max       time.Duration // Maximum retry interval
+	permanent bool          // Error is permanent, don't retry
+}
+
+// pnpRetryPolicies contains retry policies per PnPErrClass
+var pnpRetryPolicies = map[PnPErrClass]pnpRetryPolicy{
+	PnPErrOther:       {DNSSdRetryInterval, time.Minute, false},
+	PnPErrBlacklisted: {0, 0, true},
+	PnPErrAccess:      {5 * time.Second, 5 * time.Minute, false},
+	PnPErrTimeout:     {DNSSdRetryInterval, 2 * time.Minute, false},
+	PnPErrProtocol:    {5 * time.Second, DevInitRetryMaxInterval, false},
+}
+
+// pnpRetryInterval returns interval before next retry of failed
+// device initialization
+//
+// Interval grows exponentially with count of consecutive failed
+// attempts of the same class, up to the per-class maximum. If
+// error is permanent, ok is false
+func pnpRetryInterval(class PnPErrClass, attempts int) (
+	interval time.Duration, ok bool) {
+
+	policy, found := pnpRetryPolicies[class]
+	if !found {
+		policy = pnpRetryPolicies[PnPErrOther]
+	}
+
+	if policy.permanent {
+		return 0, false
+	}
+
+	interval = policy.initial
+	for i := 1; i < attempts && interval < policy.max; i++ {
+		interval *= 2
+	}
+
+	if interval > policy.max {
+		interval = policy.max
+	}
+
+	return interval, true
+}
+
+// pnpFailure tracks consecutive failures of device initialization
+type pnpFailure struct {
+	err      error       // The last error
+	class    PnPErrClass // Its class
+	attempts int         // Count of consecutive failures of this class
 }
 
 // pnpRetryExpired checks if device initialization retry time expired
@@ -35,6 +207,27 @@ func pnpRetryExpired(tm time.Time) bool {
 	return !time.Now().Before(tm)
 }
 
+// pnpInit represents device initialization in progress
+//
+// Initialization is performed asynchronously, in two steps: first,
+// USB transport is opened, then Device is created on a top of it.
+// Between these steps, PnP manager may reattach the transport to
+// the detached Device with the same identity
+type pnpInit struct {
+	desc    UsbDeviceDesc      // Device descriptor
+	ctx     context.Context    // Canceled to abort initialization
+	cancel  context.CancelFunc // Cancels ctx
+	started time.Time          // Initialization start time
+}
+
+// pnpInitResult reports result of initialization step
+type pnpInitResult struct {
+	init      *pnpInit      // Initialization that reports the result
+	transport *UsbTransport // Opened transport, first step only
+	dev       *Device       // Created Device, second step only
+	err       error         // Error, if any
+}
+
 // PnPStart start PnP manager
 //
 // If exitWhenIdle is true, PnP manager will exit, when there is no more
@@ -43,15 +236,293 @@ func PnPStart(exitWhenIdle bool) PnPExitReason {
 	devices := UsbAddrList{}
 	devByAddr := make(map[UsbAddr]*Device)
 	retryByAddr := make(map[UsbAddr]time.Time)
+	failByAddr := make(map[UsbAddr]*pnpFailure)
+	initByAddr := make(map[UsbAddr]*pnpInit)
+	initResults := make(chan pnpInitResult)
+	initRunning := 0
+	detached := make(map[*Device]time.Time)
 	sigChan := make(chan os.Signal, 1)
 	ticker := time.NewTicker(DNSSdRetryInterval / 4)
 	tickerRunning := true
+	reason := PnPTerm
+	sdReady := false
+	sdStatus := ""
+
+	// Send watchdog notifications from the PnP loop itself, so
+	// systemd will restart us, if the loop hangs
+	var watchdogChan <-chan time.Time
+	if interval := SdWatchdogInterval(); interval > 0 {
+		watchdog := time.NewTicker(interval / 2)
+		defer watchdog.Stop()
+		watchdogChan = watchdog.C
+	}
 
 	signal.Notify(sigChan,
 		os.Signal(syscall.SIGINT),
 		os.Signal(syscall.SIGTERM),
 		os.Signal(syscall.SIGHUP))
 
+	pnpStatusSetLogLevels()
+
+	// startInit starts device initialization
+	startInit := func(desc UsbDeviceDesc) {
+		ctx, cancel := context.WithCancel(context.Background())
+		init := &pnpInit{desc: desc, ctx: ctx, cancel: cancel,
+			started: time.Now()}
+		initByAddr[desc.UsbAddr] = init
+		initRunning++
+
+		pnpStatusUpdate(desc.UsbAddr, func(st *PnPDevStatus) {
+			st.State = PnPDevInitializing
+		})
+
+		go func() {
+			transport, err := NewUsbTransport(desc)
+			initResults <- pnpInitResult{init: init,
+				transport: transport, err: err}
+		}()
+	}
+
+	// continueInit performs the second step of initialization
+	continueInit := func(init *pnpInit, transport *UsbTransport) {
+		initRunning++
+
+		go func() {
+			dev, err := NewDeviceWithTransport(init.ctx, init.desc,
+				transport)
+			initResults <- pnpInitResult{init: init, dev: dev, err: err}
+		}()
+	}
+
+	// cancelInit cancels device initialization, if any. It is also
+	// used to forget initialization when it is completed
+	cancelInit := func(addr UsbAddr) {
+		if init := initByAddr[addr]; init != nil {
+			init.cancel()
+			delete(initByAddr, addr)
+		}
+	}
+
+	// failed handles failed device initialization and
+	// schedules retry, if appropriate
+	failed := func(addr UsbAddr, err error) {
+		class := PnPClassifyError(err)
+		metricsInitFailed(class)
+
+		fail := failByAddr[addr]
+		if fail == nil || fail.class != class {
+			fail = &pnpFailure{class: class}
+			failByAddr[addr] = fail
+		}
+
+		fail.err = err
+		fail.attempts++
+
+		interval, ok := pnpRetryInterval(class, fail.attempts)
+		var next time.Time
+
+		if ok {
+			next = time.Now().Add(interval)
+			retryByAddr[addr] = next
+			Log.Error('!', "PNP %s: %s (%s error), retry #%d in %s",
+				addr, err, class, fail.attempts, interval)
+		} else {
+			Log.Error('!', "PNP %s: %s (%s error), giving up",
+				addr, err, class)
+		}
+
+		pnpStatusError(addr, err.Error())
+		pnpStatusUpdate(addr, func(st *PnPDevStatus) {
+			st.State = PnPDevRetry
+			if !ok {
+				st.State = PnPDevFailed
+			}
+			st.Err = err.Error()
+			st.ErrClass = class
+			st.Attempts = fail.attempts
+			st.NextRetry = next
+		})
+	}
+
+	// ready handles successful device initialization
+	ready := func(addr UsbAddr, dev *Device, started time.Time) {
+		dev.UsbTransport.metrics.initDone(time.Since(started))
+		delete(failByAddr, addr)
+		pnpStatusUpdate(addr, func(st *PnPDevStatus) {
+			*st = PnPDevStatus{State: PnPDevReady}
+			st.setDevice(dev)
+		})
+	}
+
+	// handleInitResult handles initialization results
+	handleInitResult := func(res pnpInitResult) {
+		initRunning--
+		addr := res.init.desc.UsbAddr
+
+		// Drop results of canceled initialization
+		if initByAddr[addr] != res.init {
+			if res.transport != nil {
+				res.transport.Close(false)
+			}
+			if res.dev != nil {
+				res.dev.Close()
+			}
+			return
+		}
+
+		switch {
+		case res.err != nil:
+			cancelInit(addr)
+			failed(addr, res.err)
+
+		case res.transport != nil:
+			// Reattach detached Device with the same identity,
+			// if any, or create the new one
+			ident := res.transport.UsbDeviceInfo().Ident()
+			for dev := range detached {
+				if dev.State.Ident == ident {
+					cancelInit(addr)
+					Log.Info('+', "PNP %s: reattached (was %s)",
+						addr, dev.UsbAddr)
+					delete(detached, dev)
+					pnpStatusDelete(dev.UsbAddr)
+					dev.Attach(res.init.desc, res.transport)
+					devByAddr[addr] = dev
+					ready(addr, dev, res.init.started)
+					return
+				}
+			}
+
+			continueInit(res.init, res.transport)
+
+		default:
+			cancelInit(addr)
+			devByAddr[addr] = res.dev
+			ready(addr, res.dev, res.init.started)
+		}
+	}
+
+	// reload reloads configuration and applies it in place. Devices,
+	// affected by configuration changes, are closed and scheduled for
+	// immediate reinitialization, other devices continue to serve
+	reload := func() {
+		// Cancel initializations in progress and wait until
+		// completed, so they don't see configuration changing
+		// under their feet. They will be restarted from scratch
+		var restart []UsbAddr
+		for addr := range initByAddr {
+			cancelInit(addr)
+			restart = append(restart, addr)
+		}
+
+		for initRunning > 0 {
+			handleInitResult(<-initResults)
+		}
+
+		old, err := ConfReload()
+		if err != nil {
+			Log.Error('!', "PNP: configuration not reloaded: %s", err)
+		} else {
+			Log.Info(' ', "PNP: configuration reloaded")
+		}
+
+		conf := Conf()
+		if conf.StateDir != old.StateDir {
+			Log.Info(' ', "PNP: state-dir change will take effect after restart")
+		}
+
+		// Reopen log files in the new log directory. Devices,
+		// being initialized, will use it when restarted
+		if dir := PathLogDirFromConf(); conf.LogDir != old.LogDir &&
+			dir != PathLogDir {
+			err = os.MkdirAll(dir, 0755)
+			if err != nil {
+				Log.Error('!', "PNP: log-dir not changed: %s", err)
+			} else {
+				Log.Info(' ', "PNP: log-dir changed to %s", dir)
+				PathSetLogDir(dir)
+				Log.ToMainFile()
+				for _, dev := range devByAddr {
+					dev.ReopenLogs()
+				}
+				for dev := range detached {
+					dev.ReopenLogs()
+				}
+			}
+		}
+
+		LogConfigure()
+		pnpStatusSetLogLevels()
+
+		// These parameters affect all devices
+		all := conf.LoopbackOnly != old.LoopbackOnly ||
+			conf.IPV6Enable != old.IPV6Enable ||
+			strings.Join(conf.Interfaces, ",") !=
+				strings.Join(old.Interfaces, ",") ||
+			strings.Join(conf.ListenAddrs, ",") !=
+				strings.Join(old.ListenAddrs, ",") ||
+			conf.DNSSdEnable != old.DNSSdEnable ||
+			conf.TLSEnable != old.TLSEnable ||
+			conf.TLSCertFile != old.TLSCertFile ||
+			conf.TLSKeyFile != old.TLSKeyFile ||
+			!conf.ACL.Equal(old.ACL) ||
+			!conf.Auth.Equal(&old.Auth) ||
+			conf.UsbDetachIppOnly != old.UsbDetachIppOnly
+
+		// Update running devices
+		for addr, dev := range devByAddr {
+			dev.SetLogLevels(conf.LogDevice)
+
+			port := dev.State.HTTPPort
+			quirks := conf.Quirks.Get(dev.UsbTransport.UsbDeviceInfo())
+
+			var why string
+			switch {
+			case all:
+				why = "global settings changed"
+			case (port < conf.HTTPMinPort || port > conf.HTTPMaxPort) &&
+				!sdPortPassed(port):
+				why = "port out of range"
+			case !dev.UsbTransport.Quirks().Equal(quirks):
+				why = "quirks changed"
+			default:
+				continue
+			}
+
+			Log.Info('-', "PNP %s: %s, reinitializing", addr, why)
+			dev.Close()
+			delete(devByAddr, addr)
+			restart = append(restart, addr)
+		}
+
+		// Detached devices will be reinitialized when reattached;
+		// if settings changed for all devices, just close them
+		for dev := range detached {
+			if all {
+				dev.Close()
+				delete(detached, dev)
+				pnpStatusDelete(dev.UsbAddr)
+			} else {
+				dev.SetLogLevels(conf.LogDevice)
+			}
+		}
+
+		// Devices that failed to initialize deserve another chance
+		// with new configuration
+		for addr := range failByAddr {
+			delete(failByAddr, addr)
+			restart = append(restart, addr)
+		}
+
+		now := time.Now()
+		for _, addr := range restart {
+			retryByAddr[addr] = now
+			pnpStatusUpdate(addr, func(st *PnPDevStatus) {
+				*st = PnPDevStatus{State: PnPDevRetry, NextRetry: now}
+			})
+		}
+	}
+
 	// Serve PnP events until terminated
 loop:
 	for {
@@ -69,24 +540,39 @@ loop:
 			// Handle added devices
 			for _, addr := range added {
 				Log.Debug('+', "PNP %s: added", addr)
-				dev, err := NewDevice(dev_descs[addr])
-				if err == nil {
-					devByAddr[addr] = dev
-				} else {
-					Log.Error('!', "PNP %s: %s", addr, err)
-					retryByAddr[addr] = pnpRetryTime()
-				}
+				startInit(dev_descs[addr])
 			}
 
 			// Handle removed devices
 			for _, addr := range removed {
 				Log.Debug('-', "PNP %s: removed", addr)
 				delete(retryByAddr, addr)
+				delete(failByAddr, addr)
+				cancelInit(addr)
+				pnpStatusDelete(addr)
 
 				dev, ok := devByAddr[addr]
 				if ok {
-					dev.Close()
 					delete(devByAddr, addr)
+
+					// If grace period is configured, keep the
+					// Device for a while, so it can be reattached
+					// if USB device reappears
+					grace := Conf().UsbHotplugGrace
+					if grace > 0 {
+						Log.Debug('-', "PNP %s: detached, "+
+							"waiting %s for reattach",
+							addr, grace)
+						dev.Detach()
+						detached[dev] = time.Now().Add(grace)
+						pnpStatusUpdate(addr, func(st *PnPDevStatus) {
+							st.State = PnPDevDetached
+							st.ConnState = ""
+							st.transport = nil
+						})
+					} else {
+						dev.Close()
+					}
 				}
 			}
 
@@ -97,29 +583,54 @@ loop:
 				}
 
 				Log.Debug('+', "PNP %s: retry", addr)
-				dev, err := NewDevice(dev_descs[addr])
-				if err == nil {
-					devByAddr[addr] = dev
-					delete(retryByAddr, addr)
-				} else {
-					Log.Error('!', "PNP %s: %s", addr, err)
-					retryByAddr[addr] = pnpRetryTime()
+				delete(retryByAddr, addr)
+				if failByAddr[addr] != nil {
+					metricsInitRetry()
 				}
+				startInit(dev_descs[addr])
+			}
+		}
+
+		// Close detached devices, not reattached in time
+		for dev, tm := range detached {
+			if !time.Now().Before(tm) {
+				Log.Debug('-', "PNP %s: not reattached, closing",
+					dev.UsbAddr)
+				dev.Close()
+				delete(detached, dev)
+				pnpStatusDelete(dev.UsbAddr)
+			}
+		}
+
+		// Notify systemd. We are ready, when devices, found
+		// by the first scan, completed initialization
+		status := pnpSdStatus()
+		if status != sdStatus || (!sdReady && initRunning == 0) {
+			notify := "STATUS=" + status
+			if !sdReady && initRunning == 0 {
+				notify = "READY=1\n" + notify
+				sdReady = true
+			}
+
+			sdStatus = status
+			if err := SdNotify(notify); err != nil {
+				Log.Error('!', "PNP: %s", err)
 			}
 		}
 
 		// Handle exit when idle
-		if exitWhenIdle && len(devices) == 0 {
+		if exitWhenIdle && len(devices) == 0 && len(detached) == 0 {
 			Log.Info(' ', "No IPP-over-USB devices present, exiting")
-			return PnPIdle
+			reason = PnPIdle
+			break loop
 		}
 
 		// Update ticker
 		switch {
-		case tickerRunning && len(retryByAddr) == 0:
+		case tickerRunning && len(retryByAddr) == 0 && len(detached) == 0:
 			ticker.Stop()
 			tickerRunning = false
-		case !tickerRunning && len(retryByAddr) != 0:
+		case !tickerRunning && (len(retryByAddr) != 0 || len(detached) != 0):
 			ticker = time.NewTicker(DNSSdRetryInterval / 4)
 			tickerRunning = true
 		}
@@ -127,12 +638,92 @@ loop:
 		select {
 		case <-UsbHotPlugChan:
 		case <-ticker.C:
+		case <-watchdogChan:
+			if err := SdNotify("WATCHDOG=1"); err != nil {
+				Log.Error('!', "PNP: %s", err)
+			}
+		case res := <-initResults:
+			handleInitResult(res)
+		case addr := <-pnpResetChan:
+			dev, ok := devByAddr[addr]
+			if ok {
+				Log.Info('-', "PNP %s: reset", addr)
+				dev.Close()
+				delete(devByAddr, addr)
+				retryByAddr[addr] = time.Now().Add(DNSSdRetryInterval)
+				pnpStatusUpdate(addr, func(st *PnPDevStatus) {
+					*st = PnPDevStatus{State: PnPDevRetry,
+						NextRetry: retryByAddr[addr]}
+				})
+			}
+		case addr := <-pnpReprobeChan:
+			if devices.Find(addr) < 0 || initByAddr[addr] != nil {
+				break
+			}
+
+			Log.Info('-', "PNP %s: re-probe", addr)
+			if dev, ok := devByAddr[addr]; ok {
+				dev.Close()
+				delete(devByAddr, addr)
+			}
+
+			delete(failByAddr, addr)
+			retryByAddr[addr] = time.Now()
+			pnpStatusUpdate(addr, func(st *PnPDevStatus) {
+				*st = PnPDevStatus{State: PnPDevRetry,
+					NextRetry: retryByAddr[addr]}
+			})
+		case req := <-pnpLogLevelsChan:
+			conf := *Conf()
+			switch req.target {
+			case PnPLogMain:
+				conf.LogMain = req.levels
+			case PnPLogConsole:
+				conf.LogConsole = req.levels
+			case PnPLogDevice:
+				conf.LogDevice = req.levels
+			}
+
+			confSet(conf)
+			LogConfigure()
+			pnpStatusSetLogLevels()
+
+			for _, dev := range devByAddr {
+				dev.SetLogLevels(conf.LogDevice)
+			}
+			for dev := range detached {
+				dev.SetLogLevels(conf.LogDevice)
+			}
+
+			close(req.done)
 		case sig := <-sigChan:
+			if sig == syscall.SIGHUP {
+				Log.Info(' ', "%s signal received, reloading", sig)
+				reload()
+				break
+			}
+
 			Log.Info(' ', "%s signal received, exiting", sig)
+			SdNotify("STOPPING=1")
 			break loop
 		}
 	}
 
+	if tickerRunning {
+		ticker.Stop()
+	}
+
+	signal.Stop(sigChan)
+
+	// Cancel initializations in progress and wait until completed
+	for addr := range initByAddr {
+		cancelInit(addr)
+	}
+
+	for initRunning > 0 {
+		handleInitResult(<-initResults)
+	}
+
 	// Close remaining devices
 	ctx, cancel := context.WithTimeout(context.Background(),
 		DevShutdownTimeout)
@@ -140,7 +731,15 @@ loop:
 
 	var done sync.WaitGroup
 
+	devs := make([]*Device, 0, len(devByAddr)+len(detached))
 	for _, dev := range devByAddr {
+		devs = append(devs, dev)
+	}
+	for dev := range detached {
+		devs = append(devs, dev)
+	}
+
+	for _, dev := range devs {
 		done.Add(1)
 		go func(dev *Device) {
 			dev.Shutdown(ctx)
@@ -150,5 +749,28 @@ loop:
 	}
 
 	done.Wait()
-	return PnPTerm
+	pnpStatusReset()
+
+	return reason
+}
+
+// pnpSdStatus returns summary of devices status, for systemd
+func pnpSdStatus() string {
+	status := PnPStatus()
+
+	ready := 0
+	for _, st := range status {
+		if st.State == PnPDevReady {
+			ready++
+		}
+	}
+
+	s := fmt.Sprintf("%d of %d device(s) ready", ready, len(status))
+	for _, st := range status {
+		if st.State != PnPDevReady {
+			s += fmt.Sprintf("; %s: %s", st.UsbAddr, st.State)
+		}
+	}
+
+	return s
 }
@@ -0,0 +1,75 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * PnP manager tests
+ */
+
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// Test classification of device initialization errors
+func TestPnPClassifyError(t *testing.T) {
+	tests := []struct {
+		err   error
+		class PnPErrClass
+	}{
+		{ErrBlackListed, PnPErrBlacklisted},
+		{ErrInitTimedOut, PnPErrTimeout},
+		{ErrUsbStalled, PnPErrTimeout},
+		{ErrNoServices, PnPErrProtocol},
+		{UsbError{"libusb_open", UsbEAccess}, PnPErrAccess},
+		{UsbError{"libusb_claim_interface", UsbEBusy}, PnPErrAccess},
+		{UsbError{"libusb_bulk_transfer", UsbETimeout}, PnPErrTimeout},
+		{UsbError{"libusb_bulk_transfer", UsbEPipe}, PnPErrOther},
+		{errors.New("some error"), PnPErrOther},
+	}
+
+	for _, test := range tests {
+		class := PnPClassifyError(test.err)
+		if class != test.class {
+			t.Errorf("%q: expected %s, got %s", test.err, test.class, class)
+		}
+	}
+}
+
+// Test exponential backoff of initialization retries
+func TestPnPRetryInterval(t *testing.T) {
+	// Permanent error
+	if _, ok := pnpRetryInterval(PnPErrBlacklisted, 1); ok {
+		t.Errorf("%s: retry not expected", PnPErrBlacklisted)
+	}
+
+	// Transient errors
+	for class, policy := range pnpRetryPolicies {
+		if policy.permanent {
+			continue
+		}
+
+		prev := time.Duration(0)
+		for attempts := 1; attempts < 64; attempts++ {
+			interval, ok := pnpRetryInterval(class, attempts)
+			switch {
+			case !ok:
+				t.Fatalf("%s #%d: retry expected", class, attempts)
+			case attempts == 1 && interval != policy.initial:
+				t.Fatalf("%s #%d: expected %s, got %s",
+					class, attempts, policy.initial, interval)
+			case interval < prev || interval > policy.max:
+				t.Fatalf("%s #%d: %s out of range", class, attempts,
+					interval)
+			}
+			prev = interval
+		}
+
+		if prev != policy.max {
+			t.Fatalf("%s: max interval %s not reached", class, policy.max)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Per-device status, as seen by PnP manager
+ */
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// PnPDevState represents device state, as seen by PnP manager
+type PnPDevState int
+
+const (
+	PnPDevInitializing PnPDevState = iota // Initialization in progress
+	PnPDevReady                           // Device is being served
+	PnPDevRetry                           // Init failed, retry scheduled
+	PnPDevFailed                          // Init failed permanently
+	PnPDevDetached                        // Removed, waiting for reattach
+)
+
+// String returns PnPDevState name
+func (state PnPDevState) String() string {
+	switch state {
+	case PnPDevInitializing:
+		return "initializing"
+	case PnPDevReady:
+		return "ready"
+	case PnPDevRetry:
+		return "retry"
+	case PnPDevFailed:
+		return "failed"
+	case PnPDevDetached:
+		return "detached"
+	}
+
+	return fmt.Sprintf("unknown (%d)", int(state))
+}
+
+// PnPMaxRecentErrors is the maximum count of recent errors,
+// kept per device
+const PnPMaxRecentErrors = 8
+
+// PnPDevStatus represents device status, as seen by PnP manager
+//
+// Device parameters (Ident, HTTPPort etc) are available only
+// when device is ready
+type PnPDevStatus struct {
+	UsbAddr   UsbAddr       // Device address
+	State     PnPDevState   // Device state
+	Err       string        // The last initialization error, if any
+	ErrClass  PnPErrClass   // Class of the last error
+	Attempts  int           // Count of consecutive failures
+	NextRetry time.Time     // Time of next retry, if scheduled
+	Ident     string        // Device identity
+	Model     string        // Device model
+	HTTPPort  int           // HTTP port
+	DNSSdName string        // DNS-SD service instance name
+	Services  DNSSdServices // Advertised DNS-SD services
+	Quirks    []string      // Applied quirks sections
+	ConnState string        // USB connections state
+	Errors    []PnPDevError // Recent errors, oldest first
+	transport *UsbTransport // Device's transport, for ConnState
+}
+
+// PnPDevError represents an error, happened with device
+type PnPDevError struct {
+	Time time.Time // When error happened
+	Err  string    // Error message
+}
+
+// setDevice fills device parameters from the Device
+func (st *PnPDevStatus) setDevice(dev *Device) {
+	st.Ident = dev.State.Ident
+	st.Model = dev.UsbTransport.UsbDeviceInfo().MfgAndProduct
+	st.HTTPPort = dev.State.HTTPPort
+	st.Services = dev.DNSSdServices
+	st.DNSSdName = dev.State.DNSSdOverride
+	st.transport = dev.UsbTransport
+
+	st.Quirks = nil
+	for _, q := range dev.UsbTransport.Quirks() {
+		st.Quirks = append(st.Quirks,
+			fmt.Sprintf("[%s] (%s)", q.Model, q.Origin))
+	}
+}
+
+// PnPLogLevels represents log levels, currently in effect
+type PnPLogLevels struct {
+	Main    LogLevel // The main log
+	Console LogLevel // Console log
+	Device  LogLevel // Per-device logs
+}
+
+// pnpStatus contains status of all devices, known to PnP manager
+var pnpStatus = struct {
+	sync.Mutex
+	devs      map[UsbAddr]*PnPDevStatus
+	errors    map[UsbAddr][]PnPDevError
+	logLevels PnPLogLevels
+}{
+	devs:   make(map[UsbAddr]*PnPDevStatus),
+	errors: make(map[UsbAddr][]PnPDevError),
+}
+
+// PnPCurrentLogLevels returns log levels, currently in effect,
+// as seen by PnP manager
+func PnPCurrentLogLevels() PnPLogLevels {
+	pnpStatus.Lock()
+	defer pnpStatus.Unlock()
+	return pnpStatus.logLevels
+}
+
+// pnpStatusSetLogLevels saves log levels, currently in effect
+func pnpStatusSetLogLevels() {
+	pnpStatus.Lock()
+	pnpStatus.logLevels = PnPLogLevels{
+		Main:    Log.Levels(),
+		Console: Console.Levels(),
+		Device:  Conf().LogDevice,
+	}
+	pnpStatus.Unlock()
+}
+
+// PnPStatus returns status of all devices, known to PnP
+// manager, sorted by USB address
+func PnPStatus() []PnPDevStatus {
+	pnpStatus.Lock()
+	defer pnpStatus.Unlock()
+
+	list := make([]PnPDevStatus, 0, len(pnpStatus.devs))
+	for _, st := range pnpStatus.devs {
+		if st.transport != nil {
+			st.ConnState = st.transport.connstate.String()
+		}
+		st.Errors = pnpStatus.errors[st.UsbAddr]
+		list = append(list, *st)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].UsbAddr.Less(list[j].UsbAddr)
+	})
+
+	return list
+}
+
+// pnpStatusTransport returns transport of the ready device
+func pnpStatusTransport(addr UsbAddr) *UsbTransport {
+	pnpStatus.Lock()
+	defer pnpStatus.Unlock()
+
+	if st := pnpStatus.devs[addr]; st != nil {
+		return st.transport
+	}
+
+	return nil
+}
+
+// pnpStatusUpdate updates device status, using provided callback
+func pnpStatusUpdate(addr UsbAddr, update func(st *PnPDevStatus)) {
+	pnpStatus.Lock()
+	defer pnpStatus.Unlock()
+
+	st := pnpStatus.devs[addr]
+	if st == nil {
+		st = &PnPDevStatus{}
+		pnpStatus.devs[addr] = st
+	}
+
+	update(st)
+	st.UsbAddr = addr
+}
+
+// pnpStatusError adds error to the list of recent errors of
+// the device. Errors are kept until device is removed
+func pnpStatusError(addr UsbAddr, err string) {
+	pnpStatus.Lock()
+	defer pnpStatus.Unlock()
+
+	if pnpStatus.devs[addr] == nil {
+		return
+	}
+
+	// Note, old slice is not modified, as it may be shared
+	// with the list, returned by PnPStatus
+	errs := pnpStatus.errors[addr]
+	if len(errs) >= PnPMaxRecentErrors {
+		errs = errs[len(errs)-PnPMaxRecentErrors+1:]
+	}
+
+	pnpStatus.errors[addr] = append(append([]PnPDevError(nil), errs...),
+		PnPDevError{Time: time.Now(), Err: err})
+}
+
+// pnpStatusDelete deletes device status
+func pnpStatusDelete(addr UsbAddr) {
+	pnpStatus.Lock()
+	delete(pnpStatus.devs, addr)
+	delete(pnpStatus.errors, addr)
+	pnpStatus.Unlock()
+}
+
+// pnpStatusReset deletes status of all devices
+func pnpStatusReset() {
+	pnpStatus.Lock()
+	pnpStatus.devs = make(map[UsbAddr]*PnPDevStatus)
+	pnpStatus.errors = make(map[UsbAddr][]PnPDevError)
+	pnpStatus.Unlock()
+}
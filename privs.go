@@ -0,0 +1,239 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Dropping root privileges
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+)
+
+// #include <grp.h>
+// #include <unistd.h>
+import "C"
+
+// privsCreds represents credentials, privileges are dropped to
+type privsCreds struct {
+	uid, gid int   // User and group IDs
+	groups   []int // Supplementary groups
+}
+
+// DropPrivileges switches the process to the specified user and
+// group. If group is empty, the user's primary group is used.
+// User's supplementary groups are retained, so membership in
+// the group, that owns USB device nodes (usually "lp"), allows
+// to open hot-plugged devices
+//
+// Program directories, written at runtime (per-device state and
+// logs), files ipp-usb creates there, and the control socket are
+// chowned to the user before privileges are dropped. Files and
+// sockets, already opened, remain accessible
+//
+// Files, read at runtime, must be readable by the user. This is
+// checked after privileges are dropped, so misconfiguration is
+// detected at startup, not on configuration reload
+func DropPrivileges(username, group string) error {
+	creds, err := privsLookup(username, group)
+	if err != nil {
+		return err
+	}
+
+	// Give away directories, written at runtime, and files
+	// created there by ipp-usb
+	dirs := []struct {
+		path  string
+		files []string
+	}{
+		{PathProgStateDev, []string{"*.state", "*.pem"}},
+		{PathLogDir, []string{"*.log", "*.log.*.gz"}},
+	}
+
+	for _, dir := range dirs {
+		err = privsChown(dir.path, dir.files, creds)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Give away the control socket, keeping its group, so the
+	// daemon still owns it. Note, the socket directory remains
+	// root-owned, so socket is not unlinked on exit; the stale
+	// socket is removed at the next start
+	err = os.Chown(PathCtrlSocket, creds.uid, -1)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// Switch credentials. Note, glibc applies setuid() and friends
+	// to all threads of the process, while raw system calls (and
+	// syscall.Setuid on Linux) affect only the calling thread
+	gids := make([]C.gid_t, len(creds.groups))
+	for i, gid := range creds.groups {
+		gids[i] = C.gid_t(gid)
+	}
+
+	var pgids *C.gid_t
+	if len(gids) > 0 {
+		pgids = &gids[0]
+	}
+
+	if rc, err := C.setgroups(C.size_t(len(gids)), pgids); rc != 0 {
+		return fmt.Errorf("setgroups(): %s", err)
+	}
+
+	if rc, err := C.setgid(C.gid_t(creds.gid)); rc != 0 {
+		return fmt.Errorf("setgid(%d): %s", creds.gid, err)
+	}
+
+	if rc, err := C.setuid(C.uid_t(creds.uid)); rc != 0 {
+		return fmt.Errorf("setuid(%d): %s", creds.uid, err)
+	}
+
+	// Make sure privileges cannot be regained
+	if creds.uid != 0 && C.setuid(0) == 0 {
+		return fmt.Errorf("privileges not dropped: can regain root")
+	}
+
+	Log.Info(' ', "Privileges dropped to user %s (uid=%d gid=%d)",
+		username, creds.uid, creds.gid)
+
+	// Configuration files are read again on reload, and TLS
+	// key pair on device initialization, so they must remain
+	// readable
+	err = privsCheckFiles()
+	if err != nil {
+		return fmt.Errorf("user %q: %s", username, err)
+	}
+
+	return nil
+}
+
+// privsCheckFiles checks that files, read at runtime (configuration,
+// quirks, password file and TLS key pair), are readable with the
+// current privileges
+func privsCheckFiles() error {
+	conf := confDefault
+	err := confLoad(&conf)
+	if err != nil {
+		return err
+	}
+
+	if conf.TLSCertFile != "" {
+		_, err = tls.LoadX509KeyPair(conf.TLSCertFile, conf.TLSKeyFile)
+		if err != nil {
+			return fmt.Errorf("tls: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// privsLookup looks up credentials by user and group name.
+// Numeric IDs are accepted as well
+func privsLookup(username, group string) (privsCreds, error) {
+	var creds privsCreds
+
+	u, err := user.Lookup(username)
+	if err != nil {
+		if _, err2 := strconv.Atoi(username); err2 == nil {
+			u, err = user.LookupId(username)
+		}
+	}
+
+	if err != nil {
+		return creds, fmt.Errorf("user %q: %s", username, err)
+	}
+
+	creds.uid, _ = strconv.Atoi(u.Uid)
+	creds.gid, _ = strconv.Atoi(u.Gid)
+
+	if group != "" {
+		creds.gid, err = privsLookupGroup(group)
+		if err != nil {
+			return creds, err
+		}
+	}
+
+	ids, err := u.GroupIds()
+	if err != nil {
+		return creds, fmt.Errorf("user %q: %s", username, err)
+	}
+
+	creds.groups = []int{creds.gid}
+	for _, id := range ids {
+		gid, _ := strconv.Atoi(id)
+		if gid != creds.gid {
+			creds.groups = append(creds.groups, gid)
+		}
+	}
+
+	return creds, nil
+}
+
+// privsLookupGroup looks up group ID by group name.
+// Numeric ID is accepted as well
+func privsLookupGroup(group string) (int, error) {
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		if _, err2 := strconv.Atoi(group); err2 == nil {
+			g, err = user.LookupGroupId(group)
+		}
+	}
+
+	if err != nil {
+		return 0, fmt.Errorf("group %q: %s", group, err)
+	}
+
+	gid, _ := strconv.Atoi(g.Gid)
+	return gid, nil
+}
+
+// privsChown creates directory, if it doesn't exist, and changes
+// owner of the directory and of regular files in it, that match
+// any of patterns. Subdirectories and other files are not affected,
+// as directory may be shared with something else
+func privsChown(dir string, patterns []string, creds privsCreds) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	err = os.Lchown(dir, creds.uid, creds.gid)
+	if err != nil {
+		return err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if !file.Mode().IsRegular() {
+			continue
+		}
+
+		for _, pattern := range patterns {
+			if ok, _ := filepath.Match(pattern, file.Name()); ok {
+				err = os.Lchown(filepath.Join(dir, file.Name()),
+					creds.uid, creds.gid)
+				if err != nil {
+					return err
+				}
+				break
+			}
+		}
+	}
+
+	return nil
+}
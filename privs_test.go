@@ -0,0 +1,160 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Dropping root privileges test
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// Test lookup of user and group credentials
+func TestPrivsLookup(t *testing.T) {
+	u, err := user.Current()
+	if err != nil {
+		t.Skipf("user.Current: %s", err)
+	}
+
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(u.Gid)
+
+	// Lookup by name and by numeric ID must give the same result
+	for _, name := range []string{u.Username, u.Uid} {
+		creds, err := privsLookup(name, "")
+		if err != nil {
+			t.Fatalf("privsLookup(%q): %s", name, err)
+		}
+
+		if creds.uid != uid || creds.gid != gid {
+			t.Fatalf("privsLookup(%q): uid=%d gid=%d, expected %d %d",
+				name, creds.uid, creds.gid, uid, gid)
+		}
+
+		if len(creds.groups) == 0 || creds.groups[0] != gid {
+			t.Fatalf("privsLookup(%q): groups=%v", name, creds.groups)
+		}
+	}
+
+	// Explicitly specified group
+	creds, err := privsLookup(u.Username, u.Gid)
+	if err != nil || creds.gid != gid {
+		t.Fatalf("privsLookup(%q, %q): %+v %v", u.Username, u.Gid,
+			creds, err)
+	}
+
+	// Errors
+	_, err = privsLookup("ipp-usb-no-such-user", "")
+	if err == nil {
+		t.Fatalf("privsLookup: unknown user: error expected")
+	}
+
+	_, err = privsLookup(u.Username, "ipp-usb-no-such-group")
+	if err == nil {
+		t.Fatalf("privsLookup: unknown group: error expected")
+	}
+}
+
+// Test changing owner of program directories
+func TestPrivsChown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipp-usb-test")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	creds := privsCreds{uid: os.Getuid(), gid: os.Getgid()}
+	if os.Geteuid() == 0 {
+		creds = privsCreds{uid: 65534, gid: 65534}
+	}
+
+	sub := filepath.Join(dir, "log")
+	patterns := []string{"*.log", "*.log.*.gz"}
+
+	err = privsChown(sub, patterns, creds)
+	if err != nil {
+		t.Fatalf("privsChown: %s", err)
+	}
+
+	os.Mkdir(filepath.Join(sub, "other"), 0755)
+	for _, name := range []string{"main.log", "main.log.0.gz",
+		"other.txt", "other/nested.log"} {
+		ioutil.WriteFile(filepath.Join(sub, name), nil, 0644)
+	}
+
+	err = privsChown(sub, patterns, creds)
+	if err != nil {
+		t.Fatalf("privsChown: %s", err)
+	}
+
+	if os.Geteuid() != 0 {
+		return
+	}
+
+	// Only the directory and matching files must be chowned
+	owned := map[string]bool{
+		"":                 true,
+		"main.log":         true,
+		"main.log.0.gz":    true,
+		"other":            false,
+		"other.txt":        false,
+		"other/nested.log": false,
+	}
+
+	for name, expected := range owned {
+		fi, err := os.Lstat(filepath.Join(sub, name))
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+
+		uid := int(fi.Sys().(*syscall.Stat_t).Uid)
+		if (uid == creds.uid) != expected {
+			t.Errorf("%q: owner %d, chowned expected %v",
+				name, uid, expected)
+		}
+	}
+}
+
+// Test checking of files, read at runtime
+func TestPrivsCheckFiles(t *testing.T) {
+	_, _, cleanup := usbSimTestSetup(t)
+	defer cleanup()
+
+	defer confTestSet(func(*Configuration) {})()
+	defer PathOverride(PathParams{}, PathParams{})
+
+	path := filepath.Join(PathProgState, "test.conf")
+	PathOverride(PathParams{ConfFile: path}, PathParams{})
+
+	err := ioutil.WriteFile(path, []byte("[network]\n"), 0644)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if err = privsCheckFiles(); err != nil {
+		t.Fatalf("privsCheckFiles: %s", err)
+	}
+
+	err = ioutil.WriteFile(path, []byte("[network]\n"+
+		"tls-cert-file = "+filepath.Join(PathProgState, "cert.pem")+"\n"+
+		"tls-key-file = "+filepath.Join(PathProgState, "key.pem")+"\n"),
+		0644)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	err = privsCheckFiles()
+	if err == nil || !strings.HasPrefix(err.Error(), "tls:") {
+		t.Fatalf("privsCheckFiles: missed TLS key pair: %v", err)
+	}
+}
@@ -15,19 +15,40 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"reflect"
 	"sort"
 	"strings"
+	"time"
 )
 
 // Quirks represents device-specific quirks
 type Quirks struct {
-	Origin      string            // file:line of definition
-	Model       string            // Device model name
-	Blacklist   bool              // Blacklist the device
-	HttpHeaders map[string]string // HTTP header override
-	Index       int               // Incremented in order of loading
+	Origin           string            // file:line of definition
+	Model            string            // Device model name
+	UsbID            string            // USB VID:PID pattern, if any
+	UsbManufacturer  string            // USB manufacturer pattern, if any
+	UsbSerial        string            // USB serial number pattern, if any
+	Match            string            // Why matched, set by Match/Get
+	Blacklist        bool              // Blacklist the device
+	HttpHeaders      map[string]string // HTTP header override
+	UsbTransferSize  int               // Size of USB bulk transfer
+	UsbQueueDepth    int               // Count of queued USB transfers
+	UsbStallTimeout  time.Duration     // USB I/O stall timeout
+	UsbSoftReset     bool              // Soft-reset interfaces on open
+	UsbInitDelay     time.Duration     // Delay after configuration
+	UsbMaxInterfaces int               // Max interfaces to use, 0 - all
+	UsbResetOnOpen   bool              // Reset device on open
+	UsbDetachIppOnly bool              // Detach driver from IPP interfaces only
+	InitTimeout      time.Duration     // Device initialization timeout
+	ACL              ACL               // Client access control list
+	Params           map[string]string // Other defined parameters, raw
+	Index            int               // Incremented in order of loading
 }
 
+// QuirksList represents list of Quirks, applicable to the
+// particular device, in priority order
+type QuirksList []Quirks
+
 // QuirksSet represents collection of quirks, indexed by model name
 type QuirksSet []*Quirks
 
@@ -93,6 +114,7 @@ func (qset *QuirksSet) readFile(file string) error {
 				Origin:      fmt.Sprintf("%s:%d", rec.File, rec.Line),
 				Model:       rec.Section,
 				HttpHeaders: make(map[string]string),
+				Params:      make(map[string]string),
 				Index:       len(*qset),
 			}
 			*qset = append(*qset, q)
@@ -115,6 +137,82 @@ func (qset *QuirksSet) readFile(file string) error {
 		case "blacklist":
 			err = confLoadBinaryKey(&q.Blacklist, rec,
 				"false", "true")
+			continue
+
+		case "usb-id":
+			err = quirksLoadUsbIDKey(&q.UsbID, rec)
+			continue
+
+		case "usb-manufacturer":
+			q.UsbManufacturer = rec.Value
+			continue
+
+		case "usb-serial":
+			q.UsbSerial = rec.Value
+			continue
+
+		case "usb-transfer-size":
+			var sz int64
+			err = confLoadSizeKey(&sz, rec)
+			if err == nil && (sz < 512 || sz > 1024*1024 || sz%512 != 0) {
+				err = confBadValue(rec,
+					"must be multiple of 512 in range 512...1M")
+			}
+			q.UsbTransferSize = int(sz)
+
+		case "usb-queue-depth":
+			var depth uint
+			err = confLoadUintKey(&depth, rec)
+			if err == nil && (depth < 1 || depth > 64) {
+				err = confBadValue(rec, "must be in range 1...64")
+			}
+			q.UsbQueueDepth = int(depth)
+
+		case "usb-stall-timeout":
+			err = confLoadDurationKey(&q.UsbStallTimeout, rec)
+
+		case "usb-soft-reset":
+			err = confLoadBinaryKey(&q.UsbSoftReset, rec,
+				"false", "true")
+
+		case "usb-init-delay":
+			err = confLoadDurationKey(&q.UsbInitDelay, rec)
+
+		case "usb-max-interfaces":
+			var max uint
+			err = confLoadUintKey(&max, rec)
+			q.UsbMaxInterfaces = int(max)
+
+		case "usb-reset-on-open":
+			err = confLoadBinaryKey(&q.UsbResetOnOpen, rec,
+				"false", "true")
+
+		case "usb-detach-kernel-driver":
+			err = confLoadBinaryKey(&q.UsbDetachIppOnly, rec,
+				"all", "ipp-only")
+
+		case "init-timeout":
+			err = confLoadDurationKey(&q.InitTimeout, rec)
+			if err == nil && q.InitTimeout == 0 {
+				err = confBadValue(rec, "must not be zero")
+			}
+
+		// ACL keys may be repeated, as in the [access]
+		// section of ipp-usb.conf; rules are accumulated
+		case "allow":
+			err = confLoadACLKey(&q.ACL.Allow, rec)
+			rec.Value = q.ACL.Allow.String()
+
+		case "deny":
+			err = confLoadACLKey(&q.ACL.Deny, rec)
+			rec.Value = q.ACL.Deny.String()
+
+		default:
+			continue
+		}
+
+		if err == nil {
+			q.Params[rec.Key] = rec.Value
 		}
 	}
 
@@ -125,44 +223,126 @@ func (qset *QuirksSet) readFile(file string) error {
 	return err
 }
 
-// Get quirks by model name
+// quirksLoadUsbIDKey loads usb-id key. Its value must be in
+// the VID:PID form, where both VID and PID are either 4 hex
+// digits (? wildcards allowed) or *
+func quirksLoadUsbIDKey(out *string, rec *IniRecord) error {
+	id := strings.ToLower(rec.Value)
+	parts := strings.Split(id, ":")
+
+	ok := len(parts) == 2
+	for _, part := range parts {
+		if part == "*" {
+			continue
+		}
+
+		ok = ok && len(part) == 4
+		for _, c := range part {
+			ok = ok && strings.ContainsRune("0123456789abcdef?", c)
+		}
+	}
+
+	if !ok {
+		return confBadValue(rec, "%q: must be VID:PID (i.e., 03f0:*)",
+			rec.Value)
+	}
+
+	*out = id
+	return nil
+}
+
+// match matches Quirks against the device
 //
-// In a case of multiple match, quirks are returned in
-// the from most prioritized to least prioritized order
+// Model name, VID:PID, manufacturer and serial number are
+// matched against the corresponding patterns, if pattern
+// is specified. All specified patterns must match
 //
-// Duplicates are removed: if some parameter is set by
-// more prioritized entry, it is removed from the less
-// prioritized entries. Entries, that in result become
-// empty, are removed at all
-func (qset QuirksSet) Get(model string) []Quirks {
+// It returns the match priority, which is the total count
+// of matched non-wildcard characters, and human-readable
+// explanation of match. If Quirks doesn't match, priority
+// is -1
+func (q *Quirks) match(info UsbDeviceInfo) (int, string) {
+	criteria := []struct{ name, value, pattern string }{
+		{"model", info.MfgAndProduct, q.Model},
+		{"usb-id", fmt.Sprintf("%4.4x:%4.4x", info.Vendor, info.Product),
+			q.UsbID},
+		{"usb-manufacturer", info.Manufacturer, q.UsbManufacturer},
+		{"usb-serial", info.SerialNumber, q.UsbSerial},
+	}
+
+	priority := 0
+	reasons := []string{}
+
+	for _, c := range criteria {
+		if c.pattern == "" {
+			continue
+		}
+
+		matchlen := GlobMatch(c.value, c.pattern)
+		if matchlen < 0 {
+			return -1, ""
+		}
+
+		priority += matchlen
+		reasons = append(reasons,
+			fmt.Sprintf("%s %q matches %q", c.name, c.value, c.pattern))
+	}
+
+	return priority, strings.Join(reasons, ", ")
+}
+
+// Match returns all quirks, matching the device, without
+// duplicates removal
+//
+// Quirks are returned in the from most prioritized to least
+// prioritized order. Each returned entry has its Match field
+// set, explaining why it was matched
+func (qset QuirksSet) Match(info UsbDeviceInfo) QuirksList {
 	type item struct {
 		q        *Quirks
-		matchlen int
+		priority int
+		match    string
 	}
 	var list []item
 
 	// Get list of matching quirks
 	for _, q := range qset {
-		matchlen := GlobMatch(model, q.Model)
-		if matchlen >= 0 {
-			list = append(list, item{q, matchlen})
+		priority, match := q.match(info)
+		if priority >= 0 {
+			list = append(list, item{q, priority, match})
 		}
 	}
 
-	// Sort the list by matchlen, in decreasing order
+	// Sort the list by priority, in decreasing order
 	sort.Slice(list, func(i, j int) bool {
-		if list[i].matchlen != list[j].matchlen {
-			return list[i].matchlen > list[j].matchlen
+		if list[i].priority != list[j].priority {
+			return list[i].priority > list[j].priority
 		}
 		return list[i].q.Index < list[j].q.Index
 	})
 
-	// Rebuild it into the slice of *Quirks
-	quirks := make([]Quirks, len(list))
+	// Rebuild it into the QuirksList
+	quirks := make(QuirksList, len(list))
 	for i := range list {
 		quirks[i] = *list[i].q
+		quirks[i].Match = list[i].match
 	}
 
+	return quirks
+}
+
+// Get quirks for the device
+//
+// In a case of multiple match, quirks are returned in
+// the from most prioritized to least prioritized order
+//
+// Duplicates are removed: if some parameter is set by
+// more prioritized entry, it is removed from the less
+// prioritized entries. Entries, that in result become
+// empty, are removed at all
+func (qset QuirksSet) Get(info UsbDeviceInfo) QuirksList {
+	quirks := qset.Match(info)
+
 	// If at least one Quirks contains Blacklist == true,
 	// it overrides everything else.
 	//
@@ -170,15 +350,17 @@ func (qset QuirksSet) Get(model string) []Quirks {
 	// list for more accurate logging
 	for _, q := range quirks {
 		if q.Blacklist {
-			return []Quirks{q}
+			return QuirksList{q}
 		}
 	}
 
 	// Remove duplicates and empty entries
 	httpHeaderSeen := make(map[string]struct{})
+	paramSeen := make(map[string]struct{})
 	out := 0
 	for in, q := range quirks {
 		q.HttpHeaders = make(map[string]string)
+		q.Params = make(map[string]string)
 
 		for name, value := range quirks[in].HttpHeaders {
 			if _, seen := httpHeaderSeen[name]; !seen {
@@ -187,7 +369,14 @@ func (qset QuirksSet) Get(model string) []Quirks {
 			}
 		}
 
-		if len(q.HttpHeaders) != 0 {
+		for name, value := range quirks[in].Params {
+			if _, seen := paramSeen[name]; !seen {
+				paramSeen[name] = struct{}{}
+				q.Params[name] = value
+			}
+		}
+
+		if len(q.HttpHeaders) != 0 || len(q.Params) != 0 {
 			quirks[out] = q
 			out++
 		}
@@ -197,3 +386,163 @@ func (qset QuirksSet) Get(model string) []Quirks {
 
 	return quirks
 }
+
+// Equal reports whether two QuirksLists have the same effective
+// settings. Where these settings come from (file, section,
+// match reason) is not taken into account
+func (quirks QuirksList) Equal(quirks2 QuirksList) bool {
+	return reflect.DeepEqual(quirks.effective(), quirks2.effective())
+}
+
+// effective merges QuirksList into the single Quirks, that
+// contains only effective settings
+func (quirks QuirksList) effective() Quirks {
+	eff := Quirks{
+		HttpHeaders: make(map[string]string),
+		Params:      make(map[string]string),
+	}
+
+	for _, q := range quirks {
+		eff.Blacklist = eff.Blacklist || q.Blacklist
+
+		for name, value := range q.HttpHeaders {
+			if _, found := eff.HttpHeaders[name]; !found {
+				eff.HttpHeaders[name] = value
+			}
+		}
+
+		for name, value := range q.Params {
+			if _, found := eff.Params[name]; !found {
+				eff.Params[name] = value
+			}
+		}
+	}
+
+	return eff
+}
+
+// UsbTransferSize returns size of USB bulk transfer
+func (quirks QuirksList) UsbTransferSize() int {
+	for _, q := range quirks {
+		if _, found := q.Params["usb-transfer-size"]; found {
+			return q.UsbTransferSize
+		}
+	}
+
+	return UsbDefaultTransferSize
+}
+
+// UsbQueueDepth returns count of USB bulk transfers, queued
+// per endpoint
+func (quirks QuirksList) UsbQueueDepth() int {
+	for _, q := range quirks {
+		if _, found := q.Params["usb-queue-depth"]; found {
+			return q.UsbQueueDepth
+		}
+	}
+
+	return UsbDefaultQueueDepth
+}
+
+// UsbStallTimeout returns USB I/O stall timeout. Zero
+// means stall detection is disabled
+func (quirks QuirksList) UsbStallTimeout() time.Duration {
+	for _, q := range quirks {
+		if _, found := q.Params["usb-stall-timeout"]; found {
+			return q.UsbStallTimeout
+		}
+	}
+
+	return UsbStallTimeout
+}
+
+// UsbSoftReset reports whether interfaces must be soft-reset
+// when opened
+func (quirks QuirksList) UsbSoftReset() bool {
+	for _, q := range quirks {
+		if _, found := q.Params["usb-soft-reset"]; found {
+			return q.UsbSoftReset
+		}
+	}
+
+	return false
+}
+
+// UsbInitDelay returns delay between device configuration
+// and the first I/O
+func (quirks QuirksList) UsbInitDelay() time.Duration {
+	for _, q := range quirks {
+		if _, found := q.Params["usb-init-delay"]; found {
+			return q.UsbInitDelay
+		}
+	}
+
+	return UsbInitDelay
+}
+
+// UsbMaxInterfaces returns maximum number of interfaces to
+// use. Zero means no limit
+func (quirks QuirksList) UsbMaxInterfaces() int {
+	for _, q := range quirks {
+		if _, found := q.Params["usb-max-interfaces"]; found {
+			return q.UsbMaxInterfaces
+		}
+	}
+
+	return 0
+}
+
+// UsbResetOnOpen reports whether device must be reset
+// when opened
+func (quirks QuirksList) UsbResetOnOpen() bool {
+	for _, q := range quirks {
+		if _, found := q.Params["usb-reset-on-open"]; found {
+			return q.UsbResetOnOpen
+		}
+	}
+
+	return false
+}
+
+// UsbDetachIppOnly reports whether kernel driver must be detached
+// only from IPP-over-USB interfaces, actually used by ipp-usb, leaving
+// other interfaces (i.e., 7/1/2 printer interface) to the kernel.
+// If not set by quirks, the global configuration is used
+func (quirks QuirksList) UsbDetachIppOnly() bool {
+	for _, q := range quirks {
+		if _, found := q.Params["usb-detach-kernel-driver"]; found {
+			return q.UsbDetachIppOnly
+		}
+	}
+
+	return Conf().UsbDetachIppOnly
+}
+
+// InitTimeout returns device initialization timeout
+func (quirks QuirksList) InitTimeout() time.Duration {
+	for _, q := range quirks {
+		if _, found := q.Params["init-timeout"]; found {
+			return q.InitTimeout
+		}
+	}
+
+	return DevInitTimeout
+}
+
+// ACL returns per-device client access control list
+func (quirks QuirksList) ACL() ACL {
+	var acl ACL
+	var allowFound, denyFound bool
+
+	for _, q := range quirks {
+		if _, found := q.Params["allow"]; found && !allowFound {
+			acl.Allow, allowFound = q.ACL.Allow, true
+		}
+
+		if _, found := q.Params["deny"]; found && !denyFound {
+			acl.Deny, denyFound = q.ACL.Deny, true
+		}
+	}
+
+	return acl
+}
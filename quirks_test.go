@@ -9,7 +9,12 @@
 package main
 
 import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 // Test quirls loading and lookup
@@ -30,7 +35,7 @@ func TestQuirksSetLoadAndLookup(t *testing.T) {
 	}
 
 	// Test default quirks
-	quirks := qset.Get("unknown device")
+	quirks := qset.Get(UsbDeviceInfo{MfgAndProduct: "unknown device"})
 	if quirks == nil {
 		t.Fatalf("default quirls: missed")
 	}
@@ -41,7 +46,7 @@ func TestQuirksSetLoadAndLookup(t *testing.T) {
 
 	// Test quirks for some known device
 	device := "HP LaserJet MFP M28-M31"
-	quirks = qset.Get(device)
+	quirks = qset.Get(UsbDeviceInfo{MfgAndProduct: device})
 	if quirks == nil {
 		t.Fatalf("%q quirls: missed", device)
 	}
@@ -54,3 +59,259 @@ func TestQuirksSetLoadAndLookup(t *testing.T) {
 		t.Fatalf("%q quirls: wrong ordering of returned quirks", device)
 	}
 }
+
+// Test USB I/O parameters lookup
+func TestQuirksUsbParams(t *testing.T) {
+	const path = "testdata/quirks"
+
+	qset, err := LoadQuirksSet(path)
+	if err != nil {
+		t.Fatalf("LoadQuirksSet(%q): %s", path, err)
+	}
+
+	// Test defaults
+	quirks := qset.Get(UsbDeviceInfo{MfgAndProduct: "unknown device"})
+	if sz := quirks.UsbTransferSize(); sz != UsbDefaultTransferSize {
+		t.Fatalf("default usb-transfer-size: expected %d, got %d",
+			UsbDefaultTransferSize, sz)
+	}
+
+	if depth := quirks.UsbQueueDepth(); depth != UsbDefaultQueueDepth {
+		t.Fatalf("default usb-queue-depth: expected %d, got %d",
+			UsbDefaultQueueDepth, depth)
+	}
+
+	// Test device-specific override
+	device := "HP OfficeJet Pro 8730"
+	quirks = qset.Get(UsbDeviceInfo{MfgAndProduct: device})
+	if depth := quirks.UsbQueueDepth(); depth != 8 {
+		t.Fatalf("%q usb-queue-depth: expected %d, got %d",
+			device, 8, depth)
+	}
+
+	if sz := quirks.UsbTransferSize(); sz != UsbDefaultTransferSize {
+		t.Fatalf("%q usb-transfer-size: expected %d, got %d",
+			device, UsbDefaultTransferSize, sz)
+	}
+}
+
+// Test USB initialization parameters lookup
+func TestQuirksUsbInitParams(t *testing.T) {
+	const path = "testdata/quirks"
+
+	qset, err := LoadQuirksSet(path)
+	if err != nil {
+		t.Fatalf("LoadQuirksSet(%q): %s", path, err)
+	}
+
+	// Test defaults
+	quirks := qset.Get(UsbDeviceInfo{MfgAndProduct: "unknown device"})
+	if quirks.UsbSoftReset() ||
+		quirks.UsbInitDelay() != UsbInitDelay ||
+		quirks.UsbMaxInterfaces() != 0 ||
+		quirks.UsbResetOnOpen() ||
+		quirks.InitTimeout() != DevInitTimeout {
+		t.Fatalf("default USB init parameters: unexpected values")
+	}
+
+	// Test device-specific override
+	device := "HP LaserJet MFP M28-M31"
+	quirks = qset.Get(UsbDeviceInfo{MfgAndProduct: device})
+
+	if !quirks.UsbSoftReset() {
+		t.Fatalf("%q usb-soft-reset: expected true", device)
+	}
+
+	if d := quirks.UsbInitDelay(); d != time.Second {
+		t.Fatalf("%q usb-init-delay: expected %s, got %s",
+			device, time.Second, d)
+	}
+
+	if max := quirks.UsbMaxInterfaces(); max != 2 {
+		t.Fatalf("%q usb-max-interfaces: expected %d, got %d",
+			device, 2, max)
+	}
+
+	if !quirks.UsbResetOnOpen() {
+		t.Fatalf("%q usb-reset-on-open: expected true", device)
+	}
+
+	if d := quirks.InitTimeout(); d != 10*time.Second {
+		t.Fatalf("%q init-timeout: expected %s, got %s",
+			device, 10*time.Second, d)
+	}
+}
+
+// Test quirks matching by USB parameters
+func TestQuirksMatchUsb(t *testing.T) {
+	const path = "testdata/quirks"
+
+	qset, err := LoadQuirksSet(path)
+	if err != nil {
+		t.Fatalf("LoadQuirksSet(%q): %s", path, err)
+	}
+
+	// VID only
+	info := UsbDeviceInfo{
+		Vendor:        0x03f0,
+		Product:       0x0001,
+		MfgAndProduct: "unknown device",
+	}
+
+	quirks := qset.Get(info)
+	if d := quirks.UsbQueueDepth(); d != 2 {
+		t.Fatalf("%4.4x:%4.4x usb-queue-depth: expected %d, got %d",
+			info.Vendor, info.Product, 2, d)
+	}
+
+	// Exact VID:PID wins over VID only
+	info.Product = 0x2a17
+
+	quirks = qset.Get(info)
+	if d := quirks.UsbQueueDepth(); d != 6 {
+		t.Fatalf("%4.4x:%4.4x usb-queue-depth: expected %d, got %d",
+			info.Vendor, info.Product, 6, d)
+	}
+
+	// Other vendor doesn't match
+	info.Vendor = 0x04a9
+
+	quirks = qset.Get(info)
+	if d := quirks.UsbQueueDepth(); d != UsbDefaultQueueDepth {
+		t.Fatalf("%4.4x:%4.4x usb-queue-depth: expected %d, got %d",
+			info.Vendor, info.Product, UsbDefaultQueueDepth, d)
+	}
+
+	// Manufacturer and serial number must match both
+	info.Manufacturer = "Simulated"
+	info.SerialNumber = "SIM0002"
+
+	quirks = qset.Get(info)
+	if len(quirks) > 0 && quirks[0].Blacklist {
+		t.Fatalf("%q %q: blacklisted unexpectedly",
+			info.Manufacturer, info.SerialNumber)
+	}
+
+	info.SerialNumber = "SIM0001"
+
+	quirks = qset.Get(info)
+	if len(quirks) == 0 || !quirks[0].Blacklist {
+		t.Fatalf("%q %q: not blacklisted",
+			info.Manufacturer, info.SerialNumber)
+	}
+
+	// Check match explanation
+	for _, q := range qset.Match(info) {
+		if q.Match == "" {
+			t.Fatalf("[%s]: match reason missing", q.Model)
+		}
+	}
+
+	// Test invalid usb-id
+	q := &Quirks{}
+	for _, id := range []string{"03f0", "03f0:", "3f0:*", "03g0:*", "*:*:*"} {
+		rec := &IniRecord{Key: "usb-id", Value: id}
+		if quirksLoadUsbIDKey(&q.UsbID, rec) == nil {
+			t.Fatalf("usb-id = %q: error expected", id)
+		}
+	}
+}
+
+// Test usb-detach-kernel-driver lookup
+func TestQuirksUsbDetachIppOnly(t *testing.T) {
+	const path = "testdata/quirks"
+
+	qset, err := LoadQuirksSet(path)
+	if err != nil {
+		t.Fatalf("LoadQuirksSet(%q): %s", path, err)
+	}
+
+	defer confTestSet(func(*Configuration) {})()
+
+	// Test fallback to the global configuration
+	quirks := qset.Get(UsbDeviceInfo{MfgAndProduct: "unknown device"})
+	for _, global := range []bool{false, true} {
+		confTestSet(func(conf *Configuration) {
+			conf.UsbDetachIppOnly = global
+		})
+		if quirks.UsbDetachIppOnly() != global {
+			t.Fatalf("usb-detach-kernel-driver: expected %v", global)
+		}
+	}
+
+	// Test device-specific override
+	device := "HP OfficeJet Pro 8730"
+	quirks = qset.Get(UsbDeviceInfo{MfgAndProduct: device})
+
+	confTestSet(func(conf *Configuration) { conf.UsbDetachIppOnly = false })
+	if !quirks.UsbDetachIppOnly() {
+		t.Fatalf("%q usb-detach-kernel-driver: expected ipp-only", device)
+	}
+}
+
+// Test QuirksList.Equal
+func TestQuirksListEqual(t *testing.T) {
+	const path = "testdata/quirks"
+	qset, err := LoadQuirksSet(path)
+	if err != nil {
+		t.Fatalf("LoadQuirksSet(%q): %s", path, err)
+	}
+
+	hp1 := UsbDeviceInfo{Vendor: 0x03f0, Product: 0x0001}
+	hp2 := UsbDeviceInfo{Vendor: 0x03f0, Product: 0x0002}
+	hp3 := UsbDeviceInfo{Vendor: 0x03f0, Product: 0x2a17}
+
+	if !qset.Get(hp1).Equal(qset.Get(hp2)) {
+		t.Errorf("quirks for %s and %s must be equal",
+			hp1.Ident(), hp2.Ident())
+	}
+
+	if qset.Get(hp1).Equal(qset.Get(hp3)) {
+		t.Errorf("quirks for %s and %s must differ",
+			hp1.Ident(), hp3.Ident())
+	}
+
+	if !QuirksList(nil).Equal(QuirksList{}) {
+		t.Errorf("empty quirks must be equal")
+	}
+}
+
+// Test that repeated ACL keys are accumulated
+func TestQuirksACL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipp-usb-test")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := "[Test Printer]\n" +
+		"  allow = loopback\n" +
+		"  allow = 192.168.1.0/24\n" +
+		"  deny  = 192.168.1.5\n"
+
+	err = ioutil.WriteFile(filepath.Join(dir, "test.conf"), []byte(data), 0644)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	qset, err := LoadQuirksSet(dir)
+	if err != nil {
+		t.Fatalf("LoadQuirksSet(%q): %s", dir, err)
+	}
+
+	quirks := qset.Get(UsbDeviceInfo{MfgAndProduct: "Test Printer"})
+	acl := quirks.ACL()
+
+	if s := acl.Allow.String(); s != "loopback, 192.168.1.0/24" {
+		t.Fatalf("allow: %q", s)
+	}
+
+	if quirks[0].Params["allow"] != "loopback, 192.168.1.0/24" {
+		t.Fatalf("allow: Params: %q", quirks[0].Params["allow"])
+	}
+
+	if !ACLCheck(net.ParseIP("192.168.1.4"), acl) ||
+		ACLCheck(net.ParseIP("192.168.1.5"), acl) {
+		t.Fatalf("ACLCheck: unexpected result")
+	}
+}
@@ -0,0 +1,209 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Rewriting of device-local URLs in responses
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// URLRewriter rewrites URLs in device responses, that point to
+// the device's local address (i.e., "ipp://localhost:60000/ipp/print"),
+// so they point to the host and port, the client actually used
+// to reach the proxy
+//
+// Only URLs without port or with the device's own port are
+// rewritten, so loopback URLs of other services (i.e., CUPS at
+// "ipp://localhost:631/") are left as is
+//
+// In IPP responses only values of the uri type are affected, and
+// document data, that may follow the attributes, remains untouched
+type URLRewriter struct {
+	host   string // Host and port, client used
+	port   string // Device's own port
+	secure bool   // Client uses TLS
+}
+
+// urlRewriteRegexp matches device-local URL prefix with optional
+// port, followed by a character, that terminates the host part
+// (or end of string)
+var urlRewriteRegexp = regexp.MustCompile(
+	`(?i)\b(ipps?|https?)://` +
+		`(?:localhost\.?|127(?:\.[0-9]{1,3}){3}|\[::1\])(?::([0-9]+))?` +
+		`([^-.:a-z0-9]|$)`)
+
+// NewURLRewriter creates URLRewriter for the request, received
+// on the specified device's port. If no rewriting is needed
+// (client uses loopback address without TLS), it returns nil
+func NewURLRewriter(r *http.Request, port int) *URLRewriter {
+	host := r.Host
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+
+	hostname = strings.Trim(hostname, "[]")
+	loopback := strings.EqualFold(hostname, "localhost")
+	if ip := net.ParseIP(hostname); ip != nil {
+		loopback = ip.IsLoopback()
+	}
+
+	if host == "" || (loopback && r.TLS == nil) {
+		return nil
+	}
+
+	return &URLRewriter{
+		host:   host,
+		port:   strconv.Itoa(port),
+		secure: r.TLS != nil,
+	}
+}
+
+// String rewrites all device-local URLs in the string
+func (rw *URLRewriter) String(s string) string {
+	return urlRewriteRegexp.ReplaceAllStringFunc(s, func(prefix string) string {
+		match := urlRewriteRegexp.FindStringSubmatch(prefix)
+		scheme, port, tail := strings.ToLower(match[1]), match[2], match[3]
+
+		if port != "" && port != rw.port {
+			return prefix
+		}
+
+		switch scheme {
+		case "ipp", "ipps":
+			scheme = "ipp"
+		case "http", "https":
+			scheme = "http"
+		}
+
+		if rw.secure {
+			scheme += "s"
+		}
+
+		return scheme + "://" + rw.host + tail
+	})
+}
+
+// Response rewrites URLs in the response header and body
+//
+// IPP responses and eSCL XML documents are rewritten. Bodies of
+// other responses, including document data, are left untouched
+func (rw *URLRewriter) Response(rq *http.Request, resp *http.Response) {
+	for _, name := range []string{"Location", "Content-Location"} {
+		if v := resp.Header.Get(name); v != "" {
+			resp.Header.Set(name, rw.String(v))
+		}
+	}
+
+	if resp.Body == nil || resp.Header.Get("Content-Encoding") != "" {
+		return
+	}
+
+	ct, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	path := strings.ToLower(rq.URL.Path)
+	escl := strings.HasPrefix(path, "/escl/")
+
+	var body io.Reader
+	switch {
+	case ct == "application/ipp":
+		body = rw.ipp(resp.Body)
+	case escl && (ct == "text/xml" || ct == "application/xml"):
+		body = rw.xml(resp.Body)
+	default:
+		return
+	}
+
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{body, resp.Body}
+
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+}
+
+// xml rewrites URLs in XML document
+//
+// Documents, larger that URLRewriteMaxXMLSize, are left untouched
+func (rw *URLRewriter) xml(in io.Reader) io.Reader {
+	data, err := ioutil.ReadAll(io.LimitReader(in, URLRewriteMaxXMLSize+1))
+	if err != nil || len(data) > URLRewriteMaxXMLSize {
+		return io.MultiReader(bytes.NewReader(data), in)
+	}
+
+	return strings.NewReader(rw.String(string(data)))
+}
+
+// ipp rewrites URLs in IPP message. Data, following the message
+// (i.e., document) is passed as is
+//
+// Message is decoded with goipp, which merges attribute groups of
+// the same kind (i.e., multiple job groups of Get-Jobs response).
+// So the message is rewritten only if it survives the decode/encode
+// round trip unchanged; otherwise it is left untouched, as are the
+// messages that cannot be parsed
+func (rw *URLRewriter) ipp(in io.Reader) io.Reader {
+	reader := bufio.NewReader(in)
+	raw := &bytes.Buffer{}
+
+	var msg goipp.Message
+	err := msg.Decode(io.TeeReader(reader, raw))
+	if err != nil {
+		return io.MultiReader(raw, reader)
+	}
+
+	encoded, err := msg.EncodeBytes()
+	if err != nil || !bytes.Equal(encoded, raw.Bytes()) {
+		return io.MultiReader(raw, reader)
+	}
+
+	for _, grp := range []goipp.Attributes{
+		msg.Operation, msg.Job, msg.Printer, msg.Unsupported,
+		msg.Subscription, msg.EventNotification, msg.Resource,
+		msg.Document, msg.System,
+		msg.Future11, msg.Future12, msg.Future13, msg.Future14,
+		msg.Future15,
+	} {
+		rw.ippAttrs(grp)
+	}
+
+	encoded, err = msg.EncodeBytes()
+	if err != nil {
+		return io.MultiReader(raw, reader)
+	}
+
+	return io.MultiReader(bytes.NewReader(encoded), reader)
+}
+
+// ippAttrs rewrites URI values of attributes in place, including
+// members of collections
+func (rw *URLRewriter) ippAttrs(attrs goipp.Attributes) {
+	for _, attr := range attrs {
+		for i, v := range attr.Values {
+			switch val := v.V.(type) {
+			case goipp.String:
+				if v.T == goipp.TagURI {
+					attr.Values[i].V = goipp.String(rw.String(string(val)))
+				}
+			case goipp.Collection:
+				rw.ippAttrs(goipp.Attributes(val))
+			}
+		}
+	}
+}
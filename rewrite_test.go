@@ -0,0 +1,211 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Rewriting of device-local URLs test
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// rewriteTestRequest creates request, received by proxy
+func rewriteTestRequest(path, host string, secure bool) *http.Request {
+	r, _ := http.NewRequest("GET", path, nil)
+	r.Host = host
+	if secure {
+		r.TLS = &tls.ConnectionState{}
+	}
+	return r
+}
+
+// Test rewriting of device-local URLs in strings
+func TestURLRewriterString(t *testing.T) {
+	if NewURLRewriter(rewriteTestRequest("/", "localhost:60000", false), 60000) != nil ||
+		NewURLRewriter(rewriteTestRequest("/", "127.0.0.1:60000", false), 60000) != nil ||
+		NewURLRewriter(rewriteTestRequest("/", "[::1]:60000", false), 60000) != nil {
+		t.Errorf("NewURLRewriter: rewriting for loopback client")
+	}
+
+	rw := NewURLRewriter(rewriteTestRequest("/", "192.168.1.5:60000", false), 60000)
+	rws := NewURLRewriter(rewriteTestRequest("/", "printer.local:60000", true), 60000)
+
+	tests := []struct {
+		rw      *URLRewriter
+		in, out string
+	}{
+		{rw, "ipp://localhost:60000/ipp/print",
+			"ipp://192.168.1.5:60000/ipp/print"},
+		{rw, "http://127.0.0.1/", "http://192.168.1.5:60000/"},
+		{rw, "HTTP://[::1]:60000", "http://192.168.1.5:60000"},
+		{rw, "ipp://localhost:631/printers/cups",
+			"ipp://localhost:631/printers/cups"},
+		{rw, "ipps://localhost./ipp/print",
+			"ipp://192.168.1.5:60000/ipp/print"},
+		{rws, "ipp://localhost:60000/ipp/print",
+			"ipps://printer.local:60000/ipp/print"},
+		{rws, "http://localhost:60000/icon.png",
+			"https://printer.local:60000/icon.png"},
+		{rw, "http://localhost.example.com/", "http://localhost.example.com/"},
+		{rw, "http://192.168.1.1/", "http://192.168.1.1/"},
+		{rw, "urn:uuid:6e5ab90e-a0b3-4e1c-a5ac-6d5a6b0a2f1c",
+			"urn:uuid:6e5ab90e-a0b3-4e1c-a5ac-6d5a6b0a2f1c"},
+		{rw, "<AdminURI>http://localhost/</AdminURI><IconURI>http://localhost/i.png</IconURI>",
+			"<AdminURI>http://192.168.1.5:60000/</AdminURI>" +
+				"<IconURI>http://192.168.1.5:60000/i.png</IconURI>"},
+	}
+
+	for _, test := range tests {
+		if out := test.rw.String(test.in); out != test.out {
+			t.Errorf("%q: %q, expected %q", test.in, out, test.out)
+		}
+	}
+}
+
+// rewriteTestIPP builds IPP response with the specified host
+// in URI values
+func rewriteTestIPP(host string) []byte {
+	msg := goipp.NewResponse(goipp.DefaultVersion, goipp.StatusOk, 1)
+	msg.Operation.Add(goipp.MakeAttribute("attributes-charset",
+		goipp.TagCharset, goipp.String("utf-8")))
+	msg.Printer.Add(goipp.MakeAttribute("printer-uri-supported",
+		goipp.TagURI, goipp.String("ipp://"+host+"/ipp/print")))
+	msg.Printer.Add(goipp.MakeAttribute("printer-name",
+		goipp.TagName, goipp.String("ipp://localhost/")))
+
+	xri := goipp.Collection{}
+	xri.Add(goipp.MakeAttribute("xri-uri",
+		goipp.TagURI, goipp.String("ipp://"+host+"/ipp/print")))
+	msg.Printer.Add(goipp.MakeAttribute("printer-xri-supported",
+		goipp.TagBeginCollection, xri))
+
+	data, _ := msg.EncodeBytes()
+	return data
+}
+
+// rewriteTestIPPJobs builds IPP response in the wire format, with
+// two job groups and the specified job-uri host
+//
+// goipp merges groups of the same kind when encoding, so message
+// is assembled manually
+func rewriteTestIPPJobs(host string) []byte {
+	buf := &bytes.Buffer{}
+	buf.Write([]byte{2, 0, 0, 0, 0, 0, 0, 1})
+
+	attr := func(tag goipp.Tag, name, value string) {
+		buf.WriteByte(byte(tag))
+		binary.Write(buf, binary.BigEndian, uint16(len(name)))
+		buf.WriteString(name)
+		binary.Write(buf, binary.BigEndian, uint16(len(value)))
+		buf.WriteString(value)
+	}
+
+	buf.WriteByte(byte(goipp.TagOperationGroup))
+	attr(goipp.TagCharset, "attributes-charset", "utf-8")
+
+	for i := 1; i <= 2; i++ {
+		buf.WriteByte(byte(goipp.TagJobGroup))
+		attr(goipp.TagURI, "job-uri",
+			fmt.Sprintf("ipp://%s/ipp/print/%d", host, i))
+	}
+
+	buf.WriteByte(byte(goipp.TagEnd))
+	return buf.Bytes()
+}
+
+// Test rewriting of IPP responses
+func TestURLRewriterIPP(t *testing.T) {
+	in := append(rewriteTestIPP("localhost:60000"), "DOCUMENT ipp://localhost/"...)
+	expected := append(rewriteTestIPP("192.168.1.5:60000"), "DOCUMENT ipp://localhost/"...)
+
+	resp := &http.Response{
+		Header: http.Header{
+			"Content-Type":   {"application/ipp"},
+			"Content-Length": {"1000"},
+		},
+		Body: ioutil.NopCloser(bytes.NewReader(in)),
+	}
+
+	rq := rewriteTestRequest("/ipp/print", "192.168.1.5:60000", false)
+	NewURLRewriter(rq, 60000).Response(rq, resp)
+
+	out, _ := ioutil.ReadAll(resp.Body)
+	if !bytes.Equal(out, expected) {
+		t.Errorf("IPP:\nexpected: %q\npresent:  %q", expected, out)
+	}
+
+	if resp.Header.Get("Content-Length") != "" {
+		t.Errorf("IPP: Content-Length not removed")
+	}
+
+	// Message, that goipp cannot encode unchanged, and malformed
+	// message are passed as is
+	for _, in := range [][]byte{
+		rewriteTestIPPJobs("localhost:60000"),
+		in[:20],
+	} {
+		resp.Body = ioutil.NopCloser(bytes.NewReader(in))
+		NewURLRewriter(rq, 60000).Response(rq, resp)
+
+		out, _ = ioutil.ReadAll(resp.Body)
+		if !bytes.Equal(out, in) {
+			t.Errorf("IPP: message modified: %q", out)
+		}
+	}
+}
+
+// Test rewriting of eSCL responses
+func TestURLRewriterESCL(t *testing.T) {
+	rq := rewriteTestRequest("/eSCL/ScanJobs", "192.168.1.5:60000", false)
+	rw := NewURLRewriter(rq, 60000)
+
+	// Location header
+	resp := &http.Response{
+		Header: http.Header{
+			"Location": {"http://localhost:60000/eSCL/ScanJobs/1"},
+		},
+	}
+
+	rw.Response(rq, resp)
+	if loc := resp.Header.Get("Location"); loc !=
+		"http://192.168.1.5:60000/eSCL/ScanJobs/1" {
+		t.Errorf("Location: %q", loc)
+	}
+
+	// XML document
+	xml := `<scan:AdminURI>http://localhost/</scan:AdminURI>`
+	resp = &http.Response{
+		Header: http.Header{"Content-Type": {"text/xml; charset=utf-8"}},
+		Body:   ioutil.NopCloser(strings.NewReader(xml)),
+	}
+
+	rw.Response(rq, resp)
+	out, _ := ioutil.ReadAll(resp.Body)
+	if string(out) != `<scan:AdminURI>http://192.168.1.5:60000/</scan:AdminURI>` {
+		t.Errorf("XML: %q", out)
+	}
+
+	// Document data is left untouched
+	resp = &http.Response{
+		Header: http.Header{"Content-Type": {"image/jpeg"}},
+		Body:   ioutil.NopCloser(strings.NewReader(xml)),
+	}
+
+	rw.Response(rq, resp)
+	out, _ = ioutil.ReadAll(resp.Body)
+	if string(out) != xml {
+		t.Errorf("image/jpeg: modified: %q", out)
+	}
+}
@@ -0,0 +1,234 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Status web page
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// StatusServer serves the read-only status page over HTTP
+type StatusServer struct {
+	server    *http.Server  // HTTP server
+	closeWait chan struct{} // Closed at server close
+}
+
+// statusPageDev represents a device on the status page
+type statusPageDev struct {
+	PnPDevStatus
+	Summary string // Human-readable state summary
+	Good    bool   // Device is being served
+	URL     string // Device's web console URL
+}
+
+// statusPageTemplate is the status page template
+var statusPageTemplate = template.Must(template.New("status").Funcs(
+	template.FuncMap{
+		"fmtTime": func(tm time.Time) string {
+			return tm.Format("2006-01-02 15:04:05")
+		},
+	}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="10">
+<title>ipp-usb status</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { text-align: left; vertical-align: top; padding: 0.2em 1em 0.2em 0; }
+h2 { margin-top: 1.5em; }
+.good { color: green; }
+.bad { color: #c00; }
+.mono { font-family: monospace; }
+</style>
+</head>
+<body>
+<h1>ipp-usb status</h1>
+<p>{{len .Devices}} device(s), updated {{fmtTime .Now}}</p>
+{{range .Devices}}
+<h2>{{if .Model}}{{.Model}}{{else}}USB device {{.UsbAddr}}{{end}}</h2>
+<table>
+<tr><th>Status</th><td class="{{if .Good}}good{{else}}bad{{end}}">{{.Summary}}</td></tr>
+<tr><th>USB address</th><td>{{.UsbAddr}}</td></tr>
+{{- if .Ident}}
+<tr><th>Ident</th><td class="mono">{{.Ident}}</td></tr>
+{{- end}}
+{{- if .HTTPPort}}
+<tr><th>HTTP port</th><td>{{.HTTPPort}}</td></tr>
+{{- end}}
+{{- if .URL}}
+<tr><th>Web console</th><td><a href="{{.URL}}">{{.URL}}</a></td></tr>
+{{- end}}
+{{- if .DNSSdName}}
+<tr><th>DNS-SD name</th><td>{{.DNSSdName}}</td></tr>
+{{- end}}
+{{- if .ConnState}}
+<tr><th>USB connections</th><td class="mono">{{.ConnState}}</td></tr>
+{{- end}}
+{{- if .Quirks}}
+<tr><th>Quirks</th><td>{{range .Quirks}}{{.}}<br>{{end}}</td></tr>
+{{- end}}
+</table>
+{{- range .Services}}
+<table>
+<tr><th colspan="2">{{.Type}}, port {{.Port}}</th></tr>
+{{- range .Txt}}
+<tr><td class="mono">{{.Key}}</td><td class="mono">{{.Value}}</td></tr>
+{{- end}}
+</table>
+{{- end}}
+{{- if .Errors}}
+<table>
+<tr><th colspan="2">Recent errors</th></tr>
+{{- range .Errors}}
+<tr><td>{{fmtTime .Time}}</td><td>{{.Err}}</td></tr>
+{{- end}}
+</table>
+{{- end}}
+{{else}}
+<p>No IPP-over-USB devices connected</p>
+{{end}}
+</body>
+</html>
+`))
+
+// NewStatusServer creates new StatusServer, listening on
+// the specified port
+func NewStatusServer(port int, loopbackOnly bool) (*StatusServer, error) {
+	listener, err := newListener(port, loopbackOnly)
+	if err != nil {
+		return nil, fmt.Errorf("status page: %s", err)
+	}
+
+	return newStatusServer(listener), nil
+}
+
+// newStatusServer creates new StatusServer on a top of
+// existent listener
+func newStatusServer(listener net.Listener) *StatusServer {
+	srv := &StatusServer{closeWait: make(chan struct{})}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", statusPageHandler)
+
+	srv.server = &http.Server{Handler: mux}
+
+	go func() {
+		srv.server.Serve(listener)
+		close(srv.closeWait)
+	}()
+
+	return srv
+}
+
+// Close the server
+func (srv *StatusServer) Close() {
+	srv.server.Close()
+	<-srv.closeWait
+}
+
+// statusPageHandler handles status page requests
+func statusPageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Device consoles are on the same host, where status
+	// page is, but on the different ports. If TLS is enabled,
+	// device ports accept HTTPS
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+
+	scheme := "http://"
+	if Conf().TLSEnable || r.TLS != nil {
+		scheme = "https://"
+	}
+
+	data := struct {
+		Now     time.Time
+		Devices []statusPageDev
+	}{Now: time.Now()}
+
+	for _, st := range PnPStatus() {
+		dev := statusPageDev{
+			PnPDevStatus: st,
+			Summary:      statusPageSummary(st),
+			Good:         st.State == PnPDevReady,
+		}
+
+		if st.State == PnPDevReady && st.HTTPPort != 0 && host != "" {
+			dev.URL = scheme + net.JoinHostPort(host,
+				strconv.Itoa(st.HTTPPort)) + "/"
+		}
+
+		data.Devices = append(data.Devices, dev)
+	}
+
+	var buf bytes.Buffer
+	err = statusPageTemplate.Execute(&buf, data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	httpNoCache(w)
+	w.Write(buf.Bytes())
+}
+
+// statusPageSummary returns human-readable summary of device state,
+// explaining why device is not served, if it is the case
+func statusPageSummary(st PnPDevStatus) string {
+	switch st.State {
+	case PnPDevInitializing:
+		return "Initializing"
+
+	case PnPDevReady:
+		return "Ready, being served"
+
+	case PnPDevRetry:
+		s := "Not served"
+		if st.Err != "" {
+			s += ": " + st.Err
+		}
+		if !st.NextRetry.IsZero() {
+			d := time.Until(st.NextRetry).Round(time.Second)
+			if d > 0 {
+				s += fmt.Sprintf(", will retry in %s", d)
+			} else {
+				s += ", retrying"
+			}
+		}
+		return s
+
+	case PnPDevFailed:
+		return fmt.Sprintf("Not served: %s, gave up after %d attempts",
+			st.Err, st.Attempts)
+
+	case PnPDevDetached:
+		return "Disconnected, waiting for device to come back"
+	}
+
+	return st.State.String()
+}
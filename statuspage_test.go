@@ -0,0 +1,119 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Status web page test
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test status page, served over HTTP
+func TestStatusPage(t *testing.T) {
+	backend, dev, cleanup := usbSimTestSetup(t)
+	defer cleanup()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %s", err)
+	}
+
+	srv := newStatusServer(listener)
+	defer srv.Close()
+
+	url := "http://" + listener.Addr().String() + "/"
+
+	// get fetches the status page
+	get := func() string {
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatalf("GET %s: %s", url, err)
+		}
+
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("GET %s: %s", url, err)
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s: %s", url, resp.Status)
+		}
+
+		return string(data)
+	}
+
+	if page := get(); !strings.Contains(page, "No IPP-over-USB devices") {
+		t.Fatalf("status page without devices:\n%s", page)
+	}
+
+	// Start PnP manager and wait until device is ready
+	exited := usbSimTestStartPnP()
+	st := usbSimTestWaitReady(t)
+
+	// Reset the device, to see it among recent errors
+	pnpStatusTransport(dev.UsbAddr).requestReset("test reset")
+
+	var page string
+	for tm := time.Now(); ; {
+		if time.Since(tm) > DevInitTimeout {
+			t.Fatalf("status page: device not ready:\n%s", page)
+		}
+
+		time.Sleep(50 * time.Millisecond)
+		page = get()
+		if strings.Contains(page, "test reset") &&
+			strings.Contains(page, "Ready, being served") {
+			break
+		}
+	}
+
+	for _, expected := range []string{
+		"Simulated IPP-over-USB Printer",
+		dev.UsbAddr.String(),
+		fmt.Sprintf(`href="http://127.0.0.1:%d/"`, st.HTTPPort),
+		"_ipp._tcp",
+		"txtvers",
+	} {
+		if !strings.Contains(page, expected) {
+			t.Errorf("status page: %q missed:\n%s", expected, page)
+		}
+	}
+
+	// With TLS, device consoles are linked via HTTPS
+	restore := confTestSet(func(conf *Configuration) { conf.TLSEnable = true })
+	page = get()
+	restore()
+
+	expected := fmt.Sprintf(`href="https://127.0.0.1:%d/"`, st.HTTPPort)
+	if !strings.Contains(page, expected) {
+		t.Errorf("status page: %q missed:\n%s", expected, page)
+	}
+
+	backend.Remove(dev.UsbAddr)
+	<-exited
+}
+
+// Test human-readable summary of device state
+func TestStatusPageSummary(t *testing.T) {
+	st := PnPDevStatus{
+		State:    PnPDevFailed,
+		Err:      ErrBlackListed.Error(),
+		Attempts: 1,
+	}
+
+	s := statusPageSummary(st)
+	if !strings.Contains(s, ErrBlackListed.Error()) {
+		t.Fatalf("statusPageSummary: %q", s)
+	}
+}
@@ -0,0 +1,257 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * systemd integration: readiness notification, watchdog
+ * and socket activation
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sdListenFdsStart is the first file descriptor, passed by
+// systemd socket activation
+const sdListenFdsStart = 3
+
+// SdNotify sends notification to systemd. If ipp-usb is not
+// started by systemd with notification support, it does nothing
+//
+// The state is a newline-separated list of variable assignments,
+// as described in sd_notify(3)
+func SdNotify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+
+	// Note, abstract socket names (@name) are handled by
+	// the net package automatically
+	conn, err := net.DialUnix("unixgram", nil,
+		&net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("sd_notify: %s", err)
+	}
+
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	if err != nil {
+		return fmt.Errorf("sd_notify: %s", err)
+	}
+
+	return nil
+}
+
+// SdWatchdogInterval returns interval of watchdog, requested by
+// systemd (WatchdogSec=), or 0, if watchdog is not enabled
+//
+// WATCHDOG=1 notifications must be sent at least this often,
+// and preferably twice as often
+func SdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseUint(os.Getenv("WATCHDOG_USEC"), 10, 63)
+	if err != nil || usec == 0 {
+		return 0
+	}
+
+	pid := os.Getenv("WATCHDOG_PID")
+	if pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond
+}
+
+// sdSocket represents a listening socket, passed by systemd
+type sdSocket struct {
+	name     string           // Name, from LISTEN_FDNAMES
+	port     int              // TCP port
+	listener *net.TCPListener // The socket itself, never closed
+	inUse    bool             // Socket is in use by device
+}
+
+// sdSockets contains all sockets, passed by systemd
+var sdSockets struct {
+	sync.Mutex
+	list []*sdSocket
+}
+
+// SdListenFds takes listening sockets, passed by systemd socket
+// activation (LISTEN_FDS and LISTEN_FDNAMES), and uses them as
+// devices' HTTP sockets instead of allocating ports
+//
+// Environment variables are cleared, so sockets will not be
+// taken again by child processes
+func SdListenFds() error {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil
+	}
+
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	for i := 0; i < n; i++ {
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+
+		fd := uintptr(sdListenFdsStart + i)
+		err = sdAddSocket(name, os.NewFile(fd, name))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sdAddSocket adds listening socket, passed by systemd. File
+// is consumed by this function
+func sdAddSocket(name string, file *os.File) error {
+	nl, err := net.FileListener(file)
+	file.Close()
+
+	if err != nil {
+		return fmt.Errorf("LISTEN_FDS: %q: %s", name, err)
+	}
+
+	listener, ok := nl.(*net.TCPListener)
+	if !ok {
+		nl.Close()
+		return fmt.Errorf("LISTEN_FDS: %q: not a TCP socket", name)
+	}
+
+	sock := &sdSocket{
+		name:     name,
+		port:     listener.Addr().(*net.TCPAddr).Port,
+		listener: listener,
+	}
+
+	Log.Debug(' ', "LISTEN_FDS: %q: port %d", name, sock.port)
+
+	sdSockets.Lock()
+	sdSockets.list = append(sdSockets.list, sock)
+	sdSockets.Unlock()
+
+	return nil
+}
+
+// shared returns true, if socket is not dedicated to the
+// particular device
+//
+// Sockets are dedicated by naming them after the device
+// Ident (FileDescriptorName= in systemd.socket). Unnamed
+// sockets and sockets named after the socket unit (the
+// systemd default) are shared between devices
+func (sock *sdSocket) shared() bool {
+	return sock.name == "" || sock.name == "unknown" ||
+		strings.HasSuffix(sock.name, ".socket")
+}
+
+// sdListen returns listener for the device, created on a top of
+// socket, passed by systemd, and its port. If there is no suitable
+// socket, it returns nil
+//
+// Sockets are chosen in the following order:
+//   - socket, dedicated to the device
+//   - shared socket with the port, used by device before
+//   - any free shared socket
+func sdListen(ident string, port int) (net.Listener, int) {
+	sdSockets.Lock()
+	defer sdSockets.Unlock()
+
+	var found *sdSocket
+	for _, sock := range sdSockets.list {
+		switch {
+		case sock.inUse:
+		case sock.name == ident:
+			found = sock
+		case !sock.shared():
+		case found == nil || (sock.port == port && found.shared()):
+			found = sock
+		}
+	}
+
+	if found == nil {
+		return nil, 0
+	}
+
+	// The listener is shared by duplicating the socket, so
+	// closing device's listener doesn't close the original
+	// socket, and it can be reused when device is reinitialized
+	file, err := found.listener.File()
+	if err != nil {
+		Log.Error('!', "LISTEN_FDS: %q: %s", found.name, err)
+		return nil, 0
+	}
+
+	nl, err := net.FileListener(file)
+	file.Close()
+
+	if err != nil {
+		Log.Error('!', "LISTEN_FDS: %q: %s", found.name, err)
+		return nil, 0
+	}
+
+	found.inUse = true
+	listener := &sdListener{Listener: nl, sock: found}
+
+	return wrapListener(listener), found.port
+}
+
+// sdPortPassed returns true, if port belongs to one of
+// the sockets, passed by systemd
+func sdPortPassed(port int) bool {
+	sdSockets.Lock()
+	defer sdSockets.Unlock()
+
+	for _, sock := range sdSockets.list {
+		if sock.port == port {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sdListener wraps device's listener, created on a top of
+// socket, passed by systemd. When closed, socket is returned
+// back to the pool
+type sdListener struct {
+	net.Listener           // Underlying net.Listener
+	sock         *sdSocket // Socket, passed by systemd
+	closeOnce    sync.Once // To release socket only once
+}
+
+// Close the listener
+func (l *sdListener) Close() error {
+	err := l.Listener.Close()
+
+	l.closeOnce.Do(func() {
+		sdSockets.Lock()
+		l.sock.inUse = false
+		sdSockets.Unlock()
+	})
+
+	return err
+}
@@ -0,0 +1,143 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * systemd integration test
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test systemd readiness, status and watchdog notifications
+func TestSdNotify(t *testing.T) {
+	backend, dev, cleanup := usbSimTestSetup(t)
+	defer cleanup()
+
+	// Create fake notify socket
+	path := filepath.Join(PathProgState, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram",
+		&net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", path)
+	os.Setenv("WATCHDOG_USEC", "100000")
+	defer func() {
+		os.Unsetenv("NOTIFY_SOCKET")
+		os.Unsetenv("WATCHDOG_USEC")
+	}()
+
+	if d := SdWatchdogInterval(); d != 100*time.Millisecond {
+		t.Fatalf("SdWatchdogInterval: %s", d)
+	}
+
+	// Start PnP manager
+	exited := usbSimTestStartPnP()
+
+	// Collect notifications
+	var ready, status, watchdog bool
+	buf := make([]byte, 4096)
+	deadline := time.Now().Add(DevInitTimeout)
+
+	for !(ready && status && watchdog) {
+		conn.SetReadDeadline(deadline)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("notify: ready=%v status=%v watchdog=%v: %s",
+				ready, status, watchdog, err)
+		}
+
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			switch {
+			case line == "READY=1":
+				ready = true
+			case line == "STATUS=1 of 1 device(s) ready":
+				status = ready
+			case line == "WATCHDOG=1":
+				watchdog = true
+			case strings.HasPrefix(line, "STATUS="):
+			default:
+				t.Fatalf("notify: unexpected %q", line)
+			}
+		}
+	}
+
+	backend.Remove(dev.UsbAddr)
+	<-exited
+}
+
+// Test HTTP listening sockets, passed by systemd
+func TestSdListen(t *testing.T) {
+	backend, dev, cleanup := usbSimTestSetup(t)
+	defer cleanup()
+
+	// Pass listening socket, as systemd would do
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %s", err)
+	}
+
+	port := l.Addr().(*net.TCPAddr).Port
+	file, err := l.(*net.TCPListener).File()
+	l.Close()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	err = sdAddSocket("ipp-usb.socket", file)
+	if err != nil {
+		t.Fatalf("sdAddSocket: %s", err)
+	}
+
+	defer func() {
+		sdSockets.Lock()
+		for _, sock := range sdSockets.list {
+			sock.listener.Close()
+		}
+		sdSockets.list = nil
+		sdSockets.Unlock()
+	}()
+
+	// Start PnP manager and wait until device is ready
+	exited := usbSimTestStartPnP()
+	st := usbSimTestWaitReady(t)
+
+	if st.HTTPPort != port {
+		t.Fatalf("HTTP port: expected %d, present %d", port, st.HTTPPort)
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/", port))
+	if err != nil {
+		t.Fatalf("GET /: %s", err)
+	}
+	resp.Body.Close()
+
+	if !sdPortPassed(port) {
+		t.Fatalf("sdPortPassed(%d): false", port)
+	}
+
+	backend.Remove(dev.UsbAddr)
+	<-exited
+
+	// Socket must be returned to the pool
+	sdSockets.Lock()
+	inUse := sdSockets.list[0].inUse
+	sdSockets.Unlock()
+
+	if inUse {
+		t.Fatalf("socket still in use after device removal")
+	}
+}
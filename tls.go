@@ -0,0 +1,299 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * TLS (IPPS/HTTPS) support
+ */
+
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// TLSConfig returns TLS configuration for the device
+//
+// If certificate and key files are configured, they are
+// used for all devices. Otherwise, self-signed certificate
+// is generated on first use per device and saved next to
+// the device state
+func TLSConfig(state *DevState, name string) (*tls.Config, error) {
+	var cert tls.Certificate
+	var err error
+
+	if conf := Conf(); conf.TLSCertFile != "" {
+		cert, err = tls.LoadX509KeyPair(conf.TLSCertFile, conf.TLSKeyFile)
+	} else {
+		cert, err = tlsDevCert(state, name)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("TLS: %s", err)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	return config, nil
+}
+
+// tlsDevCert loads device certificate, generating it, if needed
+func tlsDevCert(state *DevState, name string) (tls.Certificate, error) {
+	path := filepath.Join(PathProgStateDev, state.Ident+".pem")
+
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		cert, err := tls.X509KeyPair(data, data)
+		if err == nil && tlsCertValid(cert) {
+			return cert, nil
+		}
+	}
+
+	data, err = tlsGenerateCert(name)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	os.MkdirAll(PathProgStateDev, 0755)
+	err = ioutil.WriteFile(path, data, 0600)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	Log.Info(' ', "TLS: %s: certificate generated", state.Ident)
+
+	return tls.X509KeyPair(data, data)
+}
+
+// tlsCertValid checks that certificate is not expired
+func tlsCertValid(cert tls.Certificate) bool {
+	x509cert, err := x509.ParseCertificate(cert.Certificate[0])
+	return err == nil && time.Now().Before(x509cert.NotAfter)
+}
+
+// tlsGenerateCert generates self-signed certificate and returns
+// it, followed by its private key, in PEM format
+//
+// Certificate is valid for the local host name, its .local
+// (mDNS) variant and for the loopback addresses
+func tlsGenerateCert(name string) ([]byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := []string{"localhost"}
+	if host, err := os.Hostname(); err == nil && host != "" {
+		host = strings.TrimSuffix(host, ".local")
+		hosts = append(hosts, host, host+".local")
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(TLSCertLifetime),
+		KeyUsage: x509.KeyUsageDigitalSignature |
+			x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              hosts,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template,
+		&key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	keyder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	data = append(data, pem.EncodeToMemory(
+		&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyder})...)
+
+	return data, nil
+}
+
+// TLSServices returns DNS-SD services, extended with secure
+// variants of IPP and eSCL services (_ipps._tcp and _uscans._tcp),
+// advertised on the same port
+func TLSServices(services DNSSdServices) DNSSdServices {
+	secure := map[string]string{
+		"_ipp._tcp":   "_ipps._tcp",
+		"_uscan._tcp": "_uscans._tcp",
+	}
+
+	out := services
+	for _, svc := range services {
+		svcType, ok := secure[svc.Type]
+		if !ok {
+			continue
+		}
+
+		var subTypes []string
+		for _, sub := range svc.SubTypes {
+			sub = strings.TrimSuffix(sub, svc.Type) + svcType
+			subTypes = append(subTypes, sub)
+		}
+
+		txt := append(DNSSdTxtRecord(nil), svc.Txt...)
+		txt.Add("TLS", "1.2")
+
+		out.Add(DNSSdSvcInfo{
+			Type:     svcType,
+			SubTypes: subTypes,
+			Port:     svc.Port,
+			Txt:      txt,
+		})
+	}
+
+	return out
+}
+
+// tlsSniffListener wraps net.Listener and accepts both plain
+// and TLS connections on the same port. Protocol is detected
+// by the first byte, sent by client
+//
+// Protocol detection requires reading from connection, so it
+// is performed in background, to avoid blocking Accept by slow
+// clients
+//
+// Temporary Accept errors of the underlying listener (i.e., EMFILE)
+// are retried with backoff, as http.Server does. Permanent error
+// terminates the listener
+type tlsSniffListener struct {
+	net.Listener               // Underlying net.Listener
+	config       *tls.Config   // TLS configuration
+	conns        chan net.Conn // Connections with detected protocol
+	done         chan struct{} // Closed when listener failed
+	err          error         // Listener error
+}
+
+// NewTLSSniffListener creates new listener, that accepts both
+// plain and TLS connections
+func NewTLSSniffListener(listener net.Listener,
+	config *tls.Config) net.Listener {
+
+	l := &tlsSniffListener{
+		Listener: listener,
+		config:   config,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+
+	go l.acceptLoop()
+
+	return l
+}
+
+// Accept new connection
+func (l *tlsSniffListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+// acceptLoop accepts incoming connections
+func (l *tlsSniffListener) acceptLoop() {
+	var delay time.Duration
+
+	for {
+		conn, err := l.Listener.Accept()
+		if ne, ok := err.(net.Error); ok && ne.Temporary() {
+			if delay == 0 {
+				delay = TLSAcceptRetryMin
+			} else {
+				delay *= 2
+			}
+
+			if delay > TLSAcceptRetryMax {
+				delay = TLSAcceptRetryMax
+			}
+
+			time.Sleep(delay)
+			continue
+		}
+
+		delay = 0
+
+		if err != nil {
+			l.err = err
+			close(l.done)
+			return
+		}
+
+		go l.sniff(conn)
+	}
+}
+
+// sniff detects protocol of the incoming connection
+func (l *tlsSniffListener) sniff(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+
+	conn.SetReadDeadline(time.Now().Add(TLSSniffTimeout))
+	hdr, err := reader.Peek(1)
+	conn.SetReadDeadline(time.Time{})
+
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	conn = &tlsSniffConn{conn, reader}
+
+	// 0x16 is the TLS handshake record type. Plain HTTP
+	// request always starts with a method name
+	if hdr[0] == 0x16 {
+		conn = tls.Server(conn, l.config)
+	}
+
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+// tlsSniffConn wraps net.Conn, returning data, consumed
+// during protocol detection, before the rest of data
+type tlsSniffConn struct {
+	net.Conn               // Underlying connection
+	reader   *bufio.Reader // Buffered reader
+}
+
+// Read from the connection
+func (c *tlsSniffConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
@@ -0,0 +1,152 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * TLS (IPPS/HTTPS) support test
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+// Test HTTPS and plain HTTP on the same device port
+func TestTLS(t *testing.T) {
+	backend, dev, cleanup := usbSimTestSetup(t)
+	defer cleanup()
+
+	defer confTestSet(func(conf *Configuration) { conf.TLSEnable = true })()
+
+	// Start PnP manager and wait until device is ready
+	exited := usbSimTestStartPnP()
+	st := usbSimTestWaitReady(t)
+
+	// Both HTTPS and plain HTTP must work on the same port
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+
+	for _, scheme := range []string{"https", "http"} {
+		url := fmt.Sprintf("%s://localhost:%d/", scheme, st.HTTPPort)
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatalf("GET %s: %s", url, err)
+		}
+		resp.Body.Close()
+
+		if (resp.TLS != nil) != (scheme == "https") {
+			t.Fatalf("GET %s: TLS=%v", url, resp.TLS != nil)
+		}
+	}
+
+	// Secure services must be advertised with TLS TXT key
+	secure := make(map[string]bool)
+	for _, svc := range st.Services {
+		for _, txt := range svc.Txt {
+			if txt.Key == "TLS" && txt.Value == "1.2" {
+				secure[svc.Type] = true
+			}
+		}
+	}
+
+	if !secure["_ipps._tcp"] {
+		t.Fatalf("secure services: %v", secure)
+	}
+
+	backend.Remove(dev.UsbAddr)
+	<-exited
+
+	// Generated certificate must be saved and reused
+	state := &DevState{Ident: st.Ident}
+	path := filepath.Join(PathProgStateDev, state.Ident+".pem")
+	saved, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("certificate not saved: %s", err)
+	}
+
+	_, err = tlsDevCert(state, "test")
+	if err != nil {
+		t.Fatalf("tlsDevCert: %s", err)
+	}
+
+	if data, _ := ioutil.ReadFile(path); !bytes.Equal(data, saved) {
+		t.Fatalf("certificate regenerated")
+	}
+}
+
+// Test DNS-SD services, advertised for TLS
+func TestTLSServices(t *testing.T) {
+	var services DNSSdServices
+	services.Add(DNSSdSvcInfo{
+		Type:     "_ipp._tcp",
+		SubTypes: []string{"_universal._sub._ipp._tcp"},
+		Port:     60000,
+		Txt:      DNSSdTxtRecord{{"rp", "ipp/print", false}},
+	})
+	services.Add(DNSSdSvcInfo{Type: "_uscan._tcp", Port: 60000})
+	services.Add(DNSSdSvcInfo{Type: "_http._tcp", Port: 60000})
+
+	services = TLSServices(services)
+	if len(services) != 5 {
+		t.Fatalf("TLSServices: %d services, expected 5", len(services))
+	}
+
+	ipps := services[3]
+	if ipps.Type != "_ipps._tcp" || ipps.Port != 60000 ||
+		len(ipps.SubTypes) != 1 ||
+		ipps.SubTypes[0] != "_universal._sub._ipps._tcp" ||
+		len(ipps.Txt) != 2 || ipps.Txt[1].Key != "TLS" {
+		t.Fatalf("TLSServices: bad _ipps._tcp: %+v", ipps)
+	}
+
+	// Original TXT record must not be affected
+	if len(services[0].Txt) != 1 {
+		t.Fatalf("TLSServices: _ipp._tcp modified: %+v", services[0])
+	}
+
+	if services[4].Type != "_uscans._tcp" {
+		t.Fatalf("TLSServices: bad _uscans._tcp: %+v", services[4])
+	}
+}
+
+// Test tlsSniffListener recovery from temporary Accept errors
+func TestTLSSniffListenerTempError(t *testing.T) {
+	nl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %s", err)
+	}
+
+	failing := &listenerTestFailing{Listener: nl}
+	l := NewTLSSniffListener(failing, &tls.Config{})
+	defer l.Close()
+
+	client, err := net.Dial("tcp", nl.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial: %s", err)
+	}
+	defer client.Close()
+
+	client.Write([]byte("GET / HTTP/1.1\r\n"))
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %s", err)
+	}
+	conn.Close()
+
+	if atomic.LoadInt32(&failing.failed) == 0 {
+		t.Fatalf("temporary error not simulated")
+	}
+}
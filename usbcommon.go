@@ -13,6 +13,7 @@ import (
 	"fmt"
 	"sort"
 	"strings"
+	"sync"
 )
 
 // UsbAddr represents an USB device address
@@ -26,6 +27,26 @@ func (addr UsbAddr) String() string {
 	return fmt.Sprintf("Bus %.3d Device %.3d", addr.Bus, addr.Address)
 }
 
+// ParseUsbAddr parses UsbAddr, represented either in
+// the "Bus BBB Device DDD" form, as returned by UsbAddr.String(),
+// or in the short "BBB:DDD" form
+func ParseUsbAddr(s string) (UsbAddr, error) {
+	var addr UsbAddr
+	var tail string
+
+	n, _ := fmt.Sscanf(s, "Bus %d Device %d%s",
+		&addr.Bus, &addr.Address, &tail)
+	if n != 2 {
+		n, _ = fmt.Sscanf(s, "%d:%d%s", &addr.Bus, &addr.Address, &tail)
+	}
+
+	if n != 2 || addr.Bus < 0 || addr.Address < 0 {
+		return UsbAddr{}, fmt.Errorf("invalid USB address %q", s)
+	}
+
+	return addr, nil
+}
+
 // Less returns true, if addr is "less" that addr2, for sorting
 func (addr UsbAddr) Less(addr2 UsbAddr) bool {
 	return addr.Bus < addr2.Bus ||
@@ -176,9 +197,12 @@ type UsbDeviceInfo struct {
 	SerialNumber string // Device serial number
 	Manufacturer string // Manufacturer name
 	ProductName  string // Product name
+	PortPath     string // USB port path (i.e., "1-2.3"), if available
 
 	// Precomputed fields
 	MfgAndProduct string // Product with Manufacturer prefix, if needed
+	IdentByPort   bool   // Ident() uses PortPath instead of SerialNumber
+	LegacyOwner   bool   // Device may inherit state saved by SerialIdent()
 }
 
 // Fix up precomputed fields
@@ -194,9 +218,19 @@ func (info *UsbDeviceInfo) FixUp() {
 
 // Ident returns device identification string, suitable as
 // persistent state identifier
+//
+// If info.IdentByPort is set, the physical USB port path is used
+// instead of the serial number
 func (info UsbDeviceInfo) Ident() string {
-	id := fmt.Sprintf("%4.4x-%4.4x-%s-%s",
-		info.Vendor, info.Product, info.SerialNumber, info.MfgAndProduct)
+	var id string
+
+	if info.IdentByPort {
+		id = fmt.Sprintf("%4.4x-%4.4x-port-%s-%s",
+			info.Vendor, info.Product, info.PortPath, info.MfgAndProduct)
+	} else {
+		id = fmt.Sprintf("%4.4x-%4.4x-%s-%s",
+			info.Vendor, info.Product, info.SerialNumber, info.MfgAndProduct)
+	}
 
 	id = strings.Map(func(c rune) rune {
 		switch {
@@ -212,6 +246,16 @@ func (info UsbDeviceInfo) Ident() string {
 	return id
 }
 
+// SerialIdent returns device identification string, based on
+// the serial number, regardless of info.IdentByPort
+//
+// Before identification by USB port was introduced, this
+// identifier was used for all devices
+func (info UsbDeviceInfo) SerialIdent() string {
+	info.IdentByPort = false
+	return info.Ident()
+}
+
 // DNSSdName generates device DNS-SD name in a case it is not available
 // from IPP or eSCL
 func (info UsbDeviceInfo) DNSSdName() string {
@@ -248,5 +292,102 @@ func (info UsbDeviceInfo) UUID() string {
 
 // Comment returns a short comment, describing a device
 func (info UsbDeviceInfo) Comment() string {
-	return info.MfgAndProduct + " serial=" + info.SerialNumber
+	comment := info.MfgAndProduct + " serial=" + info.SerialNumber
+	if info.IdentByPort {
+		comment += " port=" + info.PortPath
+	}
+	return comment
+}
+
+// usbIdents counts active devices by their identifiers
+var usbIdents = struct {
+	sync.Mutex
+	active map[string]int
+}{active: make(map[string]int)}
+
+// usbIdentAcquire chooses identification method for the device
+// and registers its identifier as used by the active device
+//
+// USB port path is used for identification, if device has no
+// serial number, or its serial number duplicates serial number
+// of some other attached device of the same model. Otherwise,
+// serial number is used
+//
+// The choice depends on the set of attached devices, not on order
+// in which they are initialized, so devices with the same serial
+// number keep their identity between restarts. Among such devices,
+// only the one with the lowest port path may inherit the legacy
+// state, saved under the serial number
+func usbIdentAcquire(addr UsbAddr, info *UsbDeviceInfo) {
+	var attached []UsbDeviceInfo
+	if info.PortPath != "" {
+		attached = usbIdentAttached(addr)
+	}
+
+	usbIdents.Lock()
+	defer usbIdents.Unlock()
+
+	serial := info.SerialIdent()
+
+	info.IdentByPort = false
+	info.LegacyOwner = info.PortPath != ""
+
+	if info.PortPath != "" {
+		info.IdentByPort = info.SerialNumber == "" ||
+			usbIdents.active[serial] > 0
+
+		for _, other := range attached {
+			if other.SerialIdent() == serial {
+				info.IdentByPort = true
+				if other.PortPath < info.PortPath {
+					info.LegacyOwner = false
+				}
+			}
+		}
+	}
+
+	usbIdents.active[info.Ident()]++
+}
+
+// usbIdentAttached returns UsbDeviceInfo of all attached
+// IPP-over-USB devices, except the device with the specified
+// address. Devices that cannot be opened are skipped
+func usbIdentAttached(addr UsbAddr) []UsbDeviceInfo {
+	descs, _ := UsbGetIppOverUsbDeviceDescs()
+
+	var attached []UsbDeviceInfo
+	for _, desc := range descs {
+		if desc.UsbAddr == addr {
+			continue
+		}
+
+		info, err := desc.GetUsbDeviceInfo()
+		if err == nil {
+			attached = append(attached, info)
+		}
+	}
+
+	return attached
+}
+
+// usbIdentRelease unregisters identifier, previously registered
+// by usbIdentAcquire
+func usbIdentRelease(info UsbDeviceInfo) {
+	usbIdents.Lock()
+	defer usbIdents.Unlock()
+
+	ident := info.Ident()
+	usbIdents.active[ident]--
+	if usbIdents.active[ident] <= 0 {
+		delete(usbIdents.active, ident)
+	}
+}
+
+// usbIdentInUse reports whether identifier is used by
+// some active device
+func usbIdentInUse(ident string) bool {
+	usbIdents.Lock()
+	defer usbIdents.Unlock()
+
+	return usbIdents.active[ident] > 0
 }
@@ -0,0 +1,120 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * USB low-level I/O. Pluggable backends
+ */
+
+package main
+
+import (
+	"time"
+)
+
+// UsbBackend represents the low-level USB I/O implementation
+//
+// By default, libusb-based backend is used. Other backends
+// (i.e., simulated devices for testing) may be installed
+// with UsbSetBackend
+type UsbBackend interface {
+	// Init initializes the backend
+	Init() error
+
+	// GetIppOverUsbDeviceDescs returns list of IPP-over-USB
+	// device descriptors
+	GetIppOverUsbDeviceDescs() (map[UsbAddr]UsbDeviceDesc, error)
+
+	// OpenDevice opens device by device descriptor
+	OpenDevice(desc UsbDeviceDesc) (UsbDevHandle, error)
+}
+
+// UsbDevHandle represents an opened USB device
+type UsbDevHandle interface {
+	// Configure prepares the device for further work. Quirks
+	// control, which interfaces are detached from kernel driver
+	Configure(desc UsbDeviceDesc, quirks QuirksList) error
+
+	// Close the device
+	Close()
+
+	// Reset the device. Note, after reset device may re-enumerate,
+	// and the handle becomes stale. UsbENotFound or UsbENoDev
+	// is returned at this case
+	Reset() error
+
+	// UsbDeviceInfo returns UsbDeviceInfo for the device
+	UsbDeviceInfo() (UsbDeviceInfo, error)
+
+	// OpenUsbInterface claims and opens an interface. Quirks
+	// may be used by backend to tune low-level I/O parameters
+	OpenUsbInterface(addr UsbIfAddr, quirks QuirksList) (UsbInterface, error)
+}
+
+// UsbInterface represents an opened IPP-over-USB interface
+type UsbInterface interface {
+	// Close the interface
+	Close()
+
+	// SoftReset performs interface soft reset, using
+	// class-specific SOFT_RESET request
+	SoftReset() error
+
+	// Send data to interface. Returns count of bytes actually
+	// transmitted and error, if any
+	Send(data []byte, timeout time.Duration) (n int, err error)
+
+	// Recv data from interface. Returns count of bytes actually
+	// transmitted and error, if any
+	Recv(data []byte, timeout time.Duration) (n int, err error)
+
+	// ClearHalt clears "halted" condition of either input
+	// or output endpoint
+	ClearHalt(in bool) error
+}
+
+var (
+	// usbBackend is the currently used UsbBackend
+	usbBackend UsbBackend = libusbBackend{}
+
+	// UsbHotPlugChan receives USB hotplug event notifications.
+	// It is buffered, so notifications are not lost while
+	// receiver is busy; multiple pending events are coalesced
+	UsbHotPlugChan = make(chan struct{}, 1)
+)
+
+// UsbSetBackend installs the UsbBackend. Must be called
+// before any other USB function is used
+func UsbSetBackend(backend UsbBackend) {
+	usbBackend = backend
+}
+
+// UsbInit initializes low-level USB I/O
+func UsbInit() error {
+	return usbBackend.Init()
+}
+
+// UsbCheckIppOverUsbDevices returns true if there are some IPP-over-USB devices
+func UsbCheckIppOverUsbDevices() bool {
+	descs, _ := UsbGetIppOverUsbDeviceDescs()
+	return len(descs) != 0
+}
+
+// UsbGetIppOverUsbDeviceDescs return list of IPP-over-USB
+// device descriptors
+func UsbGetIppOverUsbDeviceDescs() (map[UsbAddr]UsbDeviceDesc, error) {
+	return usbBackend.GetIppOverUsbDeviceDescs()
+}
+
+// UsbOpenDevice opens device by device descriptor
+func UsbOpenDevice(desc UsbDeviceDesc) (UsbDevHandle, error) {
+	return usbBackend.OpenDevice(desc)
+}
+
+// usbHotPlugNotify sends notification to the UsbHotPlugChan
+func usbHotPlugNotify() {
+	select {
+	case UsbHotPlugChan <- struct{}{}:
+	default:
+	}
+}
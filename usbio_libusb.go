@@ -10,6 +10,7 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -17,11 +18,14 @@ import (
 )
 
 // #cgo pkg-config: libusb-1.0
+// #include <stdlib.h>
 // #include <libusb.h>
 //
 // int libusbHotplugCallback (libusb_context *ctx, libusb_device *device,
 //     libusb_hotplug_event event, void *user_data);
 //
+// void libusbTransferCallback (struct libusb_transfer *transfer);
+//
 // typedef struct libusb_device_descriptor libusb_device_descriptor_struct;
 // typedef struct libusb_config_descriptor libusb_config_descriptor_struct;
 // typedef struct libusb_interface libusb_interface_struct;
@@ -85,13 +89,13 @@ var (
 
 	// Nonzero, if libusbContextPtr initialized
 	libusbContextOk int32
-
-	// UsbHotPlugChan receives USB hotplug event notifications
-	UsbHotPlugChan = make(chan struct{})
 )
 
-// Initialize low-level USB I/O
-func UsbInit() error {
+// libusbBackend implements UsbBackend on a top of libusb
+type libusbBackend struct{}
+
+// Init initializes low-level USB I/O
+func (libusbBackend) Init() error {
 	_, err := libusbContext()
 	return err
 }
@@ -155,23 +159,15 @@ func libusbHotplugCallback(ctx *C.libusb_context, dev *C.libusb_device,
 		Log.Debug('-', "HOTPLUG: removed %s", usbaddr)
 	}
 
-	select {
-	case UsbHotPlugChan <- struct{}{}:
-	default:
-	}
+	usbHotPlugNotify()
 
 	return 0
 }
 
-// UsbCheckIppOverUsbDevices returns true if there are some IPP-over-USB devices
-func UsbCheckIppOverUsbDevices() bool {
-	descs, _ := UsbGetIppOverUsbDeviceDescs()
-	return len(descs) != 0
-}
-
-// UsbGetIppOverUsbDeviceDescs return list of IPP-over-USB
+// GetIppOverUsbDeviceDescs return list of IPP-over-USB
 // device descriptors
-func UsbGetIppOverUsbDeviceDescs() (map[UsbAddr]UsbDeviceDesc, error) {
+func (libusbBackend) GetIppOverUsbDeviceDescs() (
+	map[UsbAddr]UsbDeviceDesc, error) {
 	// Obtain libusb context
 	ctx, err := libusbContext()
 	if err != nil {
@@ -298,11 +294,11 @@ func libusbBuildUsbDeviceDesc(dev *C.libusb_device) (UsbDeviceDesc, error) {
 	return desc, nil
 }
 
-// UsbDevHandle represents libusb_device_handle
-type UsbDevHandle C.libusb_device_handle
+// libusbDevHandle represents libusb_device_handle
+type libusbDevHandle C.libusb_device_handle
 
-// UsbOpenDevice opens device by device descriptor
-func UsbOpenDevice(desc UsbDeviceDesc) (*UsbDevHandle, error) {
+// OpenDevice opens device by device descriptor
+func (libusbBackend) OpenDevice(desc UsbDeviceDesc) (UsbDevHandle, error) {
 	// Obtain libusb context
 	ctx, err := libusbContext()
 	if err != nil {
@@ -333,7 +329,7 @@ func UsbOpenDevice(desc UsbDeviceDesc) (*UsbDevHandle, error) {
 				return nil, UsbError{"libusb_open", UsbErrCode(rc)}
 			}
 
-			return (*UsbDevHandle)(devhandle), nil
+			return (*libusbDevHandle)(devhandle), nil
 		}
 	}
 
@@ -343,9 +339,35 @@ func UsbOpenDevice(desc UsbDeviceDesc) (*UsbDevHandle, error) {
 // Configure prepares the device for further work:
 //   - set proper USB configuration
 //   - detach kernel driver
-func (devhandle *UsbDevHandle) Configure(desc UsbDeviceDesc) error {
+//
+// If quirks.UsbDetachIppOnly() is true and the proper configuration
+// is already set, kernel driver is not detached here. Instead, it
+// is automatically detached by libusb only from interfaces being
+// claimed, so the legacy printer interface remains available to
+// the usblp driver
+func (devhandle *libusbDevHandle) Configure(desc UsbDeviceDesc,
+	quirks QuirksList) error {
+
+	if quirks.UsbDetachIppOnly() {
+		C.libusb_set_auto_detach_kernel_driver(
+			(*C.libusb_device_handle)(devhandle), 1)
+
+		var config C.int
+		rc := C.libusb_get_configuration(
+			(*C.libusb_device_handle)(devhandle), &config)
+
+		if rc == 0 && int(config) == desc.Config {
+			return nil
+		}
+
+		// Configuration needs to be changed, and it requires
+		// all interfaces to be released by kernel. After that,
+		// kernel will bind its drivers to interfaces of the new
+		// configuration by itself
+	}
+
 	// Detach kernel driver
-	err := (*UsbDevHandle)(devhandle).detachKernelDriver()
+	err := devhandle.detachKernelDriver()
 	if err != nil {
 		return err
 	}
@@ -358,15 +380,12 @@ func (devhandle *UsbDevHandle) Configure(desc UsbDeviceDesc) error {
 		return UsbError{"libusb_set_configuration", UsbErrCode(rc)}
 	}
 
-	// Printer may require some time to switch configuration
-	time.Sleep(time.Second / 4)
-
 	return nil
 }
 
 // detachKernelDriver detaches kernel driver from all interfaces
 // of current configuration
-func (devhandle *UsbDevHandle) detachKernelDriver() error {
+func (devhandle *libusbDevHandle) detachKernelDriver() error {
 	C.libusb_set_auto_detach_kernel_driver(
 		(*C.libusb_device_handle)(devhandle), 1)
 
@@ -390,8 +409,8 @@ func (devhandle *UsbDevHandle) detachKernelDriver() error {
 	return nil
 }
 
-// libusbCurrentInterfaces builds list of interfaces in current configuration
-func (devhandle *UsbDevHandle) currentInterfaces() ([]int, error) {
+// currentInterfaces builds list of interfaces in current configuration
+func (devhandle *libusbDevHandle) currentInterfaces() ([]int, error) {
 	dev := C.libusb_get_device((*C.libusb_device_handle)(devhandle))
 
 	// Obtain device descriptor
@@ -447,17 +466,46 @@ func (devhandle *UsbDevHandle) currentInterfaces() ([]int, error) {
 }
 
 // Close a device
-func (devhandle *UsbDevHandle) Close() {
+//
+// Kernel driver is re-attached to all interfaces of the current
+// configuration, so device returns to its original state
+func (devhandle *libusbDevHandle) Close() {
+	devhandle.attachKernelDriver()
 	C.libusb_close((*C.libusb_device_handle)(devhandle))
 }
 
+// attachKernelDriver attaches kernel driver to all interfaces
+// of current configuration
+//
+// Errors are ignored here: interface may have no kernel driver,
+// driver may be already attached or device may be already gone
+func (devhandle *libusbDevHandle) attachKernelDriver() {
+	ifnums, err := devhandle.currentInterfaces()
+	if err != nil {
+		return
+	}
+
+	for _, ifnum := range ifnums {
+		C.libusb_attach_kernel_driver(
+			(*C.libusb_device_handle)(devhandle), C.int(ifnum))
+	}
+}
+
 // Reset a device
-func (devhandle *UsbDevHandle) Reset() {
-	C.libusb_reset_device((*C.libusb_device_handle)(devhandle))
+//
+// libusb returns LIBUSB_ERROR_NOT_FOUND, if re-enumeration is
+// required or device has been disconnected
+func (devhandle *libusbDevHandle) Reset() error {
+	rc := C.libusb_reset_device((*C.libusb_device_handle)(devhandle))
+	if rc < 0 {
+		return UsbError{"libusb_reset_device", UsbErrCode(rc)}
+	}
+
+	return nil
 }
 
 // UsbDeviceInfo returns UsbDeviceInfo for the device
-func (devhandle *UsbDevHandle) UsbDeviceInfo() (UsbDeviceInfo, error) {
+func (devhandle *libusbDevHandle) UsbDeviceInfo() (UsbDeviceInfo, error) {
 	dev := C.libusb_get_device((*C.libusb_device_handle)(devhandle))
 
 	var c_desc C.libusb_device_descriptor_struct
@@ -497,14 +545,34 @@ func (devhandle *UsbDevHandle) UsbDeviceInfo() (UsbDeviceInfo, error) {
 		}
 	}
 
+	info.PortPath = libusbPortPath(dev)
 	info.FixUp()
 
 	return info, nil
 }
 
+// libusbPortPath returns USB port path of the device, in the
+// same form as used by Linux sysfs (i.e., "1-2.3"), or empty
+// string, if port path is not available
+func libusbPortPath(dev *C.libusb_device) string {
+	var ports [7]C.uint8_t
+
+	cnt := C.libusb_get_port_numbers(dev, &ports[0], C.int(len(ports)))
+	if cnt <= 0 {
+		return ""
+	}
+
+	path := fmt.Sprintf("%d-%d", C.libusb_get_bus_number(dev), ports[0])
+	for _, port := range ports[1:cnt] {
+		path += fmt.Sprintf(".%d", port)
+	}
+
+	return path
+}
+
 // OpenUsbInterface opens an interface
-func (devhandle *UsbDevHandle) OpenUsbInterface(addr UsbIfAddr) (
-	*UsbInterface, error) {
+func (devhandle *libusbDevHandle) OpenUsbInterface(addr UsbIfAddr,
+	quirks QuirksList) (UsbInterface, error) {
 
 	// Claim the interface
 	rc := C.libusb_claim_interface(
@@ -530,20 +598,43 @@ func (devhandle *UsbDevHandle) OpenUsbInterface(addr UsbIfAddr) (
 		return nil, UsbError{"libusb_set_interface_alt_setting", UsbErrCode(rc)}
 	}
 
-	return &UsbInterface{
+	// Create transfer pipes
+	iface := &libusbInterface{
 		devhandle: devhandle,
 		addr:      addr,
-	}, nil
+	}
+
+	size, depth := quirks.UsbTransferSize(), quirks.UsbQueueDepth()
+
+	iface.in = newLibusbPipe(iface,
+		C.uchar(addr.In|C.LIBUSB_ENDPOINT_IN), size, depth)
+	iface.out = newLibusbPipe(iface,
+		C.uchar(addr.Out|C.LIBUSB_ENDPOINT_OUT), size, depth)
+
+	// Start reception
+	for _, xfer := range iface.in.xfers {
+		err := iface.in.submit(xfer, size, 0)
+		if err != nil {
+			iface.Close()
+			return nil, err
+		}
+	}
+
+	return iface, nil
 }
 
-// UsbInterface represents IPP-over-USB interface
-type UsbInterface struct {
-	devhandle *UsbDevHandle // Device handle
-	addr      UsbIfAddr     // Interface address
+// libusbInterface represents IPP-over-USB interface
+type libusbInterface struct {
+	devhandle *libusbDevHandle // Device handle
+	addr      UsbIfAddr        // Interface address
+	in, out   *libusbPipe      // Input and output pipes
 }
 
 // Close the interface
-func (iface *UsbInterface) Close() {
+func (iface *libusbInterface) Close() {
+	iface.in.close()
+	iface.out.close()
+
 	C.libusb_release_interface(
 		(*C.libusb_device_handle)(iface.devhandle),
 		C.int(iface.addr.Num),
@@ -561,7 +652,7 @@ func (iface *UsbInterface) Close() {
 //    is actually done is that all buffers get flushed and the bulk IN and OUT
 //    pipes get reset to their default states. This clears all stall conditions.
 //    See http://cholla.mmto.org/computers/linux/usb/usbprint11.pdf
-func (iface *UsbInterface) SoftReset() error {
+func (iface *libusbInterface) SoftReset() error {
 	rc := C.libusb_control_transfer(
 		(*C.libusb_device_handle)(iface.devhandle),
 		C.LIBUSB_REQUEST_TYPE_CLASS|
@@ -587,24 +678,46 @@ func (iface *UsbInterface) SoftReset() error {
 
 // Send data to interface. Returns count of bytes actually transmitted
 // and error, if any
-func (iface *UsbInterface) Send(data []byte,
+//
+// Data is split into transfers of the configured size, and up to
+// the configured number of transfers is kept in flight. Send returns
+// as soon as all data is queued, so errors of the last transfers
+// are reported by the subsequent Send or Recv
+//
+// Timeout limits the time of waiting for a free transfer. Queued
+// data is never discarded due to timeout
+func (iface *libusbInterface) Send(data []byte,
 	timeout time.Duration) (n int, err error) {
 
-	var transferred C.int
+	pipe := iface.out
+	err = pipe.enter()
+	if err != nil {
+		return
+	}
+	defer pipe.leave()
 
-	rc := C.libusb_bulk_transfer(
-		(*C.libusb_device_handle)(iface.devhandle),
-		C.uint8_t(iface.addr.Out|C.LIBUSB_ENDPOINT_OUT),
-		(*C.uchar)(unsafe.Pointer(&data[0])),
-		C.int(len(data)),
-		&transferred,
-		C.uint(timeout/time.Millisecond),
-	)
+	timer := libusbTimer(timeout)
+	if timer != nil {
+		defer timer.Stop()
+	}
 
-	if rc < 0 {
-		err = UsbError{"libusb_bulk_transfer", UsbErrCode(rc)}
+	for len(data) > 0 {
+		var xfer *libusbTransfer
+		xfer, err = iface.wait(pipe, timer)
+		if err != nil {
+			return
+		}
+
+		sz := copy(xfer.buf, data)
+		err = pipe.submit(xfer, sz, 0)
+		if err != nil {
+			pipe.queue <- xfer
+			return
+		}
+
+		n += sz
+		data = data[sz:]
 	}
-	n = int(transferred)
 
 	return
 }
@@ -612,47 +725,115 @@ func (iface *UsbInterface) Send(data []byte,
 // Recv data from interface. Returns count of bytes actually transmitted
 // and error, if any
 //
-// Note, if data size is not 512-byte aligned, and device has more data,
-// that fits the provided buffer, LIBUSB_ERROR_OVERFLOW error may occur
-func (iface *UsbInterface) Recv(data []byte,
+// Received data comes from the queue of transfers, submitted in
+// advance, so there is always some transfers in flight, and device
+// never waits for the host
+func (iface *libusbInterface) Recv(data []byte,
 	timeout time.Duration) (n int, err error) {
 
-	var transferred C.int
+	pipe := iface.in
+	err = pipe.enter()
+	if err != nil {
+		return
+	}
+	defer pipe.leave()
 
-	// Some versions of Linux kernel don't allow bulk transfers to
-	// be larger that 16kb per URB, and libusb uses some smart-ass
-	// mechanism to avoid this limitation.
-	//
-	// This mechanism seems not to work very reliable on Raspberry Pi
-	// (see #3 for details). So just limit bulk reads to 16kb
-	const MAX_BULK_READ = 16384
-	if len(data) > MAX_BULK_READ {
-		data = data[0:MAX_BULK_READ]
+	timer := libusbTimer(timeout)
+	if timer != nil {
+		defer timer.Stop()
 	}
 
-	rc := C.libusb_bulk_transfer(
-		(*C.libusb_device_handle)(iface.devhandle),
-		C.uint8_t(iface.addr.In|C.LIBUSB_ENDPOINT_IN),
-		(*C.uchar)(unsafe.Pointer(&data[0])),
-		C.int(len(data)),
-		&transferred,
-		C.uint(timeout/time.Millisecond),
-	)
+	// Wait for the next completed transfer, if needed
+	for pipe.cur == nil {
+		var xfer *libusbTransfer
+		xfer, err = iface.wait(pipe, timer)
+		if err != nil {
+			return
+		}
+
+		err = xfer.error()
+		switch {
+		case err != nil:
+			if xfer.xfer.status == C.LIBUSB_TRANSFER_STALL {
+				iface.ClearHalt(true)
+			}
+
+			// Cancelled transfer must not be resubmitted:
+			// pipe is being closed
+			switch xfer.xfer.status {
+			case C.LIBUSB_TRANSFER_NO_DEVICE, C.LIBUSB_TRANSFER_CANCELLED:
+			default:
+				pipe.submit(xfer, len(xfer.buf), 0)
+			}
+
+			return
+
+		case xfer.xfer.actual_length == 0:
+			// Zero-length packet; just resubmit the transfer
+			err = pipe.submit(xfer, len(xfer.buf), 0)
+			if err != nil {
+				return
+			}
 
-	if rc == C.LIBUSB_ERROR_PIPE {
-		iface.ClearHalt(true)
+		default:
+			xfer.off = 0
+			pipe.cur = xfer
+		}
 	}
 
-	if rc < 0 {
-		err = UsbError{"libusb_bulk_transfer", UsbErrCode(rc)}
+	// Consume received data
+	xfer := pipe.cur
+	n = copy(data, xfer.buf[xfer.off:xfer.xfer.actual_length])
+	xfer.off += n
+
+	// Note, if transfer cannot be resubmitted, error will be
+	// reported later, when there will be no more transfers
+	// in flight
+	if xfer.off == int(xfer.xfer.actual_length) {
+		pipe.cur = nil
+		pipe.submit(xfer, len(xfer.buf), 0)
 	}
-	n = int(transferred)
 
 	return
 }
 
+// wait waits until the next transfer is available in the pipe's
+// queue. Transfer errors of the output pipe are reported here
+func (iface *libusbInterface) wait(pipe *libusbPipe,
+	timer *time.Timer) (*libusbTransfer, error) {
+
+	var expired <-chan time.Time
+	if timer != nil {
+		expired = timer.C
+	}
+
+	for {
+		// Check for pending output error
+		if err := iface.out.takeError(); err != nil {
+			return nil, err
+		}
+
+		// If input transfers were not resubmitted because
+		// of errors, and there is nothing else in flight,
+		// it is time to give up
+		if pipe == iface.in && len(pipe.queue) == 0 &&
+			atomic.LoadInt32(&pipe.busy) == 0 {
+			return nil, UsbError{"libusb_submit_transfer", UsbENoDev}
+		}
+
+		// Wait for transfer
+		select {
+		case xfer := <-pipe.queue:
+			return xfer, nil
+		case <-iface.out.failed:
+		case <-expired:
+			return nil, UsbError{"libusb_handle_events", UsbETimeout}
+		}
+	}
+}
+
 // Clear "halted" condition of either input or output  endpoint
-func (iface *UsbInterface) ClearHalt(in bool) error {
+func (iface *libusbInterface) ClearHalt(in bool) error {
 	var ep C.uint8_t
 
 	if in {
@@ -671,3 +852,266 @@ func (iface *UsbInterface) ClearHalt(in bool) error {
 
 	return nil
 }
+
+// libusbTransfer represents asynchronous bulk transfer
+type libusbTransfer struct {
+	pipe *libusbPipe               // Pipe that owns the transfer
+	xfer *C.struct_libusb_transfer // Underlying libusb_transfer
+	buf  []byte                    // Transfer buffer (C memory)
+	off  int                       // Consumed bytes (IN only)
+}
+
+// libusbPipe represents a queue of asynchronous bulk transfers
+// for the single endpoint
+//
+// Completed transfers are returned to the queue channel. For
+// the output pipe it is also the queue of idle transfers
+type libusbPipe struct {
+	iface    *libusbInterface     // Interface that owns the pipe
+	ep       C.uchar              // Endpoint address
+	xfers    []*libusbTransfer    // All transfers
+	queue    chan *libusbTransfer // Completed transfers
+	cur      *libusbTransfer      // Partially consumed transfer (IN only)
+	busy     int32                // Count of transfers in flight
+	inflight sync.WaitGroup       // Transfers in flight, for close
+	users    sync.WaitGroup       // Send/Recv in progress, for close
+	closed   bool                 // Pipe is closed, don't submit
+	closing  sync.Mutex           // Serializes submit, enter and close
+	lock     sync.Mutex           // Protects err
+	err      error                // Pending output error
+	failed   chan struct{}        // Signalled on output error
+}
+
+var (
+	// libusbTransferMap maps libusb_transfer to libusbTransfer
+	libusbTransferMap = make(map[*C.struct_libusb_transfer]*libusbTransfer)
+
+	// libusbTransferMapLock protects libusbTransferMap
+	libusbTransferMapLock sync.Mutex
+)
+
+// newLibusbPipe creates a new libusbPipe
+func newLibusbPipe(iface *libusbInterface, ep C.uchar,
+	size, depth int) *libusbPipe {
+
+	pipe := &libusbPipe{
+		iface:  iface,
+		ep:     ep,
+		queue:  make(chan *libusbTransfer, depth),
+		failed: make(chan struct{}, 1),
+	}
+
+	libusbTransferMapLock.Lock()
+	defer libusbTransferMapLock.Unlock()
+
+	for i := 0; i < depth; i++ {
+		p := C.malloc(C.size_t(size))
+		xfer := &libusbTransfer{
+			pipe: pipe,
+			xfer: C.libusb_alloc_transfer(0),
+			buf:  (*[1 << 30]byte)(p)[:size:size],
+		}
+
+		// Note, transfer is filled in advance, so it is safe
+		// to cancel it, even if it was never submitted
+		pipe.fill(xfer, size, 0)
+
+		pipe.xfers = append(pipe.xfers, xfer)
+		libusbTransferMap[xfer.xfer] = xfer
+
+		if ep&C.LIBUSB_ENDPOINT_IN == 0 {
+			pipe.queue <- xfer
+		}
+	}
+
+	return pipe
+}
+
+// close cancels all transfers in flight, waits for their
+// completion and releases all resources
+//
+// Send and Recv, running concurrently, are woken up by the
+// cancelled transfers, and close waits until they return, so
+// transfers are not freed while used
+func (pipe *libusbPipe) close() {
+	// Prevent new submissions and I/O. Transfers, submitted
+	// before, are cancelled below
+	pipe.closing.Lock()
+	pipe.closed = true
+	pipe.closing.Unlock()
+
+	for _, xfer := range pipe.xfers {
+		C.libusb_cancel_transfer(xfer.xfer)
+	}
+
+	pipe.users.Wait()
+	pipe.inflight.Wait()
+
+	libusbTransferMapLock.Lock()
+	defer libusbTransferMapLock.Unlock()
+
+	for _, xfer := range pipe.xfers {
+		delete(libusbTransferMap, xfer.xfer)
+		C.free(unsafe.Pointer(&xfer.buf[0]))
+		C.libusb_free_transfer(xfer.xfer)
+	}
+
+	pipe.xfers = nil
+}
+
+// enter registers Send or Recv in progress. It fails, if pipe
+// is closed. Successful enter must be paired with leave
+func (pipe *libusbPipe) enter() error {
+	pipe.closing.Lock()
+	defer pipe.closing.Unlock()
+
+	if pipe.closed {
+		return UsbError{"libusb_submit_transfer", UsbEIntr}
+	}
+
+	pipe.users.Add(1)
+	return nil
+}
+
+// leave unregisters Send or Recv, registered by enter
+func (pipe *libusbPipe) leave() {
+	pipe.users.Done()
+}
+
+// submit submits the transfer
+//
+// Once pipe is closed, transfers are not submitted anymore,
+// so close doesn't free transfers in flight
+func (pipe *libusbPipe) submit(xfer *libusbTransfer, length int,
+	timeout time.Duration) error {
+
+	pipe.closing.Lock()
+	defer pipe.closing.Unlock()
+
+	if pipe.closed {
+		return UsbError{"libusb_submit_transfer", UsbEIntr}
+	}
+
+	pipe.fill(xfer, length, timeout)
+
+	pipe.inflight.Add(1)
+	atomic.AddInt32(&pipe.busy, 1)
+
+	rc := C.libusb_submit_transfer(xfer.xfer)
+	if rc < 0 {
+		atomic.AddInt32(&pipe.busy, -1)
+		pipe.inflight.Done()
+		return UsbError{"libusb_submit_transfer", UsbErrCode(rc)}
+	}
+
+	return nil
+}
+
+// fill fills the transfer
+func (pipe *libusbPipe) fill(xfer *libusbTransfer, length int,
+	timeout time.Duration) {
+
+	// Note, zero timeout means "wait forever" for libusb,
+	// so don't round small timeouts down to zero
+	ms := C.uint(timeout / time.Millisecond)
+	if ms == 0 && timeout > 0 {
+		ms = 1
+	}
+
+	C.libusb_fill_bulk_transfer(
+		xfer.xfer,
+		(*C.libusb_device_handle)(pipe.iface.devhandle),
+		pipe.ep,
+		(*C.uchar)(unsafe.Pointer(&xfer.buf[0])),
+		C.int(length),
+		C.libusb_transfer_cb_fn(unsafe.Pointer(C.libusbTransferCallback)),
+		nil,
+		ms,
+	)
+}
+
+// setError sets pending output error
+func (pipe *libusbPipe) setError(err error) {
+	pipe.lock.Lock()
+	if pipe.err == nil {
+		pipe.err = err
+	}
+	pipe.lock.Unlock()
+
+	select {
+	case pipe.failed <- struct{}{}:
+	default:
+	}
+}
+
+// takeError returns and resets pending output error
+func (pipe *libusbPipe) takeError() error {
+	pipe.lock.Lock()
+	err := pipe.err
+	pipe.err = nil
+	pipe.lock.Unlock()
+
+	return err
+}
+
+// error returns transfer completion error, if any
+func (xfer *libusbTransfer) error() error {
+	var code UsbErrCode
+
+	switch xfer.xfer.status {
+	case C.LIBUSB_TRANSFER_COMPLETED:
+		return nil
+	case C.LIBUSB_TRANSFER_TIMED_OUT:
+		code = UsbETimeout
+	case C.LIBUSB_TRANSFER_CANCELLED:
+		code = UsbEIntr
+	case C.LIBUSB_TRANSFER_STALL:
+		code = UsbEPipe
+	case C.LIBUSB_TRANSFER_NO_DEVICE:
+		code = UsbENoDev
+	case C.LIBUSB_TRANSFER_OVERFLOW:
+		code = UsbEOverflow
+	default:
+		code = UsbIO
+	}
+
+	return UsbError{"libusb_submit_transfer", code}
+}
+
+// Called by libusb on transfer completion
+//
+//export libusbTransferCallback
+func libusbTransferCallback(p *C.struct_libusb_transfer) {
+	libusbTransferMapLock.Lock()
+	xfer := libusbTransferMap[p]
+	libusbTransferMapLock.Unlock()
+
+	if xfer == nil {
+		return
+	}
+
+	pipe := xfer.pipe
+	if pipe == pipe.iface.out {
+		err := xfer.error()
+		if err == nil && p.actual_length != p.length {
+			err = UsbError{"libusb_submit_transfer", UsbIO}
+		}
+
+		if err != nil {
+			pipe.setError(err)
+		}
+	}
+
+	pipe.queue <- xfer
+	atomic.AddInt32(&pipe.busy, -1)
+	pipe.inflight.Done()
+}
+
+// libusbTimer creates a timer for the Send/Recv timeout. Zero
+// timeout means "wait forever", and nil timer is returned
+func libusbTimer(timeout time.Duration) *time.Timer {
+	if timeout <= 0 {
+		return nil
+	}
+	return time.NewTimer(timeout)
+}
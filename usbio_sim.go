@@ -0,0 +1,488 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * USB low-level I/O. Simulated IPP-over-USB devices, pure Go
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// UsbSimBackend implements UsbBackend on a top of simulated
+// IPP-over-USB devices. Each simulated device serves HTTP
+// requests, received over its "USB" interfaces, by the
+// in-memory http.Handler
+//
+// This backend is intended for testing, so the entire
+// HTTP-over-USB path can be exercised without real hardware
+type UsbSimBackend struct {
+	lock    sync.Mutex                // Access lock
+	devices map[UsbAddr]*UsbSimDevice // Connected devices
+}
+
+// UsbSimDevice represents a simulated IPP-over-USB device
+//
+// Handler may use http.Hijacker to write raw data into the
+// interface, for example, to simulate malformed responses. After
+// handler returns, device continues to serve the next requests
+type UsbSimDevice struct {
+	UsbAddr                  // Device address
+	Info       UsbDeviceInfo // Device information
+	Interfaces int           // Count of IPP-over-USB interfaces
+	Handler    http.Handler  // Handler for incoming HTTP requests
+	Reenum     bool          // Device re-enumerates on reset
+
+	lock    sync.Mutex               // Access lock
+	claimed map[int]*usbSimInterface // Claimed interfaces, by number
+	resets  int32                    // Count of device resets
+	removed bool                     // Device removed from the bus
+}
+
+// NewUsbSimBackend creates a new UsbSimBackend without devices
+func NewUsbSimBackend() *UsbSimBackend {
+	return &UsbSimBackend{
+		devices: make(map[UsbAddr]*UsbSimDevice),
+	}
+}
+
+// Add connects simulated device to the backend and sends
+// hotplug notification
+func (backend *UsbSimBackend) Add(dev *UsbSimDevice) {
+	dev.lock.Lock()
+	dev.claimed = make(map[int]*usbSimInterface)
+	dev.removed = false
+	dev.lock.Unlock()
+
+	backend.lock.Lock()
+	backend.devices[dev.UsbAddr] = dev
+	backend.lock.Unlock()
+
+	usbHotPlugNotify()
+}
+
+// Remove disconnects simulated device from the backend and
+// sends hotplug notification. All I/O to the device fails
+// after that
+func (backend *UsbSimBackend) Remove(addr UsbAddr) {
+	backend.lock.Lock()
+	dev := backend.devices[addr]
+	delete(backend.devices, addr)
+	backend.lock.Unlock()
+
+	if dev != nil {
+		dev.lock.Lock()
+		dev.removed = true
+		for _, iface := range dev.claimed {
+			iface.disconnect()
+		}
+		dev.lock.Unlock()
+	}
+
+	usbHotPlugNotify()
+}
+
+// Init initializes the backend
+func (backend *UsbSimBackend) Init() error {
+	return nil
+}
+
+// GetIppOverUsbDeviceDescs return list of IPP-over-USB
+// device descriptors
+func (backend *UsbSimBackend) GetIppOverUsbDeviceDescs() (
+	map[UsbAddr]UsbDeviceDesc, error) {
+
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+
+	descs := make(map[UsbAddr]UsbDeviceDesc)
+	for addr, dev := range backend.devices {
+		descs[addr] = dev.desc()
+	}
+
+	return descs, nil
+}
+
+// OpenDevice opens device by device descriptor
+func (backend *UsbSimBackend) OpenDevice(desc UsbDeviceDesc) (
+	UsbDevHandle, error) {
+
+	backend.lock.Lock()
+	dev := backend.devices[desc.UsbAddr]
+	backend.lock.Unlock()
+
+	if dev == nil {
+		return nil, UsbError{"sim_open", UsbENotFound}
+	}
+
+	return &usbSimDevHandle{dev: dev}, nil
+}
+
+// Resets returns count of device resets, performed so far
+func (dev *UsbSimDevice) Resets() int {
+	return int(atomic.LoadInt32(&dev.resets))
+}
+
+// desc builds device descriptor
+//
+// Simulated device has a single configuration, with the legacy
+// 7/1/2 printer interface number 0, followed by the requested
+// number of 7/1/4 IPP-over-USB interfaces
+func (dev *UsbSimDevice) desc() UsbDeviceDesc {
+	desc := UsbDeviceDesc{
+		UsbAddr: dev.UsbAddr,
+		Config:  1,
+	}
+
+	desc.IfDescs = append(desc.IfDescs, UsbIfDesc{
+		Config: 1, IfNum: 0, Class: 7, SubClass: 1, Proto: 2,
+	})
+
+	for i := 1; i <= dev.Interfaces; i++ {
+		desc.IfDescs = append(desc.IfDescs, UsbIfDesc{
+			Config: 1, IfNum: i, Class: 7, SubClass: 1, Proto: 4,
+		})
+
+		desc.IfAddrs.Add(UsbIfAddr{
+			UsbAddr: dev.UsbAddr,
+			Num:     i,
+			In:      i,
+			Out:     i,
+		})
+	}
+
+	return desc
+}
+
+// usbSimDevHandle represents an opened simulated device
+type usbSimDevHandle struct {
+	dev *UsbSimDevice // Underlying device
+}
+
+// Configure prepares the device for further work
+func (devhandle *usbSimDevHandle) Configure(desc UsbDeviceDesc,
+	quirks QuirksList) error {
+
+	return devhandle.check("sim_set_configuration")
+}
+
+// Close the device
+func (devhandle *usbSimDevHandle) Close() {
+}
+
+// Reset the device
+//
+// Simulated device drops all buffered data on all
+// its interfaces, much as the real device does
+//
+// If device re-enumerates on reset, it becomes inaccessible
+// via this handle
+func (devhandle *usbSimDevHandle) Reset() error {
+	dev := devhandle.dev
+
+	atomic.AddInt32(&dev.resets, 1)
+
+	dev.lock.Lock()
+	defer dev.lock.Unlock()
+
+	for _, iface := range dev.claimed {
+		iface.disconnect()
+	}
+
+	switch {
+	case dev.removed:
+		return UsbError{"sim_reset_device", UsbENoDev}
+	case dev.Reenum:
+		dev.removed = true
+		return UsbError{"sim_reset_device", UsbENotFound}
+	}
+
+	return nil
+}
+
+// UsbDeviceInfo returns UsbDeviceInfo for the device
+func (devhandle *usbSimDevHandle) UsbDeviceInfo() (UsbDeviceInfo, error) {
+	err := devhandle.check("sim_get_device_descriptor")
+	if err != nil {
+		return UsbDeviceInfo{}, err
+	}
+
+	info := devhandle.dev.Info
+	info.FixUp()
+
+	return info, nil
+}
+
+// OpenUsbInterface claims and opens an interface
+func (devhandle *usbSimDevHandle) OpenUsbInterface(addr UsbIfAddr,
+	quirks QuirksList) (UsbInterface, error) {
+
+	dev := devhandle.dev
+
+	dev.lock.Lock()
+	defer dev.lock.Unlock()
+
+	switch {
+	case dev.removed:
+		return nil, UsbError{"sim_claim_interface", UsbENoDev}
+	case addr.Num < 1 || addr.Num > dev.Interfaces:
+		return nil, UsbError{"sim_claim_interface", UsbENotFound}
+	case dev.claimed[addr.Num] != nil:
+		return nil, UsbError{"sim_claim_interface", UsbEBusy}
+	}
+
+	iface := &usbSimInterface{
+		devhandle: devhandle,
+		addr:      addr,
+	}
+	iface.connect()
+
+	dev.claimed[addr.Num] = iface
+
+	return iface, nil
+}
+
+// check returns UsbENoDev error if device is removed
+func (devhandle *usbSimDevHandle) check(fn string) error {
+	dev := devhandle.dev
+
+	dev.lock.Lock()
+	defer dev.lock.Unlock()
+
+	if dev.removed {
+		return UsbError{fn, UsbENoDev}
+	}
+
+	return nil
+}
+
+// usbSimInterface represents an opened interface of the simulated
+// device
+//
+// Bulk endpoints are modeled by the synchronous in-memory
+// full-duplex connection (net.Pipe()), and the device side
+// of this connection is served by the separate goroutine
+type usbSimInterface struct {
+	devhandle *usbSimDevHandle // Device handle
+	addr      UsbIfAddr        // Interface address
+	lock      sync.Mutex       // Access lock
+	host      net.Conn         // Host side of connection
+	device    net.Conn         // Device side of connection
+}
+
+// Close the interface
+func (iface *usbSimInterface) Close() {
+	dev := iface.devhandle.dev
+
+	dev.lock.Lock()
+	if dev.claimed[iface.addr.Num] == iface {
+		delete(dev.claimed, iface.addr.Num)
+	}
+	dev.lock.Unlock()
+
+	iface.disconnect()
+}
+
+// SoftReset performs interface soft reset
+//
+// Like the real device, simulated device drops all buffered
+// data and starts to wait for the next request
+func (iface *usbSimInterface) SoftReset() error {
+	iface.disconnect()
+
+	dev := iface.devhandle.dev
+	dev.lock.Lock()
+	defer dev.lock.Unlock()
+
+	if dev.removed {
+		return UsbError{"sim_control_transfer", UsbENoDev}
+	}
+
+	iface.connect()
+	return nil
+}
+
+// Send data to interface. Returns count of bytes actually transmitted
+// and error, if any
+func (iface *usbSimInterface) Send(data []byte,
+	timeout time.Duration) (n int, err error) {
+
+	host := iface.conn()
+	host.SetWriteDeadline(usbSimDeadline(timeout))
+	n, err = host.Write(data)
+
+	return n, usbSimError(err)
+}
+
+// Recv data from interface. Returns count of bytes actually transmitted
+// and error, if any
+func (iface *usbSimInterface) Recv(data []byte,
+	timeout time.Duration) (n int, err error) {
+
+	host := iface.conn()
+	host.SetReadDeadline(usbSimDeadline(timeout))
+	n, err = host.Read(data)
+
+	return n, usbSimError(err)
+}
+
+// ClearHalt clears "halted" condition of either input
+// or output endpoint
+func (iface *usbSimInterface) ClearHalt(in bool) error {
+	return nil
+}
+
+// connect creates a new connection between host and device
+// and starts device-side goroutine
+func (iface *usbSimInterface) connect() {
+	host, device := net.Pipe()
+
+	iface.lock.Lock()
+	iface.host, iface.device = host, device
+	iface.lock.Unlock()
+
+	go iface.serve(device)
+}
+
+// disconnect closes connection between host and device
+func (iface *usbSimInterface) disconnect() {
+	iface.lock.Lock()
+	iface.host.Close()
+	iface.device.Close()
+	iface.lock.Unlock()
+}
+
+// conn returns the host side of current connection
+func (iface *usbSimInterface) conn() net.Conn {
+	iface.lock.Lock()
+	defer iface.lock.Unlock()
+	return iface.host
+}
+
+// serve handles HTTP requests on a device side of connection
+func (iface *usbSimInterface) serve(device net.Conn) {
+	reader := bufio.NewReader(device)
+	writer := bufio.NewWriter(device)
+	handler := iface.devhandle.dev.Handler
+
+	for {
+		rq, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+
+		rsp := &usbSimResponseWriter{
+			header: make(http.Header),
+			conn:   device,
+			rw:     bufio.NewReadWriter(reader, writer),
+		}
+		handler.ServeHTTP(rsp, rq)
+
+		// Drain request body, if handler didn't consume it
+		io.Copy(ioutil.Discard, rq.Body)
+		rq.Body.Close()
+
+		if !rsp.hijacked {
+			err = rsp.response(rq).Write(writer)
+		}
+		if err == nil {
+			err = writer.Flush()
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// usbSimResponseWriter implements http.ResponseWriter for
+// simulated device. It collects the whole response in memory
+type usbSimResponseWriter struct {
+	header   http.Header       // Response header
+	status   int               // Response status
+	body     bytes.Buffer      // Response body
+	conn     net.Conn          // Device side of connection
+	rw       *bufio.ReadWriter // Buffered connection
+	hijacked bool              // Connection is hijacked
+}
+
+// Header returns response header
+func (rsp *usbSimResponseWriter) Header() http.Header {
+	return rsp.header
+}
+
+// Write writes response body
+func (rsp *usbSimResponseWriter) Write(data []byte) (int, error) {
+	if rsp.status == 0 {
+		rsp.status = http.StatusOK
+	}
+	return rsp.body.Write(data)
+}
+
+// WriteHeader writes response status
+func (rsp *usbSimResponseWriter) WriteHeader(status int) {
+	if rsp.status == 0 {
+		rsp.status = status
+	}
+}
+
+// Hijack lets the handler to write raw data into the connection.
+// It implements http.Hijacker interface
+//
+// Note, connection must not be closed by handler
+func (rsp *usbSimResponseWriter) Hijack() (net.Conn,
+	*bufio.ReadWriter, error) {
+	rsp.hijacked = true
+	return rsp.conn, rsp.rw, nil
+}
+
+// response builds http.Response
+func (rsp *usbSimResponseWriter) response(rq *http.Request) *http.Response {
+	if rsp.status == 0 {
+		rsp.status = http.StatusOK
+	}
+
+	return &http.Response{
+		Status:        http.StatusText(rsp.status),
+		StatusCode:    rsp.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        rsp.header,
+		ContentLength: int64(rsp.body.Len()),
+		Body:          ioutil.NopCloser(&rsp.body),
+		Request:       rq,
+	}
+}
+
+// usbSimDeadline converts USB timeout into net.Conn deadline
+func usbSimDeadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+// usbSimError converts net.Conn error into UsbError
+func usbSimError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+		return UsbError{"sim_bulk_transfer", UsbETimeout}
+	}
+
+	return UsbError{"sim_bulk_transfer", UsbENoDev}
+}
@@ -0,0 +1,1138 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for simulated IPP-over-USB devices
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// usbSimTestSetup prepares environment for tests, based on
+// simulated devices, and returns simulated backend with
+// the single device connected, and the cleanup function
+func usbSimTestSetup(t *testing.T) (*UsbSimBackend, *UsbSimDevice, func()) {
+	dir, err := ioutil.TempDir("", "ipp-usb-test")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	PathConfDir = filepath.Join(dir, "conf")
+	PathQuirksDir = filepath.Join(dir, "quirks")
+	PathSetStateDir(dir)
+	PathSetLogDir(filepath.Join(dir, "log"))
+
+	Log.ToNowhere()
+	Console.ToNowhere()
+	confTestSet(func(conf *Configuration) { conf.DNSSdEnable = false })
+
+	dev := &UsbSimDevice{
+		UsbAddr: UsbAddr{Bus: 1, Address: 2},
+		Info: UsbDeviceInfo{
+			Vendor:       0x03f0,
+			Product:      0x0001,
+			SerialNumber: "SIM0001",
+			Manufacturer: "Simulated",
+			ProductName:  "IPP-over-USB Printer",
+		},
+		Interfaces: 3,
+		Handler:    http.HandlerFunc(usbSimTestHandler),
+	}
+
+	backend := NewUsbSimBackend()
+	backend.Add(dev)
+	UsbSetBackend(backend)
+
+	cleanup := func() {
+		UsbSetBackend(libusbBackend{})
+		os.RemoveAll(dir)
+	}
+
+	return backend, dev, cleanup
+}
+
+// usbSimTestStartPnP starts PnP manager and returns the channel,
+// that receives its exit reason
+func usbSimTestStartPnP() chan PnPExitReason {
+	exited := make(chan PnPExitReason)
+	go func() {
+		exited <- PnPStart(true)
+	}()
+
+	return exited
+}
+
+// usbSimTestWaitReady waits until the single simulated device,
+// served by PnP manager, is ready, and returns its status
+func usbSimTestWaitReady(t *testing.T) PnPDevStatus {
+	var st PnPDevStatus
+	for tm := time.Now(); st.State != PnPDevReady; {
+		if time.Since(tm) > DevInitTimeout {
+			t.Fatalf("PnPStatus: device not ready: %+v", PnPStatus())
+		}
+
+		time.Sleep(50 * time.Millisecond)
+		if status := PnPStatus(); len(status) == 1 {
+			st = status[0]
+		}
+	}
+
+	return st
+}
+
+// usbSimTestHandler serves HTTP requests for simulated device
+func usbSimTestHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/ipp/print":
+		msg := goipp.NewResponse(goipp.DefaultVersion, goipp.StatusOk, 1)
+		msg.Operation.Add(goipp.MakeAttribute("attributes-charset",
+			goipp.TagCharset, goipp.String("utf-8")))
+		msg.Operation.Add(goipp.MakeAttribute("attributes-natural-language",
+			goipp.TagLanguage, goipp.String("en-US")))
+		msg.Printer.Add(goipp.MakeAttribute("printer-make-and-model",
+			goipp.TagText, goipp.String("Simulated IPP-over-USB Printer")))
+
+		data, _ := msg.EncodeBytes()
+		w.Header().Set("Content-Type", goipp.ContentType)
+		w.Write(data)
+
+	case "/":
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("Hello from simulated device"))
+
+	case "/garbage":
+		// Valid response, followed by garbage
+		_, rw, _ := w.(http.Hijacker).Hijack()
+		rw.WriteString("HTTP/1.1 200 OK\r\n")
+		rw.WriteString("Content-Length: 5\r\n\r\n")
+		rw.WriteString("hello")
+		rw.WriteString("garbage")
+
+	case "/malformed":
+		_, rw, _ := w.(http.Hijacker).Hijack()
+		rw.WriteString("malformed\r\n\r\n")
+
+	case "/stall":
+		time.Sleep(5 * time.Second)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Test HTTP requests over UsbTransport, backed by the simulated device
+func TestUsbSimTransport(t *testing.T) {
+	backend, dev, cleanup := usbSimTestSetup(t)
+	defer cleanup()
+
+	descs, err := UsbGetIppOverUsbDeviceDescs()
+	if err != nil {
+		t.Fatalf("UsbGetIppOverUsbDeviceDescs: %s", err)
+	}
+
+	desc, found := descs[dev.UsbAddr]
+	if !found {
+		t.Fatalf("%s: device not found", dev.UsbAddr)
+	}
+
+	if len(desc.IfAddrs) != dev.Interfaces {
+		t.Fatalf("%s: expected %d interfaces, got %d",
+			dev.UsbAddr, dev.Interfaces, len(desc.IfAddrs))
+	}
+
+	transport, err := NewUsbTransport(desc)
+	if err != nil {
+		t.Fatalf("NewUsbTransport: %s", err)
+	}
+	defer transport.Close(false)
+
+	c := &http.Client{Transport: transport}
+
+	// Perform several sequential requests, so connections
+	// are reused
+	for i := 0; i < 2*dev.Interfaces; i++ {
+		resp, err := c.Get("http://localhost/")
+		if err != nil {
+			t.Fatalf("GET #%d: %s", i, err)
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if err != nil {
+			t.Fatalf("GET #%d: %s", i, err)
+		}
+
+		if string(body) != "Hello from simulated device" {
+			t.Fatalf("GET #%d: unexpected body %q", i, body)
+		}
+	}
+
+	// Check status code propagation
+	resp, err := c.Get("http://localhost/not-found")
+	if err != nil {
+		t.Fatalf("GET: %s", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("GET: expected %d, got %d",
+			http.StatusNotFound, resp.StatusCode)
+	}
+
+	// Now remove the device. Requests must fail
+	backend.Remove(dev.UsbAddr)
+
+	resp, err = c.Get("http://localhost/")
+	if err == nil {
+		resp.Body.Close()
+		t.Fatalf("GET: succeeded after device removal")
+	}
+}
+
+// Test Device, backed by the simulated device
+func TestUsbSimDevice(t *testing.T) {
+	_, dev, cleanup := usbSimTestSetup(t)
+	defer cleanup()
+
+	descs, err := UsbGetIppOverUsbDeviceDescs()
+	if err != nil {
+		t.Fatalf("UsbGetIppOverUsbDeviceDescs: %s", err)
+	}
+
+	device, err := NewDevice(context.Background(), descs[dev.UsbAddr])
+	if err != nil {
+		t.Fatalf("NewDevice: %s", err)
+	}
+	defer device.Close()
+
+	// Check persistent state
+	if device.State.DNSSdName != "Simulated IPP-over-USB Printer" {
+		t.Fatalf("DNS-SD name: unexpected %q", device.State.DNSSdName)
+	}
+
+	// Query device via HTTP proxy
+	uri := fmt.Sprintf("http://localhost:%d/", device.State.HTTPPort)
+	resp, err := http.Get(uri)
+	if err != nil {
+		t.Fatalf("GET %s: %s", uri, err)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if err != nil {
+		t.Fatalf("GET %s: %s", uri, err)
+	}
+
+	if string(body) != "Hello from simulated device" {
+		t.Fatalf("GET %s: unexpected body %q", uri, body)
+	}
+}
+
+// Test resynchronization of desynchronized connections
+func TestUsbSimResync(t *testing.T) {
+	_, dev, cleanup := usbSimTestSetup(t)
+	defer cleanup()
+
+	// Use the single interface, so the same connection
+	// is used for all requests
+	dev.Interfaces = 1
+
+	descs, err := UsbGetIppOverUsbDeviceDescs()
+	if err != nil {
+		t.Fatalf("UsbGetIppOverUsbDeviceDescs: %s", err)
+	}
+
+	transport, err := NewUsbTransport(descs[dev.UsbAddr])
+	if err != nil {
+		t.Fatalf("NewUsbTransport: %s", err)
+	}
+	defer transport.Close(false)
+
+	c := &http.Client{Transport: transport}
+
+	get := func(path string) (string, error) {
+		resp, err := c.Get("http://localhost" + path)
+		if err != nil {
+			return "", err
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		return string(body), err
+	}
+
+	check := func() {
+		body, err := get("/")
+		if err != nil {
+			t.Fatalf("GET /: %s", err)
+		}
+
+		if body != "Hello from simulated device" {
+			t.Fatalf("GET /: unexpected body %q", body)
+		}
+	}
+
+	// Extra data after response
+	body, err := get("/garbage")
+	if err != nil {
+		t.Fatalf("GET /garbage: %s", err)
+	}
+
+	if body != "hello" {
+		t.Fatalf("GET /garbage: unexpected body %q", body)
+	}
+
+	check()
+
+	// Malformed response
+	_, err = get("/malformed")
+	if err == nil {
+		t.Fatalf("GET /malformed: error expected")
+	}
+
+	check()
+
+	if atomic.LoadInt32(&transport.needReset) != 0 {
+		t.Fatalf("device reset requested unexpectedly")
+	}
+
+	// Too many resyncs in a row must cause device reset request
+	for i := 0; i < UsbResyncMaxAttempts; i++ {
+		get("/garbage")
+	}
+
+	check()
+
+	if atomic.LoadInt32(&transport.needReset) == 0 {
+		t.Fatalf("device reset not requested")
+	}
+
+	select {
+	case addr := <-pnpResetChan:
+		if addr != dev.UsbAddr {
+			t.Fatalf("reset requested for %s, expected %s",
+				addr, dev.UsbAddr)
+		}
+	default:
+		t.Fatalf("reset request not received by PnP")
+	}
+}
+
+// Test that connection, that cannot be resynchronized, is not
+// considered in use anymore
+func TestUsbSimDeadConn(t *testing.T) {
+	backend, dev, cleanup := usbSimTestSetup(t)
+	defer cleanup()
+
+	descs, err := UsbGetIppOverUsbDeviceDescs()
+	if err != nil {
+		t.Fatalf("UsbGetIppOverUsbDeviceDescs: %s", err)
+	}
+
+	transport, err := NewUsbTransport(descs[dev.UsbAddr])
+	if err != nil {
+		t.Fatalf("NewUsbTransport: %s", err)
+	}
+	defer transport.Close(false)
+
+	conn, err := transport.usbConnGet(context.Background())
+	if err != nil {
+		t.Fatalf("usbConnGet: %s", err)
+	}
+
+	// All resync steps fail on removed device
+	backend.Remove(dev.UsbAddr)
+	conn.quarantine(fmt.Errorf("test"))
+	conn.put()
+	transport.resyncing.Wait()
+
+	if conn.health != usbConnDead {
+		t.Fatalf("connection not dead after resync failure")
+	}
+
+	if n := transport.connInUse(); n != 0 {
+		t.Fatalf("%d connections in use, expected 0", n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err = transport.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %s", err)
+	}
+
+	select {
+	case <-pnpResetChan:
+	default:
+		t.Fatalf("reset request not received by PnP")
+	}
+}
+
+// Test device reset on open, including device re-enumeration
+func TestUsbSimResetOnOpen(t *testing.T) {
+	_, dev, cleanup := usbSimTestSetup(t)
+	defer cleanup()
+
+	defer confTestSet(func(conf *Configuration) {
+		conf.Quirks = QuirksSet{
+			&Quirks{
+				Model:          "*",
+				HttpHeaders:    map[string]string{},
+				UsbResetOnOpen: true,
+				Params:         map[string]string{"usb-reset-on-open": "true"},
+			},
+		}
+	})()
+
+	descs, err := UsbGetIppOverUsbDeviceDescs()
+	if err != nil {
+		t.Fatalf("UsbGetIppOverUsbDeviceDescs: %s", err)
+	}
+
+	transport, err := NewUsbTransport(descs[dev.UsbAddr])
+	if err != nil {
+		t.Fatalf("NewUsbTransport: %s", err)
+	}
+	transport.Close(false)
+
+	if n := atomic.LoadInt32(&dev.resets); n != 1 {
+		t.Fatalf("%d device resets, expected 1", n)
+	}
+
+	// Handle is stale after re-enumeration
+	dev.Reenum = true
+	_, err = NewUsbTransport(descs[dev.UsbAddr])
+	if err != ErrDevReenum {
+		t.Fatalf("NewUsbTransport: %v, expected %v", err, ErrDevReenum)
+	}
+}
+
+// Test watchdog for stalled connections
+func TestUsbSimWatchdog(t *testing.T) {
+	_, dev, cleanup := usbSimTestSetup(t)
+	defer cleanup()
+
+	// Set short stall timeout
+	defer confTestSet(func(conf *Configuration) {
+		conf.Quirks = QuirksSet{
+			&Quirks{
+				Model:           "*",
+				HttpHeaders:     map[string]string{},
+				UsbStallTimeout: 2 * time.Second,
+				Params:          map[string]string{"usb-stall-timeout": "2s"},
+			},
+		}
+	})()
+
+	descs, err := UsbGetIppOverUsbDeviceDescs()
+	if err != nil {
+		t.Fatalf("UsbGetIppOverUsbDeviceDescs: %s", err)
+	}
+
+	transport, err := NewUsbTransport(descs[dev.UsbAddr])
+	if err != nil {
+		t.Fatalf("NewUsbTransport: %s", err)
+	}
+	defer transport.Close(false)
+
+	// Run HTTP proxy on a top of transport
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %s", err)
+	}
+
+	proxy := NewHTTPProxy(transport.Log(), listener, transport, nil, nil)
+	defer proxy.Close()
+	proxy.Enable()
+
+	// Stalled request must fail with 504
+	uri := fmt.Sprintf("http://%s/stall", listener.Addr())
+	resp, err := http.Get(uri)
+	if err != nil {
+		t.Fatalf("GET %s: %s", uri, err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("GET %s: expected %d, got %d", uri,
+			http.StatusGatewayTimeout, resp.StatusCode)
+	}
+
+	// Device reset must be requested
+	if atomic.LoadInt32(&transport.needReset) == 0 {
+		t.Fatalf("device reset not requested")
+	}
+
+	<-pnpResetChan
+}
+
+// Test identification of devices without serial numbers
+func TestUsbSimIdent(t *testing.T) {
+	backend, dev, cleanup := usbSimTestSetup(t)
+	defer cleanup()
+
+	// Two identical devices without serial number
+	dev.Info.SerialNumber = ""
+	dev.Info.PortPath = "1-1"
+
+	dev2 := &UsbSimDevice{
+		UsbAddr:    UsbAddr{Bus: 1, Address: 3},
+		Info:       dev.Info,
+		Interfaces: dev.Interfaces,
+		Handler:    dev.Handler,
+	}
+	dev2.Info.PortPath = "1-2"
+	backend.Add(dev2)
+
+	// Create legacy state file, without usb-port
+	info := dev.Info
+	info.FixUp()
+
+	legacy := &DevState{
+		Ident:         info.SerialIdent(),
+		DNSSdOverride: "Simulated IPP-over-USB Printer (2)",
+	}
+	legacy.path = legacy.devStatePath()
+
+	os.MkdirAll(PathProgStateDev, 0755)
+	err := ioutil.WriteFile(legacy.path, []byte(
+		"[device]\n"+
+			"dns-sd-name     = \"Simulated IPP-over-USB Printer\"\n"+
+			"dns-sd-override = \"Simulated IPP-over-USB Printer (2)\"\n"),
+		0644)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	// Initialize both devices
+	descs, err := UsbGetIppOverUsbDeviceDescs()
+	if err != nil {
+		t.Fatalf("UsbGetIppOverUsbDeviceDescs: %s", err)
+	}
+
+	device, err := NewDevice(context.Background(), descs[dev.UsbAddr])
+	if err != nil {
+		t.Fatalf("NewDevice: %s", err)
+	}
+	defer device.Close()
+
+	device2, err := NewDevice(context.Background(), descs[dev2.UsbAddr])
+	if err != nil {
+		t.Fatalf("NewDevice: %s", err)
+	}
+	defer device2.Close()
+
+	// Devices must have distinct identity
+	if device.State.Ident == device2.State.Ident {
+		t.Fatalf("both devices identified as %q", device.State.Ident)
+	}
+
+	if device.State.HTTPPort == device2.State.HTTPPort {
+		t.Fatalf("both devices use HTTP port %d", device.State.HTTPPort)
+	}
+
+	if device.State.UsbPort != "1-1" || device2.State.UsbPort != "1-2" {
+		t.Fatalf("usb-port: unexpected %q, %q",
+			device.State.UsbPort, device2.State.UsbPort)
+	}
+
+	// Legacy state must be inherited by the first device only
+	if device.State.DNSSdOverride != legacy.DNSSdOverride {
+		t.Fatalf("legacy state not migrated")
+	}
+
+	if device2.State.DNSSdOverride == legacy.DNSSdOverride {
+		t.Fatalf("legacy state migrated twice")
+	}
+
+	if _, err := os.Stat(legacy.path); err == nil {
+		t.Fatalf("legacy state file not removed")
+	}
+}
+
+// Test identification of devices with duplicated serial numbers
+func TestUsbSimIdentSerial(t *testing.T) {
+	backend, dev, cleanup := usbSimTestSetup(t)
+	defer cleanup()
+
+	// Two devices with the same serial number
+	dev.Info.PortPath = "1-1"
+
+	dev2 := &UsbSimDevice{
+		UsbAddr:    UsbAddr{Bus: 1, Address: 3},
+		Info:       dev.Info,
+		Interfaces: dev.Interfaces,
+		Handler:    dev.Handler,
+	}
+	dev2.Info.PortPath = "1-2"
+	backend.Add(dev2)
+
+	descs, err := UsbGetIppOverUsbDeviceDescs()
+	if err != nil {
+		t.Fatalf("UsbGetIppOverUsbDeviceDescs: %s", err)
+	}
+
+	// Initialize devices in the given order and return their
+	// identifiers, in order of USB addresses
+	idents := func(first, second *UsbSimDevice) [2]string {
+		transport, err := NewUsbTransport(descs[first.UsbAddr])
+		if err != nil {
+			t.Fatalf("NewUsbTransport: %s", err)
+		}
+		defer transport.Close(false)
+
+		transport2, err := NewUsbTransport(descs[second.UsbAddr])
+		if err != nil {
+			t.Fatalf("NewUsbTransport: %s", err)
+		}
+		defer transport2.Close(false)
+
+		info := transport.UsbDeviceInfo()
+		info2 := transport2.UsbDeviceInfo()
+		if !info.IdentByPort || !info2.IdentByPort {
+			t.Fatalf("duplicated serial: IdentByPort %v, %v",
+				info.IdentByPort, info2.IdentByPort)
+		}
+
+		if info.LegacyOwner == info2.LegacyOwner {
+			t.Fatalf("duplicated serial: LegacyOwner %v, %v",
+				info.LegacyOwner, info2.LegacyOwner)
+		}
+
+		if first != dev {
+			info, info2 = info2, info
+		}
+
+		return [2]string{info.Ident(), info2.Ident()}
+	}
+
+	forward := idents(dev, dev2)
+	backward := idents(dev2, dev)
+
+	if forward != backward {
+		t.Fatalf("identity depends on order: %q, %q", forward, backward)
+	}
+
+	// Device with unique serial number is identified by serial number
+	dev2.Info.SerialNumber = "SIM0002"
+
+	transport, err := NewUsbTransport(descs[dev.UsbAddr])
+	if err != nil {
+		t.Fatalf("NewUsbTransport: %s", err)
+	}
+	defer transport.Close(false)
+
+	if transport.UsbDeviceInfo().IdentByPort {
+		t.Fatalf("unique serial: identified by port")
+	}
+}
+
+// Test Device reattachment after device re-enumeration
+func TestUsbSimReattach(t *testing.T) {
+	backend, dev, cleanup := usbSimTestSetup(t)
+	defer cleanup()
+
+	descs, err := UsbGetIppOverUsbDeviceDescs()
+	if err != nil {
+		t.Fatalf("UsbGetIppOverUsbDeviceDescs: %s", err)
+	}
+
+	device, err := NewDevice(context.Background(), descs[dev.UsbAddr])
+	if err != nil {
+		t.Fatalf("NewDevice: %s", err)
+	}
+	defer device.Close()
+
+	// Device disappears from the bus
+	backend.Remove(dev.UsbAddr)
+	device.Detach()
+
+	// Request must wait until device is reattached
+	uri := fmt.Sprintf("http://localhost:%d/", device.State.HTTPPort)
+	done := make(chan error)
+
+	go func() {
+		resp, err := http.Get(uri)
+		if err == nil {
+			var body []byte
+			body, err = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if err == nil && string(body) != "Hello from simulated device" {
+				err = fmt.Errorf("unexpected body %q", body)
+			}
+		}
+		done <- err
+	}()
+
+	select {
+	case err = <-done:
+		t.Fatalf("GET %s: completed while detached (%v)", uri, err)
+	case <-time.After(250 * time.Millisecond):
+	}
+
+	// Device reappears at the new address
+	dev.UsbAddr = UsbAddr{Bus: 1, Address: 3}
+	backend.Add(dev)
+
+	descs, err = UsbGetIppOverUsbDeviceDescs()
+	if err != nil {
+		t.Fatalf("UsbGetIppOverUsbDeviceDescs: %s", err)
+	}
+
+	desc := descs[dev.UsbAddr]
+	transport, err := NewUsbTransport(desc)
+	if err != nil {
+		t.Fatalf("NewUsbTransport: %s", err)
+	}
+
+	if ident := transport.UsbDeviceInfo().Ident(); ident != device.State.Ident {
+		t.Fatalf("ident mismatch: %q != %q", ident, device.State.Ident)
+	}
+
+	device.Attach(desc, transport)
+
+	err = <-done
+	if err != nil {
+		t.Fatalf("GET %s: %s", uri, err)
+	}
+
+	// Detached and closed Device must fail waiting requests
+	device.Detach()
+	go func() {
+		resp, err := http.Get(uri)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusServiceUnavailable {
+				err = fmt.Errorf("unexpected status %d", resp.StatusCode)
+			} else {
+				err = nil
+			}
+		}
+		done <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	device.transport.Close()
+
+	err = <-done
+	if err != nil {
+		t.Fatalf("GET %s: %s", uri, err)
+	}
+}
+
+// Test parallel device initialization by PnP manager
+func TestUsbSimPnP(t *testing.T) {
+	backend, dev, cleanup := usbSimTestSetup(t)
+	defer cleanup()
+
+	// The slow device doesn't respond to IPP requests until
+	// the end of test
+	unblock := make(chan struct{})
+	defer close(unblock)
+
+	slow := &UsbSimDevice{
+		UsbAddr:    UsbAddr{Bus: 1, Address: 3},
+		Info:       dev.Info,
+		Interfaces: dev.Interfaces,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter,
+			r *http.Request) {
+			<-unblock
+		}),
+	}
+	slow.Info.SerialNumber = "SIM0002"
+	backend.Add(slow)
+
+	// Start PnP manager
+	exited := make(chan PnPExitReason)
+	go func() {
+		exited <- PnPStart(true)
+	}()
+
+	// Wait until the fast device is ready
+	info := dev.Info
+	info.FixUp()
+
+	statePath := (&DevState{Ident: info.Ident()}).devStatePath()
+	ready := false
+
+	for tm := time.Now(); !ready && time.Since(tm) < DevInitTimeout/2; {
+		time.Sleep(50 * time.Millisecond)
+
+		if _, err := os.Stat(statePath); err != nil {
+			continue
+		}
+
+		state := LoadDevState(info.Ident(), "")
+		uri := fmt.Sprintf("http://localhost:%d/", state.HTTPPort)
+		resp, err := http.Get(uri)
+		if err == nil {
+			resp.Body.Close()
+			ready = resp.StatusCode == http.StatusOK
+		}
+	}
+
+	if !ready {
+		t.Fatalf("fast device not ready while slow device initializing")
+	}
+
+	// Remove both devices. Initialization of the slow device
+	// must be canceled, and PnP manager must exit
+	tm := time.Now()
+	backend.Remove(slow.UsbAddr)
+	backend.Remove(dev.UsbAddr)
+
+	select {
+	case reason := <-exited:
+		if reason != PnPIdle {
+			t.Fatalf("PnPStart: unexpected exit reason %d", reason)
+		}
+	case <-time.After(DevInitTimeout):
+		t.Fatalf("PnPStart: not exited")
+	}
+
+	if elapsed := time.Since(tm); elapsed >= DevInitTimeout/2 {
+		t.Fatalf("PnPStart: exit took %s", elapsed)
+	}
+}
+
+// Test that PnP manager gives up on permanent errors
+func TestUsbSimPnPBlacklisted(t *testing.T) {
+	backend, dev, cleanup := usbSimTestSetup(t)
+	defer cleanup()
+
+	defer confTestSet(func(conf *Configuration) {
+		conf.Quirks = QuirksSet{
+			&Quirks{
+				Model:       "*",
+				Blacklist:   true,
+				HttpHeaders: map[string]string{},
+				Params:      map[string]string{},
+			},
+		}
+	})()
+
+	// Start PnP manager
+	exited := make(chan PnPExitReason)
+	go func() {
+		exited <- PnPStart(true)
+	}()
+
+	// Wait until device initialization fails
+	var status []PnPDevStatus
+	for tm := time.Now(); time.Since(tm) < DevInitTimeout; {
+		time.Sleep(50 * time.Millisecond)
+		status = PnPStatus()
+		if len(status) == 1 && status[0].State != PnPDevInitializing {
+			break
+		}
+	}
+
+	if len(status) != 1 {
+		t.Fatalf("PnPStatus: expected 1 device, got %d", len(status))
+	}
+
+	st := status[0]
+	if st.UsbAddr != dev.UsbAddr || st.State != PnPDevFailed ||
+		st.ErrClass != PnPErrBlacklisted || st.Attempts != 1 ||
+		!st.NextRetry.IsZero() {
+		t.Fatalf("PnPStatus: unexpected %+v", st)
+	}
+
+	backend.Remove(dev.UsbAddr)
+	<-exited
+
+	if status = PnPStatus(); len(status) != 0 {
+		t.Fatalf("PnPStatus: not empty after exit")
+	}
+}
+
+// Test configuration reload on SIGHUP
+func TestUsbSimPnPReload(t *testing.T) {
+	backend, dev, cleanup := usbSimTestSetup(t)
+	defer cleanup()
+
+	savedLevels := Log.Levels()
+	defer Log.SetLevels(savedLevels)
+	defer Log.ToNowhere()
+	defer confTestSet(func(conf *Configuration) { conf.Quirks = nil })()
+
+	// Count IPP requests, sent to each device. Initialization
+	// always starts from the IPP request
+	var reqs [2]int32
+	counter := func(n int) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter,
+			r *http.Request) {
+			if r.URL.Path == "/ipp/print" {
+				atomic.AddInt32(&reqs[n], 1)
+			}
+			usbSimTestHandler(w, r)
+		})
+	}
+
+	dev.Handler = counter(0)
+
+	dev2 := &UsbSimDevice{
+		UsbAddr:    UsbAddr{Bus: 1, Address: 3},
+		Info:       dev.Info,
+		Interfaces: dev.Interfaces,
+		Handler:    counter(1),
+	}
+	dev2.Info.SerialNumber = "SIM0002"
+	backend.Add(dev2)
+
+	// waitReady waits until both devices are ready
+	waitReady := func() {
+		for tm := time.Now(); time.Since(tm) < DevInitTimeout; {
+			time.Sleep(50 * time.Millisecond)
+			status := PnPStatus()
+			if len(status) == 2 &&
+				status[0].State == PnPDevReady &&
+				status[1].State == PnPDevReady {
+				return
+			}
+		}
+
+		t.Fatalf("PnPStatus: devices not ready: %+v", PnPStatus())
+	}
+
+	// Start PnP manager
+	exited := make(chan PnPExitReason)
+	go func() {
+		exited <- PnPStart(true)
+	}()
+
+	waitReady()
+	before := [2]int32{atomic.LoadInt32(&reqs[0]),
+		atomic.LoadInt32(&reqs[1])}
+
+	// Write new configuration and quirks, that affect only
+	// the second device, and send SIGHUP
+	os.MkdirAll(PathConfDir, 0755)
+	os.MkdirAll(PathQuirksDir, 0755)
+
+	logdir := filepath.Join(PathProgState, "newlog")
+	err := ioutil.WriteFile(filepath.Join(PathConfDir, ConfFileName),
+		[]byte("[network]\ndns-sd = disable\n"+
+			"[logging]\nmain-log = error\n"+
+			"[paths]\nlog-dir = "+logdir+"\n"), 0644)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(PathQuirksDir, "test.conf"),
+		[]byte("[*]\nusb-serial = SIM0002\nhttp-connection = close\n"),
+		0644)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+
+	// Wait until the second device is reinitialized
+	for tm := time.Now(); atomic.LoadInt32(&reqs[1]) == before[1]; {
+		if time.Since(tm) >= DevInitTimeout {
+			t.Fatalf("device not reinitialized after SIGHUP")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	waitReady()
+
+	if n := atomic.LoadInt32(&reqs[0]); n != before[0] {
+		t.Fatalf("unaffected device reinitialized (%d requests)",
+			n-before[0])
+	}
+
+	if Log.Levels() != LogError {
+		t.Fatalf("main log levels not updated: %v", Log.Levels())
+	}
+
+	// Log files must be reopened in the new log directory
+	Log.lock.Lock()
+	path := Log.path
+	Log.lock.Unlock()
+
+	if path != filepath.Join(logdir, "main.log") {
+		t.Fatalf("main log not reopened: %s", path)
+	}
+
+	for _, addr := range []UsbAddr{dev.UsbAddr, dev2.UsbAddr} {
+		transport := pnpStatusTransport(addr)
+		l := transport.Log()
+
+		l.lock.Lock()
+		path = l.path
+		l.lock.Unlock()
+
+		if path != logDevFilePath(transport.UsbDeviceInfo().Ident()) ||
+			filepath.Dir(path) != logdir {
+			t.Fatalf("%s: device log not reopened: %s", addr, path)
+		}
+	}
+
+	backend.Remove(dev.UsbAddr)
+	backend.Remove(dev2.UsbAddr)
+	<-exited
+}
+
+// usbSimPanicTransport wraps UsbTransport and panics on
+// requests to /panic
+type usbSimPanicTransport struct {
+	*UsbTransport
+}
+
+// RoundTripWithSession executes a single HTTP transaction
+func (pt usbSimPanicTransport) RoundTripWithSession(session int,
+	rq *http.Request) (*http.Response, error) {
+
+	if rq.URL.Path == "/panic" {
+		panic("test panic")
+	}
+
+	return pt.UsbTransport.RoundTripWithSession(session, rq)
+}
+
+// Test that panic in HTTP proxy affects only the device
+func TestUsbSimPanic(t *testing.T) {
+	_, dev, cleanup := usbSimTestSetup(t)
+	defer cleanup()
+
+	descs, err := UsbGetIppOverUsbDeviceDescs()
+	if err != nil {
+		t.Fatalf("UsbGetIppOverUsbDeviceDescs: %s", err)
+	}
+
+	transport, err := NewUsbTransport(descs[dev.UsbAddr])
+	if err != nil {
+		t.Fatalf("NewUsbTransport: %s", err)
+	}
+	defer transport.Close(false)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %s", err)
+	}
+
+	proxy := NewHTTPProxy(transport.Log(), listener,
+		usbSimPanicTransport{transport}, nil, nil)
+	defer proxy.Close()
+	proxy.Enable()
+
+	// Request must be aborted
+	uri := fmt.Sprintf("http://%s/panic", listener.Addr())
+	resp, err := http.Get(uri)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatalf("GET %s: expected error, got %s", uri, resp.Status)
+	}
+
+	// Device reinitialization must be requested
+	select {
+	case addr := <-pnpResetChan:
+		if addr != dev.UsbAddr {
+			t.Fatalf("reset requested for %s, expected %s",
+				addr, dev.UsbAddr)
+		}
+	default:
+		t.Fatalf("device reset not requested")
+	}
+
+	// Panic must be written to the device log
+	path := filepath.Join(PathLogDir, transport.UsbDeviceInfo().Ident()+".log")
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if !strings.Contains(string(data), "panic: test panic") {
+		t.Fatalf("panic not logged to device log")
+	}
+
+	// Device continues to serve until reinitialized
+	uri = fmt.Sprintf("http://%s/", listener.Addr())
+	resp, err = http.Get(uri)
+	if err != nil {
+		t.Fatalf("GET %s: %s", uri, err)
+	}
+	resp.Body.Close()
+}
+
+// Test that panic during device initialization is contained
+func TestUsbSimPnPPanic(t *testing.T) {
+	backend, dev, cleanup := usbSimTestSetup(t)
+	defer cleanup()
+
+	// Malformed media-size-supported, mixing collections
+	// and integers, panics in getPaperMax
+	dev.Handler = http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		if r.URL.Path != "/ipp/print" {
+			usbSimTestHandler(w, r)
+			return
+		}
+
+		msg := goipp.NewResponse(goipp.DefaultVersion, goipp.StatusOk, 1)
+		msg.Operation.Add(goipp.MakeAttribute("attributes-charset",
+			goipp.TagCharset, goipp.String("utf-8")))
+		msg.Operation.Add(goipp.MakeAttribute("attributes-natural-language",
+			goipp.TagLanguage, goipp.String("en-US")))
+
+		media := goipp.MakeAttribute("media-size-supported",
+			goipp.TagBeginCollection, goipp.Collection{})
+		media.Values.Add(goipp.TagInteger, goipp.Integer(1))
+		msg.Printer.Add(media)
+
+		data, _ := msg.EncodeBytes()
+		w.Header().Set("Content-Type", goipp.ContentType)
+		w.Write(data)
+	})
+
+	// Start PnP manager
+	exited := make(chan PnPExitReason)
+	go func() {
+		exited <- PnPStart(true)
+	}()
+
+	// Wait until device initialization fails
+	var status []PnPDevStatus
+	for tm := time.Now(); time.Since(tm) < DevInitTimeout; {
+		time.Sleep(50 * time.Millisecond)
+		status = PnPStatus()
+		if len(status) == 1 && status[0].State != PnPDevInitializing {
+			break
+		}
+	}
+
+	if len(status) != 1 {
+		t.Fatalf("PnPStatus: expected 1 device, got %d", len(status))
+	}
+
+	st := status[0]
+	if st.State != PnPDevRetry || st.Err != ErrPanic.Error() {
+		t.Fatalf("PnPStatus: unexpected %+v", st)
+	}
+
+	backend.Remove(dev.UsbAddr)
+	<-exited
+}
@@ -19,23 +19,29 @@ import (
 	"os"
 	"sort"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
 // UsbTransport implements HTTP transport functionality over USB
 type UsbTransport struct {
-	addr         UsbAddr       // Device address
-	info         UsbDeviceInfo // USB device info
-	log          *Logger       // Device's own logger
-	dev          *UsbDevHandle // Underlying USB device
-	connPool     chan *usbConn // Pool of idle connections
-	connList     []*usbConn    // List of all connections
-	connReleased chan struct{} // Signalled when connection released
-	shutdown     chan struct{} // Closed by Shutdown()
-	connstate    *usbConnState // Connections state tracker
-	quirks       []Quirks      // Device quirks
-	deadline     time.Time     // Deadline for requests
+	addr         UsbAddr        // Device address
+	info         UsbDeviceInfo  // USB device info
+	log          *Logger        // Device's own logger
+	dev          UsbDevHandle   // Underlying USB device
+	connPool     chan *usbConn  // Pool of idle connections
+	connList     []*usbConn     // List of all connections
+	connReleased chan struct{}  // Signalled when connection released
+	shutdown     chan struct{}  // Closed by Shutdown()
+	connstate    *usbConnState  // Connections state tracker
+	quirks       QuirksList     // Device quirks
+	deadline     atomic.Value   // Deadline for requests, time.Time
+	needReset    int32          // Device reset requested, atomic
+	resyncing    sync.WaitGroup // Connections being resynchronized
+	watchdogStop chan struct{}  // Closed to stop watchdog
+	watchdogDone chan struct{}  // Closed when watchdog stopped
+	metrics      *DevMetrics    // Device metrics
 }
 
 // NewUsbTransport creates new http.RoundTripper backed by IPP-over-USB
@@ -51,12 +57,14 @@ func NewUsbTransport(desc UsbDeviceDesc) (*UsbTransport, error) {
 		addr:         desc.UsbAddr,
 		log:          NewLogger(),
 		dev:          dev,
-		connPool:     make(chan *usbConn, len(desc.IfAddrs)),
 		connReleased: make(chan struct{}),
 		shutdown:     make(chan struct{}),
-		connstate:    newUsbConnState(len(desc.IfAddrs)),
+		watchdogStop: make(chan struct{}),
+		watchdogDone: make(chan struct{}),
 	}
 
+	ifaddrs := desc.IfAddrs
+
 	// Obtain device info
 	transport.info, err = dev.UsbDeviceInfo()
 	if err != nil {
@@ -64,12 +72,15 @@ func NewUsbTransport(desc UsbDeviceDesc) (*UsbTransport, error) {
 		return nil, err
 	}
 
+	usbIdentAcquire(desc.UsbAddr, &transport.info)
+	transport.metrics = MetricsDev(transport.info.Ident())
+
 	transport.log.Cc(Console)
 	transport.log.ToDevFile(transport.info)
-	transport.log.SetLevels(Conf.LogDevice)
+	transport.log.SetLevels(Conf().LogDevice)
 
 	// Setup quirks
-	transport.quirks = Conf.Quirks.Get(transport.info.MfgAndProduct)
+	transport.quirks = Conf().Quirks.Get(transport.info)
 
 	// Write device info to the log
 	log := transport.log.Begin().
@@ -81,16 +92,21 @@ func NewUsbTransport(desc UsbDeviceDesc) (*UsbTransport, error) {
 		Debug(' ', "  Manufacturer:  %s", transport.info.Manufacturer).
 		Debug(' ', "  Product:       %s", transport.info.ProductName).
 		Debug(' ', "  SerialNumber:  %s", transport.info.SerialNumber).
+		Debug(' ', "  PortPath:      %s", transport.info.PortPath).
 		Debug(' ', "  MfgAndProduct: %s", transport.info.MfgAndProduct).
 		Nl(LogDebug)
 
 	log.Debug(' ', "Device quirks:")
 	for _, quirks := range transport.quirks {
 		log.Debug(' ', "  from [%s] (%s)", quirks.Model, quirks.Origin)
+		log.Debug(' ', "    matched by: %s", quirks.Match)
 		log.Debug(' ', "    blacklist = %v", quirks.Blacklist)
 		for name, value := range quirks.HttpHeaders {
 			log.Debug(' ', "    http-%s = %q", strings.ToLower(name), value)
 		}
+		for name, value := range quirks.Params {
+			log.Debug(' ', "    %s = %q", name, value)
+		}
 	}
 	log.Nl(LogDebug)
 
@@ -119,14 +135,45 @@ func NewUsbTransport(desc UsbDeviceDesc) (*UsbTransport, error) {
 		goto ERROR
 	}
 
+	// Reset the device, if required
+	if transport.quirks.UsbResetOnOpen() {
+		transport.log.Debug(' ', "%s: resetting on open", transport.addr)
+		err = dev.Reset()
+
+		// If device re-enumerates after reset, the handle is stale.
+		// Device will appear at the new address, and if not, PnP
+		// manager will retry initialization
+		if usberr, ok := err.(UsbError); ok &&
+			(usberr.Code == UsbENotFound || usberr.Code == UsbENoDev) {
+			err = ErrDevReenum
+		}
+
+		if err != nil {
+			goto ERROR
+		}
+	}
+
 	// Configure the device
-	err = dev.Configure(desc)
+	err = dev.Configure(desc, transport.quirks)
 	if err != nil {
 		goto ERROR
 	}
 
+	time.Sleep(transport.quirks.UsbInitDelay())
+
+	// Limit count of used interfaces, if required
+	if max := transport.quirks.UsbMaxInterfaces(); max > 0 &&
+		len(ifaddrs) > max {
+		transport.log.Debug(' ', "%s: using %d of %d interfaces",
+			transport.addr, max, len(ifaddrs))
+		ifaddrs = ifaddrs[:max]
+	}
+
+	transport.connPool = make(chan *usbConn, len(ifaddrs))
+	transport.connstate = newUsbConnState(len(ifaddrs))
+
 	// Open connections
-	for i, ifaddr := range desc.IfAddrs {
+	for i, ifaddr := range ifaddrs {
 		var conn *usbConn
 		conn, err = transport.openUsbConn(i, ifaddr)
 		if err != nil {
@@ -136,6 +183,11 @@ func NewUsbTransport(desc UsbDeviceDesc) (*UsbTransport, error) {
 		transport.connList = append(transport.connList, conn)
 	}
 
+	// Start watchdog
+	go transport.watchdog(transport.quirks.UsbStallTimeout())
+
+	transport.metrics.attach(transport)
+
 	return transport, nil
 
 	// Error: cleanup and exit
@@ -145,6 +197,7 @@ ERROR:
 	}
 
 	dev.Close()
+	usbIdentRelease(transport.info)
 	return nil, err
 }
 
@@ -195,8 +248,12 @@ func (transport *UsbTransport) dumpUSBparams(log *LogMessage) {
 }
 
 // Get count of connections still in use
+//
+// Dead connections are never returned to the pool, so they
+// are not counted
 func (transport *UsbTransport) connInUse() int {
-	return cap(transport.connPool) - len(transport.connPool)
+	return cap(transport.connPool) - len(transport.connPool) -
+		transport.connstate.deadCount()
 }
 
 // SetDeadline sets the deadline for all requests, submitted
@@ -210,14 +267,23 @@ func (transport *UsbTransport) connInUse() int {
 // at this case synchronization with device will probably be lost
 //
 // A zero value for t means no timeout
+//
+// SetDeadline may be called concurrently with requests
+// processing, to interrupt them
 func (transport *UsbTransport) SetDeadline(t time.Time) {
-	transport.deadline = t
+	transport.deadline.Store(t)
+}
+
+// getDeadline returns deadline, previously set by SetDeadline()
+func (transport *UsbTransport) getDeadline() time.Time {
+	deadline, _ := transport.deadline.Load().(time.Time)
+	return deadline
 }
 
 // DeadlineExpired reports if deadline previously set by SetDeadline()
 // is already expired
 func (transport *UsbTransport) DeadlineExpired() bool {
-	deadline := transport.deadline
+	deadline := transport.getDeadline()
 	return !deadline.IsZero() && time.Until(deadline) <= 0
 }
 
@@ -248,19 +314,56 @@ func (transport *UsbTransport) Shutdown(ctx context.Context) error {
 	return nil
 }
 
+// requestReset requests the full device reset. Device will be
+// reset when transport is closed, and PnP manager is asked to
+// close and reinitialize the device
+func (transport *UsbTransport) requestReset(format string,
+	args ...interface{}) {
+
+	if atomic.SwapInt32(&transport.needReset, 1) == 0 {
+		reason := fmt.Sprintf(format, args...)
+		transport.log.Error('!', "%s: device reset requested: %s",
+			transport.addr, reason)
+		transport.metrics.reset()
+		pnpStatusError(transport.addr, "device reset: "+reason)
+		PnPRequestReset(transport.addr)
+	}
+}
+
+// Panicked handles panic, recovered in the device's goroutine
+//
+// Panic is written to the device's log, and device is reset
+// and reinitialized, so panic doesn't affect other devices
+func (transport *UsbTransport) Panicked(v interface{}) {
+	transport.log.Recovered(v)
+	transport.requestReset("panic: %v", v)
+}
+
 // Close the transport
 func (transport *UsbTransport) Close(reset bool) {
+	transport.metrics.detach(transport)
+
+	if atomic.LoadInt32(&transport.needReset) != 0 {
+		reset = true
+	}
+
 	if transport.connInUse() > 0 || reset {
 		transport.log.Info('-', "%s: resetting %s",
 			transport.addr, transport.info.ProductName)
 		transport.dev.Reset()
 	}
 
+	transport.resyncing.Wait()
+
+	close(transport.watchdogStop)
+	<-transport.watchdogDone
+
 	for _, conn := range transport.connList {
 		conn.destroy()
 	}
 
 	transport.dev.Close()
+	usbIdentRelease(transport.info)
 	transport.log.Info('-', "%s: removed %s",
 		transport.addr, transport.info.ProductName)
 }
@@ -270,6 +373,11 @@ func (transport *UsbTransport) Log() *Logger {
 	return transport.log
 }
 
+// Quirks returns device quirks
+func (transport *UsbTransport) Quirks() QuirksList {
+	return transport.quirks
+}
+
 // UsbDeviceInfo returns USB device information for the device
 // behind the transport
 func (transport *UsbTransport) UsbDeviceInfo() UsbDeviceInfo {
@@ -379,16 +487,12 @@ func (transport *UsbTransport) RoundTripWithSession(session int,
 	// Send request and receive a response
 	err = outreq.Write(conn)
 	if err != nil {
-		transport.log.HTTPError('!', session, "%s", err)
-		conn.put()
-		return nil, err
+		return nil, conn.failed(session, err)
 	}
 
 	resp, err := http.ReadResponse(conn.reader, outreq)
 	if err != nil {
-		transport.log.HTTPError('!', session, "%s", err)
-		conn.put()
-		return nil, err
+		return nil, conn.failed(session, err)
 	}
 
 	// Wrap response body
@@ -465,6 +569,10 @@ func (wrap *usbResponseBodyWrapper) Read(buf []byte) (int, error) {
 		wrap.log.HTTPDebug('<', wrap.session,
 			"response body: got %d bytes; %s", wrap.count, err)
 		wrap.drained = true
+
+		if err != io.EOF {
+			wrap.conn.quarantine(err)
+		}
 	}
 	return n, err
 }
@@ -484,11 +592,15 @@ func (wrap *usbResponseBodyWrapper) Close() error {
 		defer func() {
 			v := recover()
 			if v != nil {
-				Log.Panic(v)
+				wrap.conn.transport.Panicked(v)
 			}
 		}()
 
-		io.Copy(ioutil.Discard, wrap.body)
+		_, err := io.Copy(ioutil.Discard, wrap.body)
+		if err != nil {
+			wrap.conn.quarantine(err)
+		}
+
 		wrap.body.Close()
 		wrap.conn.put()
 	}()
@@ -497,15 +609,39 @@ func (wrap *usbResponseBodyWrapper) Close() error {
 }
 
 // usbConn implements an USB connection
+//
+// Note, cntRecv and cntSent are accessed atomically, so they
+// go first, to be properly aligned on 32-bit platforms
 type usbConn struct {
+	cntRecv   int64         // Total bytes received
+	cntSent   int64         // Total bytes sent
 	transport *UsbTransport // Transport that owns the connection
 	index     int           // Connection index (for logging)
-	iface     *UsbInterface // Underlying interface
+	ifaddr    UsbIfAddr     // Interface address
+	iface     UsbInterface  // Underlying interface
 	reader    *bufio.Reader // For http.ReadResponse
-	cntRecv   int           // Total bytes received
-	cntSent   int           // Total bytes sent
+	health    usbConnHealth // Connection health
+	resyncs   int           // Count of resyncs without successful use
+	stalled   int32         // Set by watchdog, atomic
 }
 
+// usbConnHealth represents health state of the usbConn
+type usbConnHealth int
+
+const (
+	// usbConnHealthy means connection is in sync with device
+	usbConnHealthy usbConnHealth = iota
+
+	// usbConnQuarantined means connection probably has lost
+	// synchronization with device, and must be resynchronized
+	// before it can be used again
+	usbConnQuarantined
+
+	// usbConnDead means connection cannot be resynchronized.
+	// It is not returned to the pool anymore
+	usbConnDead
+)
+
 // Open usbConn
 func (transport *UsbTransport) openUsbConn(
 	index int, ifaddr UsbIfAddr) (*usbConn, error) {
@@ -518,29 +654,30 @@ func (transport *UsbTransport) openUsbConn(
 	conn := &usbConn{
 		transport: transport,
 		index:     index,
+		ifaddr:    ifaddr,
 	}
 
 	conn.reader = bufio.NewReader(conn)
 
 	// Obtain interface
 	var err error
-	conn.iface, err = dev.OpenUsbInterface(ifaddr)
+	conn.iface, err = dev.OpenUsbInterface(ifaddr, transport.quirks)
 	if err != nil {
 		goto ERROR
 	}
 
-	// Soft-reset interface
-	//
-	// Note, disabled for now, because it causes problems
-	// with EPSON ET-4750 (see #17)
-	//
-	// May be in a future we will enable it conditionally,
-	// for some printer models (based on quirks)
+	// Soft-reset interface, if required
 	//
-	// err = conn.iface.SoftReset()
-	if err != nil {
-		// Don't treat it too seriously
-		transport.log.Info('?', "USB[%d]: SOFT_RESET: %s", index, err)
+	// Note, it is disabled by default, because it causes
+	// problems with EPSON ET-4750 (see #17)
+	if transport.quirks.UsbSoftReset() {
+		err = conn.iface.SoftReset()
+		if err != nil {
+			// Don't treat it too seriously
+			transport.log.Info('?', "USB[%d]: SOFT_RESET: %s",
+				index, err)
+			err = nil
+		}
 	}
 
 	return conn, nil
@@ -556,16 +693,39 @@ ERROR:
 }
 
 // Compute Recv/Send timeout
-func (conn *usbConn) timeout() (tm time.Duration, expored bool) {
-	deadline := conn.transport.deadline
+//
+// Returned timeout never exceeds UsbWatchdogInterval, so
+// blocked I/O can be interrupted by watchdog
+func (conn *usbConn) timeout() (tm time.Duration, expired bool) {
+	tm = UsbWatchdogInterval
+
+	deadline := conn.transport.getDeadline()
 	if deadline.IsZero() {
 		return
 	}
 
-	tm = time.Until(deadline)
+	if left := time.Until(deadline); left < tm {
+		tm = left
+	}
+
 	return tm, tm <= 0
 }
 
+// check returns error, if I/O cannot be continued, because
+// either deadline is expired or watchdog considers connection
+// stalled
+func (conn *usbConn) check() (time.Duration, error) {
+	tm, expired := conn.timeout()
+	switch {
+	case expired:
+		return 0, ErrInitTimedOut
+	case atomic.LoadInt32(&conn.stalled) != 0:
+		return 0, ErrUsbStalled
+	}
+
+	return tm, nil
+}
+
 // Read from USB
 func (conn *usbConn) Read(b []byte) (int, error) {
 	conn.transport.connstate.beginRead(conn)
@@ -587,17 +747,25 @@ func (conn *usbConn) Read(b []byte) (int, error) {
 
 	backoff := time.Millisecond * 100
 	for {
-		tm, expired := conn.timeout()
-		if expired {
-			return 0, ErrInitTimedOut
+		tm, err := conn.check()
+		if err != nil {
+			return 0, err
 		}
 
 		n, err := conn.iface.Recv(b, tm)
-		conn.cntRecv += n
+		total := atomic.AddInt64(&conn.cntRecv, int64(n))
+		conn.transport.metrics.usbIO(0, n, err)
+
+		if usbIsTimeout(err) {
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
 
 		conn.transport.log.Add(LogTraceHTTP, '<',
 			"USB[%d]: read: wanted %d got %d total %d",
-			conn.index, len(b), n, conn.cntRecv)
+			conn.index, len(b), n, total)
 
 		if err != nil {
 			conn.transport.log.Error('!',
@@ -623,34 +791,49 @@ func (conn *usbConn) Write(b []byte) (int, error) {
 	conn.transport.connstate.beginWrite(conn)
 	defer conn.transport.connstate.doneWrite(conn)
 
-	tm, expired := conn.timeout()
-	if expired {
-		return 0, ErrInitTimedOut
-	}
+	sent := 0
+	for len(b) > 0 {
+		tm, err := conn.check()
+		if err != nil {
+			return sent, err
+		}
 
-	n, err := conn.iface.Send(b, tm)
-	conn.cntSent += n
+		n, err := conn.iface.Send(b, tm)
+		total := atomic.AddInt64(&conn.cntSent, int64(n))
+		conn.transport.metrics.usbIO(n, 0, err)
+		sent += n
 
-	conn.transport.log.Add(LogTraceHTTP, '>',
-		"USB[%d]: write: wanted %d sent %d total %d",
-		conn.index, len(b), n, conn.cntSent)
+		conn.transport.log.Add(LogTraceHTTP, '>',
+			"USB[%d]: write: wanted %d sent %d total %d",
+			conn.index, len(b), n, total)
 
-	if err != nil {
-		conn.transport.log.Error('!',
-			"USB[%d]: send: %s", conn.index, err)
+		b = b[n:]
+
+		if usbIsTimeout(err) {
+			continue
+		}
+
+		if err != nil {
+			conn.transport.log.Error('!',
+				"USB[%d]: send: %s", conn.index, err)
+			return sent, err
+		}
 	}
 
-	return n, err
+	return sent, nil
 }
 
 // Allocate a connection
 func (transport *UsbTransport) usbConnGet(ctx context.Context) (*usbConn, error) {
+	start := time.Now()
+
 	select {
 	case <-transport.shutdown:
 		return nil, ErrShutdown
 	case <-ctx.Done():
 		return nil, ctx.Err()
 	case conn := <-transport.connPool:
+		transport.metrics.queueWait(time.Since(start))
 		transport.connstate.gotConn(conn)
 		transport.log.Debug(' ', "USB[%d]: connection allocated, %s",
 			conn.index, transport.connstate)
@@ -660,12 +843,45 @@ func (transport *UsbTransport) usbConnGet(ctx context.Context) (*usbConn, error)
 }
 
 // Release the connection
+//
+// If connection has lost synchronization with device, it is
+// resynchronized in background, before returning to the pool
 func (conn *usbConn) put() {
+	if n := conn.reader.Buffered(); n != 0 {
+		conn.quarantine(fmt.Errorf("%d bytes of unexpected data", n))
+	}
+
+	if conn.health == usbConnHealthy {
+		conn.resyncs = 0
+		conn.release()
+		return
+	}
+
+	conn.transport.resyncing.Add(1)
+	go func() {
+		defer func() {
+			v := recover()
+			if v != nil {
+				conn.transport.Panicked(v)
+			}
+		}()
+
+		defer conn.transport.resyncing.Done()
+
+		if conn.resync() {
+			conn.release()
+		}
+	}()
+}
+
+// release returns the connection into the pool
+func (conn *usbConn) release() {
 	transport := conn.transport
 
 	conn.reader.Reset(conn)
-	conn.cntRecv = 0
-	conn.cntSent = 0
+	atomic.StoreInt64(&conn.cntRecv, 0)
+	atomic.StoreInt64(&conn.cntSent, 0)
+	atomic.StoreInt32(&conn.stalled, 0)
 
 	transport.connstate.putConn(conn)
 	transport.log.Debug(' ', "USB[%d]: connection released, %s",
@@ -679,17 +895,228 @@ func (conn *usbConn) put() {
 	}
 }
 
+// dead accounts connection as dead. Dead connection is not
+// returned to the pool, but no longer considered in use
+func (conn *usbConn) dead() {
+	transport := conn.transport
+
+	transport.connstate.deadConn(conn)
+	transport.log.Debug(' ', "USB[%d]: connection dead, %s",
+		conn.index, transport.connstate)
+
+	select {
+	case transport.connReleased <- struct{}{}:
+	default:
+	}
+}
+
 // Destroy USB connection
 func (conn *usbConn) destroy() {
 	conn.transport.log.Debug(' ', "USB[%d]: closed", conn.index)
-	conn.iface.Close()
+	if conn.iface != nil {
+		conn.iface.Close()
+	}
+}
+
+// failed handles I/O error during HTTP transaction, and returns
+// error to be returned to the caller
+func (conn *usbConn) failed(session int, err error) error {
+	if atomic.LoadInt32(&conn.stalled) != 0 {
+		err = ErrUsbStalled
+	}
+
+	conn.transport.log.HTTPError('!', session, "%s", err)
+	conn.quarantine(err)
+	conn.put()
+
+	return err
+}
+
+// quarantine marks connection as probably desynchronized
+// with device
+func (conn *usbConn) quarantine(err error) {
+	if conn.health == usbConnHealthy {
+		conn.transport.log.Error('!',
+			"USB[%d]: quarantined: %s", conn.index, err)
+		conn.health = usbConnQuarantined
+	}
+}
+
+// resync attempts to restore synchronization between quarantined
+// connection and device. It returns true if connection can be
+// returned to the pool
+//
+// The following steps are taken, until one succeeds:
+//   1) drain data buffered by device and clear halt condition
+//      of both endpoints
+//   2) class-specific SOFT_RESET and drain
+//   3) release and reclaim the interface and drain
+//
+// If all steps fail, or connection needs resynchronization
+// too often, the full device reset is requested
+func (conn *usbConn) resync() bool {
+	transport := conn.transport
+	log := transport.log
+
+	conn.resyncs++
+	log.Info(' ', "USB[%d]: resync: attempt %d", conn.index, conn.resyncs)
+
+	// Drain and clear halt
+	err := conn.drain()
+	if err == nil {
+		err = conn.iface.ClearHalt(true)
+	}
+	if err == nil {
+		err = conn.iface.ClearHalt(false)
+	}
+
+	// Soft reset
+	if err != nil {
+		log.Error('!', "USB[%d]: resync: %s", conn.index, err)
+		log.Info(' ', "USB[%d]: resync: trying SOFT_RESET", conn.index)
+
+		err = conn.iface.SoftReset()
+		if err == nil {
+			err = conn.drain()
+		}
+	}
+
+	// Release and reclaim the interface
+	if err != nil {
+		log.Error('!', "USB[%d]: resync: %s", conn.index, err)
+		log.Info(' ', "USB[%d]: resync: reclaiming interface", conn.index)
+
+		conn.iface.Close()
+		conn.iface, err = transport.dev.OpenUsbInterface(conn.ifaddr,
+			transport.quirks)
+		if err == nil {
+			err = conn.drain()
+		}
+	}
+
+	// Check results
+	switch {
+	case err != nil:
+		log.Error('!', "USB[%d]: resync: %s", conn.index, err)
+		if conn.iface != nil {
+			conn.iface.Close()
+			conn.iface = nil
+		}
+		conn.health = usbConnDead
+		conn.dead()
+		transport.requestReset("USB[%d]: resync failed", conn.index)
+		return false
+
+	case conn.resyncs >= UsbResyncMaxAttempts:
+		transport.requestReset("USB[%d]: too many resyncs", conn.index)
+	}
+
+	log.Info(' ', "USB[%d]: resync: done", conn.index)
+	conn.health = usbConnHealthy
+	return true
+}
+
+// drain drains data, buffered by device. Device considered
+// drained, when no more data received within UsbDrainIdleTimeout
+func (conn *usbConn) drain() error {
+	buf := make([]byte, 16384)
+	total := 0
+	deadline := time.Now().Add(UsbDrainTimeout)
+
+	for time.Now().Before(deadline) {
+		n, err := conn.iface.Recv(buf, UsbDrainIdleTimeout)
+		total += n
+
+		if usbIsTimeout(err) {
+			conn.transport.log.Debug(' ',
+				"USB[%d]: resync: %d bytes drained",
+				conn.index, total)
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return fmt.Errorf("drain: device still sends data after %d bytes",
+		total)
+}
+
+// watchdog detects connections, blocked in read or write
+// without any progress for longer that threshold. Session,
+// performed over such a connection, is failed with the
+// ErrUsbStalled error, and device reset is requested
+//
+// Zero threshold disables the watchdog
+func (transport *UsbTransport) watchdog(threshold time.Duration) {
+	defer close(transport.watchdogDone)
+
+	if threshold == 0 {
+		<-transport.watchdogStop
+		return
+	}
+
+	type progress struct {
+		count int64     // Total bytes sent and received
+		since time.Time // Time of last progress
+	}
+
+	interval := UsbWatchdogInterval
+	if interval > threshold/2 {
+		interval = threshold / 2
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	progressList := make([]progress, len(transport.connList))
+
+	for {
+		var now time.Time
+
+		select {
+		case <-transport.watchdogStop:
+			return
+		case now = <-ticker.C:
+		}
+
+		for i, conn := range transport.connList {
+			count := atomic.LoadInt64(&conn.cntRecv) +
+				atomic.LoadInt64(&conn.cntSent)
+
+			p := &progressList[i]
+			if !transport.connstate.busy(conn) || count != p.count {
+				p.count, p.since = count, now
+				continue
+			}
+
+			if now.Sub(p.since) < threshold ||
+				!atomic.CompareAndSwapInt32(&conn.stalled, 0, 1) {
+				continue
+			}
+
+			transport.log.Error('!',
+				"USB[%d]: stalled: no progress for %s, %s",
+				conn.index, now.Sub(p.since), transport.connstate)
+
+			transport.requestReset("USB[%d]: stalled", conn.index)
+		}
+	}
+}
+
+// usbIsTimeout reports whether error is USB timeout
+func usbIsTimeout(err error) bool {
+	usberr, ok := err.(UsbError)
+	return ok && usberr.Code == UsbETimeout
 }
 
-// usbConnState tracks connections state, for logging
+// usbConnState tracks connections state, for logging and watchdog
 type usbConnState struct {
 	alloc []int32 // Per-connection "allocated" flag
 	read  []int32 // Per-connection "reading" flag
 	write []int32 // Per-connection "writing" flag
+	dead  []int32 // Per-connection "dead" flag
 }
 
 // newUsbConnState creates a new usbConnState for given
@@ -699,6 +1126,7 @@ func newUsbConnState(cnt int) *usbConnState {
 		alloc: make([]int32, cnt),
 		read:  make([]int32, cnt),
 		write: make([]int32, cnt),
+		dead:  make([]int32, cnt),
 	}
 }
 
@@ -712,6 +1140,24 @@ func (state *usbConnState) putConn(conn *usbConn) {
 	atomic.AddInt32(&state.alloc[conn.index], -1)
 }
 
+// deadConn notifies usbConnState, that allocated connection
+// is dead and will never be released
+func (state *usbConnState) deadConn(conn *usbConn) {
+	atomic.StoreInt32(&state.dead[conn.index], 1)
+	atomic.AddInt32(&state.alloc[conn.index], -1)
+}
+
+// deadCount returns count of dead connections
+func (state *usbConnState) deadCount() int {
+	cnt := 0
+	for i := range state.dead {
+		if atomic.LoadInt32(&state.dead[i]) != 0 {
+			cnt++
+		}
+	}
+	return cnt
+}
+
 // beginRead notifies usbConnState, that read is started
 func (state *usbConnState) beginRead(conn *usbConn) {
 	atomic.AddInt32(&state.read[conn.index], 1)
@@ -732,6 +1178,12 @@ func (state *usbConnState) doneWrite(conn *usbConn) {
 	atomic.AddInt32(&state.write[conn.index], -1)
 }
 
+// busy reports whether connection is blocked in read or write
+func (state *usbConnState) busy(conn *usbConn) bool {
+	return atomic.LoadInt32(&state.read[conn.index]) != 0 ||
+		atomic.LoadInt32(&state.write[conn.index]) != 0
+}
+
 // String returns a string, representing connections state
 func (state *usbConnState) String() string {
 	buf := make([]byte, 0, 64)
@@ -746,7 +1198,9 @@ func (state *usbConnState) String() string {
 			buf = append(buf, ' ')
 		}
 
-		if a|r|w == 0 {
+		if atomic.LoadInt32(&state.dead[i]) != 0 {
+			buf = append(buf, 'x', 'x', 'x')
+		} else if a|r|w == 0 {
 			buf = append(buf, '-', '-', '-')
 		} else {
 			used++